@@ -0,0 +1,286 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/encoding"
+)
+
+// status of instances received from agents, read like a status socket
+const agentSnapshotScheme = "agent://"
+
+var instanceNamePattern = regexp.MustCompile(`^[a-zA-Z0-9\._-]+$`)
+
+// agentSnapshot is streamed from agents to the collector for every instance.
+type agentSnapshot struct {
+	// Gateway is the --agent.name of the agent
+	Gateway  string    `json:"gateway"`
+	Instance string    `json:"instance"`
+	Time     time.Time `json:"time"`
+	MTU      int       `json:"mtu,omitempty"`
+	Methods  []string  `json:"methods,omitempty"`
+	Status   Message   `json:"status"`
+
+	// received is when the collector received the snapshot, as the clock
+	// of the agent may be off
+	received time.Time
+}
+
+type agentAck struct{}
+
+// jsonCodec encodes the agent messages as JSON, which spares generating
+// protobuf code for a single message type.
+type jsonCodec struct{}
+
+func (jsonCodec) Marshal(v interface{}) ([]byte, error)      { return json.Marshal(v) }
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error { return json.Unmarshal(data, v) }
+func (jsonCodec) Name() string                               { return "json" }
+
+func init() {
+	encoding.RegisterCodec(jsonCodec{})
+}
+
+var agentServiceDesc = grpc.ServiceDesc{
+	ServiceName: "fastdexporter.Agent",
+	HandlerType: (*interface{})(nil),
+	Streams: []grpc.StreamDesc{{
+		StreamName:    "Push",
+		Handler:       agentPushHandler,
+		ClientStreams: true,
+	}},
+}
+
+// agentSnapshots holds the last snapshot received for every gateway and
+// instance, keyed by gateway/instance.
+var agentSnapshots = struct {
+	sync.Mutex
+	snapshots map[string]agentSnapshot
+	exporters map[string]*PrometheusExporter
+}{snapshots: map[string]agentSnapshot{}, exporters: map[string]*PrometheusExporter{}}
+
+// agentTLSConfig loads the certificates for the mutual TLS between agents
+// and the collector.
+func agentTLSConfig(server bool) (*tls.Config, error) {
+	if *grpcTLSCA == "" || *grpcTLSCert == "" || *grpcTLSKey == "" {
+		return nil, errors.New("--grpc.tls-ca, --grpc.tls-cert and --grpc.tls-key are required unless --grpc.insecure is set")
+	}
+
+	certificate, err := tls.LoadX509KeyPair(*grpcTLSCert, *grpcTLSKey)
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(*grpcTLSCA)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificates found in %s", *grpcTLSCA)
+	}
+
+	config := &tls.Config{Certificates: []tls.Certificate{certificate}, MinVersion: tls.VersionTLS12}
+	if server {
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	} else {
+		config.RootCAs = pool
+	}
+	return config, nil
+}
+
+// runAgent streams snapshots of all instances to the collector every
+// --agent.interval.
+func runAgent(exporters []*PrometheusExporter) {
+	credential := insecure.NewCredentials()
+	if !*grpcInsecure {
+		config, err := agentTLSConfig(false)
+		if err != nil {
+			log.Fatal(err)
+		}
+		credential = credentials.NewTLS(config)
+	}
+
+	conn, err := grpc.Dial(*agentCollectorAddress, grpc.WithTransportCredentials(credential), grpc.WithDefaultCallOptions(grpc.CallContentSubtype(jsonCodec{}.Name())))
+	if err != nil {
+		log.Fatalf("Failed to connect to collector: %v", err)
+	}
+
+	ticker := time.NewTicker(*agentInterval)
+	defer ticker.Stop()
+
+	for {
+		if err := pushSnapshots(conn, exporters, ticker); err != nil {
+			log.Printf("Streaming to collector %s failed: %v", *agentCollectorAddress, err)
+		}
+		<-ticker.C
+	}
+}
+
+// pushSnapshots streams snapshots until the stream fails.
+func pushSnapshots(conn *grpc.ClientConn, exporters []*PrometheusExporter, ticker *time.Ticker) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	stream, err := conn.NewStream(ctx, &agentServiceDesc.Streams[0], "/"+agentServiceDesc.ServiceName+"/Push")
+	if err != nil {
+		return err
+	}
+
+	for {
+		for _, exporter := range exporters {
+			readCtx, readCancel := context.WithTimeout(ctx, exporter.settings.socketTimeout)
+			data, readTime, err := exporter.status(readCtx)
+			readCancel()
+			if err != nil {
+				// the collector reports the instance down once its
+				// snapshot is stale
+				continue
+			}
+
+			err = stream.SendMsg(&agentSnapshot{
+				Gateway:  *agentName,
+				Instance: exporter.instance,
+				Time:     readTime,
+				MTU:      exporter.configuredMTU,
+				Methods:  exporter.methods,
+				Status:   data,
+			})
+			if err != nil {
+				return err
+			}
+		}
+		<-ticker.C
+	}
+}
+
+// runCollector accepts snapshots from agents on --collector.listen-address.
+func runCollector() error {
+	listener, err := net.Listen("tcp", *collectorListenAddress)
+	if err != nil {
+		return err
+	}
+
+	var options []grpc.ServerOption
+	if !*grpcInsecure {
+		config, err := agentTLSConfig(true)
+		if err != nil {
+			return err
+		}
+		options = append(options, grpc.Creds(credentials.NewTLS(config)))
+	}
+
+	server := grpc.NewServer(options...)
+	server.RegisterService(&agentServiceDesc, nil)
+	go func() {
+		log.Fatal(server.Serve(listener))
+	}()
+	return nil
+}
+
+// agentPushHandler receives the snapshots of an agent. Every gateway and
+// instance is exported like a local instance, with the gateway label.
+func agentPushHandler(srv interface{}, stream grpc.ServerStream) error {
+	for {
+		var snapshot agentSnapshot
+		err := stream.RecvMsg(&snapshot)
+		if errors.Is(err, io.EOF) {
+			return stream.SendMsg(&agentAck{})
+		}
+		if err != nil {
+			return err
+		}
+		if !instanceNamePattern.MatchString(snapshot.Instance) || snapshot.Gateway == "" || strings.Contains(snapshot.Gateway, "/") {
+			return fmt.Errorf("invalid snapshot of gateway %q instance %q", snapshot.Gateway, snapshot.Instance)
+		}
+
+		key := snapshot.Gateway + "/" + snapshot.Instance
+		snapshot.received = time.Now()
+		agentSnapshots.Lock()
+		agentSnapshots.snapshots[key] = snapshot
+		if _, ok := agentSnapshots.exporters[key]; !ok {
+			exporter := NewPrometheusExporter(snapshot.Instance, fastdConfig{
+				statusSocketPath: agentSnapshotScheme + key,
+				gateway:          snapshot.Gateway,
+				mtu:              snapshot.MTU,
+				methods:          snapshot.Methods,
+			})
+			// its status is there to be read from the start
+			exporter.ready = true
+			if err := defaultExporterRegistries.register(exporter); err != nil {
+				agentSnapshots.Unlock()
+				return fmt.Errorf("failed to register instance %s of gateway %s: %w", snapshot.Instance, snapshot.Gateway, err)
+			}
+			agentSnapshots.exporters[key] = exporter
+			log.Printf("Receiving fastd data for %v from agent %v", snapshot.Instance, snapshot.Gateway)
+		}
+		agentSnapshots.Unlock()
+	}
+}
+
+// withAgentExporters returns the exporters followed by those discovered
+// after the start and those created for the instances of agents so far,
+// which come and go while the collector is running.
+func withAgentExporters(exporters []*PrometheusExporter) []*PrometheusExporter {
+	exporters = withDiscoveredExporters(exporters)
+
+	agentSnapshots.Lock()
+	defer agentSnapshots.Unlock()
+
+	if len(agentSnapshots.exporters) == 0 {
+		return exporters
+	}
+	keys := make([]string, 0, len(agentSnapshots.exporters))
+	for key := range agentSnapshots.exporters {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	all := append([]*PrometheusExporter{}, exporters...)
+	for _, key := range keys {
+		all = append(all, agentSnapshots.exporters[key])
+	}
+	return all
+}
+
+// agentSnapshotKey returns the gateway/instance of a status socket that
+// refers to snapshots received from an agent.
+func agentSnapshotKey(sock string) (string, bool) {
+	if !strings.HasPrefix(sock, agentSnapshotScheme) {
+		return "", false
+	}
+	return strings.TrimPrefix(sock, agentSnapshotScheme), true
+}
+
+// readAgentSnapshot returns the status of the last snapshot received for a
+// gateway and instance, which fails once it is older than
+// --collector.max-age.
+func readAgentSnapshot(key string) (Message, error) {
+	agentSnapshots.Lock()
+	defer agentSnapshots.Unlock()
+
+	snapshot, ok := agentSnapshots.snapshots[key]
+	if !ok {
+		return Message{}, fmt.Errorf("no snapshot received for %s", key)
+	}
+	if age := time.Since(snapshot.received); age > *collectorMaxAge {
+		return Message{}, fmt.Errorf("snapshot of %s was received %s ago: %w", key, age.Round(time.Second), errStatusFileStale)
+	}
+	return snapshot.Status, nil
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/netip"
+	"regexp"
+	"strings"
+	"time"
+)
+
+var publicKeyPattern = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+type peerDetails struct {
+	Name          string      `json:"name"`
+	Address       string      `json:"address,omitempty"`
+	Interface     string      `json:"interface,omitempty"`
+	Connected     bool        `json:"connected"`
+	Method        string      `json:"method,omitempty"`
+	UptimeSeconds float64     `json:"uptime_seconds,omitempty"`
+	Statistics    *Statistics `json:"statistics,omitempty"`
+
+	// session history since the exporter started
+	Sessions       int        `json:"sessions"`
+	ConnectedAt    *time.Time `json:"connected_at,omitempty"`
+	DisconnectedAt *time.Time `json:"disconnected_at,omitempty"`
+	Stalled        bool       `json:"stalled"`
+
+	// enrichment
+	AddressFamily string `json:"address_family,omitempty"`
+	NAT64         bool   `json:"nat64,omitempty"`
+	ASN           string `json:"asn,omitempty"`
+	Country       string `json:"country_code,omitempty"`
+	Site          string `json:"site,omitempty"`
+	Floating      *bool  `json:"floating,omitempty"`
+}
+
+// peerAPIHandler serves /api/v1/peers/<public key> with the details of a
+// single peer on all instances it is configured on.
+func peerAPIHandler(exporters []*PrometheusExporter) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		publicKey := strings.ToLower(strings.TrimPrefix(r.URL.Path, "/api/v1/peers/"))
+		if !publicKeyPattern.MatchString(publicKey) {
+			http.Error(w, "invalid public key", http.StatusBadRequest)
+			return
+		}
+
+		results := map[string]peerDetails{}
+		for _, exporter := range withAgentExporters(exporters) {
+			ctx, cancel := context.WithTimeout(r.Context(), exporter.settings.socketTimeout)
+			if details, ok := exporter.peerDetails(ctx, publicKey); ok {
+				results[exporter.instanceKey()] = details
+			}
+			cancel()
+		}
+
+		status := http.StatusOK
+		if len(results) == 0 {
+			status = http.StatusNotFound
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		err := json.NewEncoder(w).Encode(map[string]interface{}{"public_key": publicKey, "instances": results})
+		if err != nil {
+			log.Print(err)
+		}
+	})
+}
+
+// peerDetails returns what is known about a peer of the instance.
+func (exporter *PrometheusExporter) peerDetails(ctx context.Context, publicKey string) (peerDetails, bool) {
+	data, _, err := exporter.status(ctx)
+	if err != nil {
+		return peerDetails{}, false
+	}
+	peer, ok := data.Peers[publicKey]
+	if !ok {
+		return peerDetails{}, false
+	}
+
+	details := peerDetails{
+		Name:      publicPeerName(peer.Name),
+		Interface: peer.Interface,
+		Connected: peer.Connection != nil,
+	}
+	if data.Interface != "" {
+		details.Interface = data.Interface
+	}
+
+	if peer.Connection != nil {
+		statistics := peer.Connection.Statistics
+		details.Address = peer.Address
+		details.Method = peer.Connection.Method
+		details.UptimeSeconds = peer.Connection.Established / 1000
+		details.Statistics = &statistics
+
+		addr, nat64 := normalizePeerAddress(peer.Address)
+		details.AddressFamily = addressFamily(addr)
+		details.NAT64 = nat64
+		enriched := exporter.settings.enriched(publicKey, peer.Name)
+		if exporter.settings.asnLookup && enriched {
+			details.ASN = lookupASNs(ctx, []netip.Addr{addr})[addr]
+		}
+		if exporter.settings.geoip && enriched {
+			details.Country = lookupCountry(addr)
+		}
+		if len(exporterConfig.Sites) != 0 {
+			details.Site = peerSite(publicKey, addr)
+		}
+	}
+
+	if config, ok := exporter.peerConfigs()[publicKey]; ok {
+		details.Floating = &config.floating
+	}
+
+	exporter.peersMutex.Lock()
+	if state, ok := exporter.peers[publicKey]; ok {
+		if details.Interface == "" {
+			details.Interface = state.interfaceName
+		}
+		details.Sessions = state.sessions
+		if !state.connectedAt.IsZero() {
+			connectedAt := state.connectedAt
+			details.ConnectedAt = &connectedAt
+		}
+		if !state.disconnectedAt.IsZero() {
+			disconnectedAt := state.disconnectedAt
+			details.DisconnectedAt = &disconnectedAt
+		}
+		details.Stalled = exporter.settings.stalledPolls > 0 && state.unchangedPolls >= exporter.settings.stalledPolls
+	}
+	exporter.peersMutex.Unlock()
+
+	return details, true
+}
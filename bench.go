@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/expfmt"
+)
+
+// runBench implements the bench subcommand, which scrapes an instance with
+// synthetic status data and reports the cost of a collection, to measure
+// performance regressions before deploying to supernodes.
+func runBench(args []string) error {
+	flags := flag.NewFlagSet("bench", flag.ExitOnError)
+	peers := flags.Int("peers", 1000, "Number of peers in the synthetic status data.")
+	connected := flags.Float64("connected", 0.9, "Share of the peers that are connected.")
+	scrapes := flags.Int("scrapes", 100, "Number of scrapes to measure.")
+	flags.BoolVar(lite, "lite", false, "Benchmark the lite mode.")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *peers < 0 || *scrapes <= 0 || *connected < 0 || *connected > 1 {
+		return errors.New("--peers must not be negative, --scrapes must be positive and --connected between 0 and 1")
+	}
+
+	// enrichment would measure DNS and the kernel instead of the exporter
+	*ipAsnLookupEnable = false
+	*geoipDatabasePath = ""
+	*ifaceLookupEnable = false
+	if *lite {
+		applyLiteProfile()
+	}
+
+	directory, err := os.MkdirTemp("", "fastd-exporter-bench")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(directory)
+
+	statusFile := filepath.Join(directory, "status.json")
+	data, err := json.Marshal(benchStatus(*peers, *connected))
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(statusFile, data, 0o600); err != nil {
+		return err
+	}
+
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(NewPrometheusExporter("bench", fastdConfig{statusSocketPath: statusFileScheme + statusFile}))
+
+	var latencies []time.Duration
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	for i := 0; i < *scrapes; i++ {
+		start := time.Now()
+		if _, err := registry.Gather(); err != nil {
+			return err
+		}
+		latencies = append(latencies, time.Since(start))
+	}
+	runtime.ReadMemStats(&after)
+
+	families, err := registry.Gather()
+	if err != nil {
+		return err
+	}
+	var exposition bytes.Buffer
+	series := 0
+	for _, family := range families {
+		series += len(family.GetMetric())
+		if _, err := expfmt.MetricFamilyToText(&exposition, family); err != nil {
+			return err
+		}
+	}
+
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	percentile := func(p float64) time.Duration {
+		return latencies[int(p*float64(len(latencies)-1))]
+	}
+
+	fmt.Printf("peers:        %d (%d bytes of status data)\n", *peers, len(data))
+	fmt.Printf("scrapes:      %d\n", *scrapes)
+	fmt.Printf("latency:      min %s  p50 %s  p99 %s  max %s\n", latencies[0], percentile(0.5), percentile(0.99), latencies[len(latencies)-1])
+	fmt.Printf("allocations:  %d (%.1f KiB) per scrape\n", (after.Mallocs-before.Mallocs)/uint64(*scrapes), float64(after.TotalAlloc-before.TotalAlloc)/float64(*scrapes)/1024)
+	fmt.Printf("exposition:   %d series, %d bytes\n", series, exposition.Len())
+	return nil
+}
+
+// benchStatus generates the status of an instance with the given number of
+// peers, of which the given share is connected.
+func benchStatus(peers int, connected float64) Message {
+	statistics := func(i int) Statistics {
+		return Statistics{
+			Rx:          PacketStatistics{Count: 1000 * i, Bytes: 1000000 * i},
+			RxReordered: &PacketStatistics{Count: i, Bytes: 1000 * i},
+			Tx:          PacketStatistics{Count: 2000 * i, Bytes: 2000000 * i},
+			TxDropped:   &PacketStatistics{Count: i, Bytes: 1000 * i},
+			TxError:     &PacketStatistics{},
+		}
+	}
+
+	msg := Message{
+		Uptime:     float64(24 * time.Hour / time.Millisecond),
+		Interface:  "bench",
+		Statistics: statistics(peers),
+		Peers:      make(map[string]Peer, peers),
+	}
+	for i := 0; i < peers; i++ {
+		peer := Peer{
+			Name: fmt.Sprintf("node%d", i),
+			MAC:  []string{fmt.Sprintf("02:00:00:%02x:%02x:%02x", i>>16&0xff, i>>8&0xff, i&0xff)},
+		}
+		if float64(i) < connected*float64(peers) {
+			peer.Address = fmt.Sprintf("[2001:db8::%x]:10000", i)
+			if i%2 == 0 {
+				peer.Address = fmt.Sprintf("198.18.%d.%d:10000", i>>8&0xff, i&0xff)
+			}
+			peer.Connection = &struct {
+				Established float64    `json:"established"`
+				Method      string     `json:"method"`
+				Statistics  Statistics `json:"statistics"`
+				MAC         []string   `json:"mac_addresses"`
+			}{
+				Established: float64(i) * 1000,
+				Method:      "salsa2012+umac",
+				Statistics:  statistics(i),
+			}
+		}
+		msg.Peers[fmt.Sprintf("%064x", i)] = peer
+	}
+	return msg
+}
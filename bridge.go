@@ -0,0 +1,32 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// sysClassNet lists the network interfaces of the kernel, with a master
+// link to the bridge or batman-adv interface they are enslaved to.
+const sysClassNet = "/sys/class/net"
+
+// interfaceMaster returns the interface an interface is enslaved to, an
+// empty string if none or if it does not exist.
+func interfaceMaster(interfaceName string) string {
+	master, err := os.Readlink(filepath.Join(sysClassNet, interfaceName, "master"))
+	if err != nil {
+		return ""
+	}
+	return filepath.Base(master)
+}
+
+// collectBridges exports whether the interfaces of the instance and of its
+// connected peers are enslaved to the expected bridge, which catches hook
+// scripts that failed to add the interface of a new peer.
+func (exporter *PrometheusExporter) collectBridges(channel chan<- prometheus.Metric, interfaces map[string]bool) {
+	for interfaceName := range interfaces {
+		bridged := interfaceMaster(interfaceName) == exporter.settings.bridge
+		channel <- prometheus.MustNewConstMetric(exporter.interfaceBridged, prometheus.GaugeValue, boolToFloat64(bridged), interfaceName)
+	}
+}
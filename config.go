@@ -0,0 +1,492 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/netip"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+	"gopkg.in/yaml.v3"
+)
+
+// Config is the exporter configuration loaded from --config.
+type Config struct {
+	// ListenAddress is used instead of --web.listen-address unless that is
+	// given on the command line.
+	ListenAddress string `yaml:"listen_address"`
+	// Labels are added to the metrics of all instances.
+	Labels map[string]string `yaml:"labels"`
+	// ConfigPaths are tried in order to find the fastd config of an instance
+	// when --config-path is not given.
+	ConfigPaths []string `yaml:"config_paths"`
+	// Sites tag peers with the logical site or segment they belong to,
+	// the first matching site wins.
+	Sites []SiteConfig `yaml:"sites"`
+	// Instances holds settings of individual fastd instances by name.
+	Instances map[string]InstanceConfig `yaml:"instances"`
+	// Plugins are run for every instance on each scrape.
+	Plugins []PluginConfig `yaml:"plugins"`
+	// CriticalPeers marks peers like backbone links, whose disconnects
+	// matter more than those of client nodes.
+	CriticalPeers PeerPatterns `yaml:"critical_peers"`
+	// Enrichers are the names of the registered enrichers to enable.
+	Enrichers []string `yaml:"enrichers"`
+}
+
+type InstanceConfig struct {
+	// Enabled set to false skips the instance, e.g. because it is
+	// intentionally down on some hosts
+	Enabled *bool `yaml:"enabled"`
+	// DisplayName is a human friendly name of the instance, e.g.
+	// "Domain 3 / Darmstadt Nord"
+	DisplayName string `yaml:"display_name"`
+	// ListenAddress serves the metrics of the instance on an address of its
+	// own instead of along with the other instances
+	ListenAddress string `yaml:"listen_address"`
+	// Maintenance are recurring maintenance windows of the instance
+	Maintenance []MaintenanceWindow `yaml:"maintenance"`
+	// Socket is the status socket of the instance, as given on the command
+	// line after the instance name. Instances with a socket are exported
+	// without being given on the command line.
+	Socket string `yaml:"socket"`
+	// Labels are added to the metrics of the instance, overriding the
+	// global labels of the same name.
+	Labels map[string]string `yaml:"labels"`
+
+	// overrides of the flags of the same name
+	SocketTimeout          *time.Duration `yaml:"socket_timeout"`
+	SocketAttempts         *int           `yaml:"socket_attempts"`
+	SocketProxy            *string        `yaml:"socket_proxy"`
+	Netns                  *string        `yaml:"netns"`
+	ASNLookup              *bool          `yaml:"asn_lookup"`
+	GeoIP                  *bool          `yaml:"geoip"`
+	InterfaceLookup        *bool          `yaml:"interface_lookup"`
+	StalledPolls           *int           `yaml:"stalled_polls"`
+	FrozenPolls            *int           `yaml:"frozen_polls"`
+	PeersByPrefixThreshold *int           `yaml:"peers_by_prefix_threshold"`
+	PacketSizePerPeer      *bool          `yaml:"packet_size_per_peer"`
+	Bridge                 *string        `yaml:"bridge"`
+
+	// EnrichPeers restricts the ASN lookup and GeoIP to the matching peers,
+	// e.g. backbone links among thousands of nodes
+	EnrichPeers *PeerPatterns `yaml:"enrich_peers"`
+}
+
+// instanceSettings are the settings of an instance, taken from the flags
+// unless overridden in the config.
+type instanceSettings struct {
+	socketTimeout          time.Duration
+	socketAttempts         int
+	socketProxy            string
+	netns                  string
+	asnLookup              bool
+	geoip                  bool
+	interfaceLookup        bool
+	stalledPolls           int
+	frozenPolls            int
+	peersByPrefixThreshold int
+	packetSizePerPeer      bool
+	// interface the fastd interfaces should be enslaved to, none if empty
+	bridge string
+	// peers to enrich, all if nil
+	enrichPeers *PeerPatterns
+}
+
+// PeerPatterns select peers by their key or name.
+type PeerPatterns struct {
+	// Keys match the beginning of a peer's public key, critical peers given
+	// with their full key are reported down when fastd does not know them
+	Keys []string `yaml:"keys"`
+	// Names are glob patterns matching the name of a peer
+	Names []string `yaml:"names"`
+}
+
+type SiteConfig struct {
+	Name string `yaml:"name"`
+	// Prefixes match the remote address of a peer
+	Prefixes []netip.Prefix `yaml:"prefixes"`
+	// Keys match the beginning of a peer's public key
+	Keys []string `yaml:"keys"`
+}
+
+// exporterConfig is the configuration loaded from --config, empty if none is
+// given.
+var exporterConfig Config
+
+// staticLabelNames are the labels that tell the instances apart, set on
+// every metric of an instance.
+var staticLabelNames = map[string]bool{"fastd_instance": true, "host": true, "gateway": true}
+
+// reservedLabelNames are the labels of the metrics of the instances, which
+// the labels from the config are added to and must not repeat.
+var reservedLabelNames = map[string]bool{
+	"asn": true, "bucket": true, "cipher": true, "country_code": true,
+	"direction": true, "display_name": true, "group": true, "interface": true,
+	"ipaddr_family": true, "key_prefix": true, "kind": true, "le": true,
+	"mac": true, "method": true, "name": true, "offload": true, "prefix": true,
+	"public_key": true, "quantile": true, "reason": true, "release": true,
+	"remote": true, "site": true, "state": true, "tag": true, "version": true,
+}
+
+// checkPeerLabel validates a label added to the info metrics of peers, from
+// the peer files, the peer registry or an enricher, which must not repeat
+// the labels of the peer, of the instance or from the config.
+func (config Config) checkPeerLabel(name string) error {
+	if !model.LabelName(name).IsValid() {
+		return fmt.Errorf("invalid label %q", name)
+	}
+	if name == "public_key" || name == "name" || name == "interface" || staticLabelNames[name] {
+		return fmt.Errorf("label %q is used by the exporter", name)
+	}
+	for _, label := range config.labelNames() {
+		if name == label {
+			return fmt.Errorf("label %q is set in the config", name)
+		}
+	}
+	return nil
+}
+
+func loadConfig(path string) error {
+	if path == "" {
+		return nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var config Config
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err = decoder.Decode(&config); err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+
+	for _, site := range config.Sites {
+		if site.Name == "" {
+			return fmt.Errorf("failed to parse %s: site without name", path)
+		}
+	}
+
+	if err := config.CriticalPeers.validate(); err != nil {
+		return fmt.Errorf("failed to parse %s: critical peers: %w", path, err)
+	}
+	if err := config.validateEnrichers(); err != nil {
+		return fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+	for _, name := range config.labelNames() {
+		if !model.LabelName(name).IsValid() {
+			return fmt.Errorf("failed to parse %s: invalid label %q", path, name)
+		}
+		if staticLabelNames[name] || reservedLabelNames[name] {
+			return fmt.Errorf("failed to parse %s: label %q is used by the exporter", path, name)
+		}
+	}
+	for name, instance := range config.Instances {
+		if instance.EnrichPeers == nil {
+			continue
+		}
+		if err := instance.EnrichPeers.validate(); err != nil {
+			return fmt.Errorf("failed to parse %s: enrich_peers of %s: %w", path, name, err)
+		}
+	}
+
+	plugins := map[string]bool{}
+	for _, plugin := range config.Plugins {
+		if plugin.Name == "" || len(plugin.Command) == 0 {
+			return fmt.Errorf("failed to parse %s: plugin without name or command", path)
+		}
+		if plugins[plugin.Name] {
+			return fmt.Errorf("failed to parse %s: duplicate plugin %s", path, plugin.Name)
+		}
+		plugins[plugin.Name] = true
+	}
+
+	exporterConfig = config
+	return nil
+}
+
+// validate checks the patterns and normalizes the keys to lower case
+// without repetitions, as the same peer must not be matched twice.
+func (patterns *PeerPatterns) validate() error {
+	seen := map[string]bool{}
+	keys := patterns.Keys[:0]
+	for _, key := range patterns.Keys {
+		key = strings.ToLower(strings.TrimSpace(key))
+		if key == "" {
+			return errors.New("empty peer key")
+		}
+		if !seen[key] {
+			seen[key] = true
+			keys = append(keys, key)
+		}
+	}
+	patterns.Keys = keys
+
+	for _, pattern := range patterns.Names {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid peer name pattern %q: %w", pattern, err)
+		}
+	}
+	return nil
+}
+
+// matches reports whether a peer matches one of the patterns.
+func (patterns PeerPatterns) matches(publicKey, name string) bool {
+	for _, key := range patterns.Keys {
+		if strings.HasPrefix(publicKey, key) {
+			return true
+		}
+	}
+	for _, pattern := range patterns.Names {
+		if matched, _ := path.Match(pattern, name); matched && name != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// criticalPeer reports whether a peer is marked critical in the config.
+func (config Config) criticalPeer(publicKey, name string) bool {
+	return config.CriticalPeers.matches(publicKey, name)
+}
+
+// missingCriticalPeers returns the critical peers given with their full key
+// that fastd does not know.
+func (config Config) missingCriticalPeers(data Message) []string {
+	var missing []string
+	for _, key := range config.CriticalPeers.Keys {
+		if _, ok := data.Peers[key]; !ok && publicKeyPattern.MatchString(key) {
+			missing = append(missing, key)
+		}
+	}
+	return missing
+}
+
+// peerSite returns the name of the first site matching a peer, or "unknown".
+func peerSite(publicKey string, addr netip.Addr) string {
+	for _, site := range exporterConfig.Sites {
+		for _, prefix := range site.Prefixes {
+			if addr.IsValid() && prefix.Contains(addr) {
+				return site.Name
+			}
+		}
+		for _, key := range site.Keys {
+			if strings.HasPrefix(publicKey, strings.ToLower(key)) {
+				return site.Name
+			}
+		}
+	}
+
+	return "unknown"
+}
+
+// labelNames returns the names of the labels given globally or for any
+// instance, which all instances need to have to be registered together.
+func (config Config) labelNames() []string {
+	names := map[string]bool{}
+	for name := range config.Labels {
+		names[name] = true
+	}
+	for _, instance := range config.Instances {
+		for name := range instance.Labels {
+			names[name] = true
+		}
+	}
+
+	sorted := make([]string, 0, len(names))
+	for name := range names {
+		sorted = append(sorted, name)
+	}
+	sort.Strings(sorted)
+	return sorted
+}
+
+// instanceLabel returns the value of a label from the config for an
+// instance, empty if neither the instance nor the global labels set it.
+func (config Config) instanceLabel(instance, name string) string {
+	if value, ok := config.Instances[instance].Labels[name]; ok {
+		return value
+	}
+	return config.Labels[name]
+}
+
+// instanceSockets returns the instances with a status socket in the config,
+// formatted like instances given on the command line.
+func (config Config) instanceSockets() []string {
+	var instances []string
+	for name, instance := range config.Instances {
+		if instance.Socket != "" {
+			instances = append(instances, name+"="+instance.Socket)
+		}
+	}
+	sort.Strings(instances)
+	return instances
+}
+
+// instanceEnabled reports whether an instance is not disabled by the config.
+func (config Config) instanceEnabled(instance string) bool {
+	enabled := config.Instances[instance].Enabled
+	return enabled == nil || *enabled
+}
+
+// instanceDisplayName returns the display name of an instance, or its name
+// if it has none.
+func (config Config) instanceDisplayName(instance string) string {
+	if name := config.Instances[instance].DisplayName; name != "" {
+		return name
+	}
+	return instance
+}
+
+// registerConfigInfo exports which optional collectors, enrichment sources
+// and outputs are enabled, for auditing the settings across a fleet.
+func registerConfigInfo() {
+	enabled := func(settings map[string]bool) string {
+		var names []string
+		for name, enabled := range settings {
+			if enabled {
+				names = append(names, name)
+			}
+		}
+		sort.Strings(names)
+		return strings.Join(names, ",")
+	}
+
+	info := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "fastd_exporter_config_info",
+		Help: "settings of the exporter, lists of enabled optional collectors, enrichment sources and outputs",
+	}, []string{"lite", "collectors", "enrichment", "outputs", "scrape_min_interval"})
+
+	enrichment := map[string]bool{
+		"asn":           *ipAsnLookupEnable,
+		"geoip":         *geoipDatabasePath != "",
+		"interface":     *ifaceLookupEnable,
+		"peer_metadata": *peerMetadataKeys != "",
+		"peer_registry": *peerAPIURL != "",
+		"nodes_json":    *nodesJSONURL != "",
+		"consul_tags":   *consulAddress != "" && *consulKVPrefix != "",
+		"sites":         len(exporterConfig.Sites) != 0,
+	}
+	for _, enricher := range exporterConfig.enrichers() {
+		enrichment[enricher.Name()] = true
+	}
+
+	info.WithLabelValues(
+		strconv.FormatBool(*lite),
+		enabled(map[string]bool{
+			"frozen":                   *frozenPolls > 0,
+			"peer_remote_dns":          *remoteDNSInterval > 0,
+			"peer_stalled":             *stalledPolls > 0,
+			"peers_by_prefix":          *peersByPrefixThreshold > 0,
+			"unknown_peers":            *verifyHookEnable,
+			"plugins":                  len(exporterConfig.Plugins) != 0,
+			"peer_last_handshake":      *handshakeLogEnable,
+			"fastd_version":            *fastdVersionBinary != "",
+			"handshake_storm":          *handshakeStormRatio > 0 && (*handshakeLogEnable || *verifyHookEnable),
+			"peer_method":              !*lite,
+			"peer_method_detail":       !*lite,
+			"peer_floating":            !*lite,
+			"peer_groups":              !*lite,
+			"key_files":                !*lite,
+			"tx_ratios":                *txRatiosWindow > 0,
+			"bridges":                  *bridgeExpected != "",
+			"peers_trend":              *peersTrendWindow > 0,
+			"peer_average_packet_size": *packetSizePerPeer,
+			"peer_throughput_window":   *pollInterval > 0 && !*lite,
+		}),
+		enabled(enrichment),
+		enabled(map[string]bool{
+			"kafka":   *eventsKafkaBrokers != "",
+			"nats":    *eventsNATSURL != "",
+			"consul":  *consulAddress != "",
+			"csv":     *exportDirectory != "",
+			"rollups": *rollupsDirectory != "",
+			"snmp":    *snmpAgentXAddress != "",
+			"tracing": *tracingEndpoint != "",
+			"grpc":    *grpcListenAddress != "",
+		}),
+		scrapeMinInterval.String(),
+	).Set(1)
+
+	prometheus.MustRegister(info)
+}
+
+// instanceSettings returns the settings of an instance. Overrides of
+// enrichment and collectors are ignored in lite mode.
+func (config Config) instanceSettings(instance string) instanceSettings {
+	settings := instanceSettings{
+		socketTimeout:          *socketTimeout,
+		socketAttempts:         *socketAttempts,
+		socketProxy:            *socketProxy,
+		netns:                  *statusSocketNetns,
+		asnLookup:              *ipAsnLookupEnable,
+		geoip:                  geoipDatabase != nil,
+		interfaceLookup:        *ifaceLookupEnable,
+		stalledPolls:           *stalledPolls,
+		frozenPolls:            *frozenPolls,
+		peersByPrefixThreshold: *peersByPrefixThreshold,
+		packetSizePerPeer:      *packetSizePerPeer,
+		bridge:                 strings.ReplaceAll(*bridgeExpected, "%s", instance),
+	}
+
+	overrides := config.Instances[instance]
+	if overrides.SocketTimeout != nil {
+		settings.socketTimeout = *overrides.SocketTimeout
+	}
+	if overrides.SocketAttempts != nil {
+		settings.socketAttempts = *overrides.SocketAttempts
+	}
+	if overrides.SocketProxy != nil {
+		settings.socketProxy = *overrides.SocketProxy
+	}
+	if overrides.Netns != nil {
+		settings.netns = *overrides.Netns
+	}
+	if *lite {
+		return settings
+	}
+
+	if overrides.ASNLookup != nil {
+		settings.asnLookup = *overrides.ASNLookup
+	}
+	if overrides.GeoIP != nil {
+		settings.geoip = *overrides.GeoIP && geoipDatabase != nil
+	}
+	if overrides.InterfaceLookup != nil {
+		settings.interfaceLookup = *overrides.InterfaceLookup
+	}
+	if overrides.StalledPolls != nil {
+		settings.stalledPolls = *overrides.StalledPolls
+	}
+	if overrides.FrozenPolls != nil {
+		settings.frozenPolls = *overrides.FrozenPolls
+	}
+	if overrides.PeersByPrefixThreshold != nil {
+		settings.peersByPrefixThreshold = *overrides.PeersByPrefixThreshold
+	}
+	if overrides.PacketSizePerPeer != nil {
+		settings.packetSizePerPeer = *overrides.PacketSizePerPeer
+	}
+	if overrides.Bridge != nil {
+		settings.bridge = *overrides.Bridge
+	}
+	settings.enrichPeers = overrides.EnrichPeers
+
+	return settings
+}
+
+// enriched reports whether the ASN and country of a peer are looked up.
+func (settings instanceSettings) enriched(publicKey, name string) bool {
+	return settings.enrichPeers == nil || settings.enrichPeers.matches(publicKey, name)
+}
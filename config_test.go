@@ -0,0 +1,94 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// loadTestConfig loads a config file with the given content.
+func loadTestConfig(t *testing.T, content string) error {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.yml")
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { exporterConfig = Config{} })
+	return loadConfig(path)
+}
+
+func TestCriticalPeerKeysNormalized(t *testing.T) {
+	key := strings.Repeat("ab", 32)
+	err := loadTestConfig(t, `critical_peers:
+  keys:
+    - `+strings.ToUpper(key)+`
+    - `+key+`
+    - 4F1A
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want := []string{key, "4f1a"}; !reflect.DeepEqual(exporterConfig.CriticalPeers.Keys, want) {
+		t.Errorf("got keys %v, want %v", exporterConfig.CriticalPeers.Keys, want)
+	}
+	if missing := exporterConfig.missingCriticalPeers(Message{}); !reflect.DeepEqual(missing, []string{key}) {
+		t.Errorf("got missing peers %v, want only %s", missing, key)
+	}
+	if !exporterConfig.criticalPeer("4f1a00", "") {
+		t.Error("peer matching a key prefix is not critical")
+	}
+}
+
+func TestCriticalPeerEmptyKey(t *testing.T) {
+	if err := loadTestConfig(t, "critical_peers:\n  keys:\n    - \"\"\n"); err == nil {
+		t.Error("empty key, which matches every peer, was accepted")
+	}
+}
+
+func TestConfigLabelsReserved(t *testing.T) {
+	for _, name := range []string{"fastd_instance", "host", "gateway", "public_key", "method"} {
+		if err := loadTestConfig(t, "labels:\n  "+name+": value\n"); err == nil {
+			t.Errorf("label %s of the exporter was accepted", name)
+		}
+		if err := loadTestConfig(t, "instances:\n  dom0:\n    labels:\n      "+name+": value\n"); err == nil {
+			t.Errorf("label %s of the exporter was accepted for an instance", name)
+		}
+	}
+	if err := loadTestConfig(t, "labels:\n  region: darmstadt\n"); err != nil {
+		t.Fatal(err)
+	}
+	if err := exporterConfig.checkPeerLabel("region"); err == nil {
+		t.Error("peer label repeating a label from the config was accepted")
+	}
+}
+
+var descVariableLabels = regexp.MustCompile(`variableLabels: \{([^}]*)\}`)
+
+// TestReservedLabelNamesComplete makes sure that reservedLabelNames lists
+// every label of the metrics of an instance, so labels from the config
+// cannot break registering it.
+func TestReservedLabelNamesComplete(t *testing.T) {
+	keyPrefix := *verifyHookKeyPrefix
+	*verifyHookKeyPrefix = 4
+	t.Cleanup(func() { *verifyHookKeyPrefix = keyPrefix })
+
+	descs := make(chan *prometheus.Desc)
+	go func() {
+		NewPrometheusExporter("dom0", fastdConfig{}).Describe(descs)
+		close(descs)
+	}()
+	for desc := range descs {
+		labels := descVariableLabels.FindStringSubmatch(desc.String())[1]
+		for _, name := range strings.Split(labels, ",") {
+			if name != "" && !reservedLabelNames[name] {
+				t.Errorf("label %s of %s is not reserved", name, desc)
+			}
+		}
+	}
+}
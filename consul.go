@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var consulClient = &http.Client{Timeout: 10 * time.Second}
+
+// consulTags holds the tags of peers read from the Consul KV store, keyed by
+// public key.
+var consulTags = struct {
+	sync.Mutex
+	tags map[string][]string
+}{}
+
+// consulRequest sends a request to the Consul agent given by
+// --consul.address and decodes the JSON response into result, if not nil.
+func consulRequest(ctx context.Context, method string, path string, body interface{}, result interface{}) error {
+	reader := bytes.NewReader(nil)
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(data)
+	}
+
+	request, err := http.NewRequestWithContext(ctx, method, strings.TrimSuffix(*consulAddress, "/")+path, reader)
+	if err != nil {
+		return err
+	}
+	if *consulToken != "" {
+		request.Header.Set("X-Consul-Token", *consulToken)
+	}
+
+	response, err := consulClient.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode == http.StatusNotFound && result != nil {
+		return nil
+	}
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("consul answered %s to %s %s", response.Status, method, path)
+	}
+	if result == nil {
+		return nil
+	}
+	return json.NewDecoder(response.Body).Decode(result)
+}
+
+// registerConsulService registers the exporter with the local Consul agent,
+// with a HTTP check of /readyz on the given listener. The service is tagged
+// with the instances, so scrape jobs can select gateways by them.
+func registerConsulService(listener net.Listener, exporters []*PrometheusExporter) error {
+	host, port, err := net.SplitHostPort(listener.Addr().String())
+	if err != nil {
+		return err
+	}
+	portNumber, err := strconv.Atoi(port)
+	if err != nil {
+		return err
+	}
+	// the agent checks from the local host when listening on all addresses
+	if ip := net.ParseIP(host); ip == nil || ip.IsUnspecified() {
+		host = "127.0.0.1"
+	}
+
+	var tags []string
+	for _, exporter := range exporters {
+		tags = append(tags, "fastd-instance="+exporter.instance)
+	}
+
+	service := map[string]interface{}{
+		"ID":   *consulServiceName + "-" + port,
+		"Name": *consulServiceName,
+		"Port": portNumber,
+		"Tags": tags,
+		"Check": map[string]interface{}{
+			"HTTP":                           "http://" + net.JoinHostPort(host, port) + "/readyz",
+			"Interval":                       "15s",
+			"Timeout":                        "5s",
+			"DeregisterCriticalServiceAfter": "24h",
+		},
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), consulClient.Timeout)
+	defer cancel()
+	return consulRequest(ctx, http.MethodPut, "/v1/agent/service/register", service, nil)
+}
+
+// runConsulTags reads the peer tags below --consul.kv-prefix every
+// --consul.kv-interval. Keys are <prefix>/<public key>, values comma
+// separated tags.
+func runConsulTags() {
+	ticker := time.NewTicker(*consulKVInterval)
+	defer ticker.Stop()
+
+	for {
+		var pairs []struct {
+			Key   string
+			Value []byte
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), consulClient.Timeout)
+		err := consulRequest(ctx, http.MethodGet, "/v1/kv/"+strings.Trim(*consulKVPrefix, "/")+"/?recurse=true", nil, &pairs)
+		cancel()
+
+		if err != nil {
+			log.Printf("Failed to read peer tags from Consul: %v", err)
+		} else {
+			tags := map[string][]string{}
+			for _, pair := range pairs {
+				publicKey := strings.ToLower(pair.Key[strings.LastIndex(pair.Key, "/")+1:])
+				if !publicKeyPattern.MatchString(publicKey) {
+					continue
+				}
+				seen := map[string]bool{}
+				for _, tag := range strings.Split(string(pair.Value), ",") {
+					if tag = strings.TrimSpace(tag); tag != "" && !seen[tag] {
+						seen[tag] = true
+						tags[publicKey] = append(tags[publicKey], tag)
+					}
+				}
+				sort.Strings(tags[publicKey])
+			}
+
+			consulTags.Lock()
+			consulTags.tags = tags
+			consulTags.Unlock()
+		}
+
+		<-ticker.C
+	}
+}
+
+// collectConsulTags exports the Consul tags of a peer.
+func (exporter *PrometheusExporter) collectConsulTags(channel chan<- prometheus.Metric, publicKey, peerName, interfaceName string) {
+	consulTags.Lock()
+	defer consulTags.Unlock()
+
+	for _, tag := range consulTags.tags[publicKey] {
+		channel <- prometheus.MustNewConstMetric(exporter.peerTagInfo, prometheus.GaugeValue, 1, publicKey, peerName, interfaceName, tag)
+	}
+}
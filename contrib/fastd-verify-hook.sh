@@ -0,0 +1,15 @@
+#!/usr/bin/env bash
+#
+# on verify hook for fastd instances that only accept configured peers.
+# Reports the unknown peer to fastd-exporter started with
+# -verify-hook.enable and rejects it. Configure it in fastd.conf with:
+#
+#   on verify "/path/to/fastd-verify-hook.sh dom0";
+#   secure handshakes yes;
+
+instance="$1"
+exporter="${FASTD_EXPORTER_URL:-http://127.0.0.1:9281}"
+
+curl --silent --max-time 1 --data-urlencode "instance=$instance" --data-urlencode "key=$PEER_KEY" "$exporter/hooks/verify" > /dev/null
+
+exit 1
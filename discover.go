@@ -0,0 +1,127 @@
+package main
+
+import (
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"regexp"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// discoverableInstance matches directory names that can be used as
+// instance names.
+var discoverableInstance = regexp.MustCompile(`^[a-zA-Z0-9\._-]+$`)
+
+// discoveredExporters are the instances found in --discover-config-dir after
+// the exporter started.
+var discoveredExporters = struct {
+	sync.Mutex
+	exporters []*PrometheusExporter
+}{}
+
+// discoveredConfigPattern is the config path pattern of the instances found
+// in --discover-config-dir.
+func discoveredConfigPattern() string {
+	return filepath.Join(*discoverConfigDir, "%s", "fastd.conf")
+}
+
+// discoverInstances returns the names of the subdirectories of a fastd
+// config directory like /etc/fastd that contain a fastd.conf.
+func discoverInstances(directory string) ([]string, error) {
+	entries, err := os.ReadDir(directory)
+	if err != nil {
+		return nil, err
+	}
+
+	var instances []string
+	for _, entry := range entries {
+		if !discoverableInstance.MatchString(entry.Name()) {
+			continue
+		}
+		// follow symlinks to directories
+		if info, err := os.Stat(filepath.Join(directory, entry.Name(), "fastd.conf")); err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+		instances = append(instances, entry.Name())
+	}
+	return instances, nil
+}
+
+// parseDiscoveredConfig parses the config of an instance found in
+// --discover-config-dir. Its status socket need not exist, as the fastd of
+// the instance may not be running yet.
+func parseDiscoveredConfig(instance string) (fastdConfig, error) {
+	return parseConfigFrom(instance, []string{discoveredConfigPattern()}, false)
+}
+
+// runDiscovery scans --discover-config-dir again every
+// --discover-config-dir.interval and on SIGHUP, and exports the instances
+// found there that are not exported yet.
+func runDiscovery(exported map[string]bool) {
+	var tick <-chan time.Time
+	if *discoverInterval > 0 {
+		ticker := time.NewTicker(*discoverInterval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+
+	for {
+		select {
+		case <-tick:
+		case <-hangup:
+			log.Printf("Scanning %s for new instances", *discoverConfigDir)
+		}
+		discoverNewInstances(exported)
+	}
+}
+
+// discoverNewInstances exports the instances in --discover-config-dir that
+// are not exported yet.
+func discoverNewInstances(exported map[string]bool) {
+	names, err := discoverInstances(*discoverConfigDir)
+	if err != nil {
+		logRepeated("Failed to discover instances: %v", err)
+		return
+	}
+	for _, name := range names {
+		if exported[name] || excludedInstances.matches(name) || !exporterConfig.instanceEnabled(name) {
+			continue
+		}
+		config, err := parseDiscoveredConfig(name)
+		if err != nil {
+			logRepeated("Skipping discovered instance %v: %v", name, err)
+			continue
+		}
+
+		log.Printf("Reading fastd data for discovered instance %v from %v", name, config.statusSocketPath)
+		exporter := NewPrometheusExporter(name, config)
+		exporter.optional = true
+		if err := defaultExporterRegistries.register(exporter); err != nil {
+			log.Printf("Failed to register discovered instance %v: %v", name, err)
+			continue
+		}
+		exporter.startBackground()
+		exported[name] = true
+
+		discoveredExporters.Lock()
+		discoveredExporters.exporters = append(discoveredExporters.exporters, exporter)
+		discoveredExporters.Unlock()
+	}
+}
+
+// withDiscoveredExporters returns the exporters followed by those discovered
+// after the start.
+func withDiscoveredExporters(exporters []*PrometheusExporter) []*PrometheusExporter {
+	discoveredExporters.Lock()
+	defer discoveredExporters.Unlock()
+
+	if len(discoveredExporters.exporters) == 0 {
+		return exporters
+	}
+	return append(append([]*PrometheusExporter{}, exporters...), discoveredExporters.exporters...)
+}
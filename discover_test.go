@@ -0,0 +1,59 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writeDiscoveredConfig creates the config of an instance in
+// --discover-config-dir.
+func writeDiscoveredConfig(t *testing.T, instance string, content string) {
+	t.Helper()
+	directory := filepath.Join(*discoverConfigDir, instance)
+	if err := os.MkdirAll(directory, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(directory, "fastd.conf"), []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDiscoverNewInstances(t *testing.T) {
+	*discoverConfigDir = t.TempDir()
+	t.Cleanup(func() {
+		*discoverConfigDir = ""
+		discoveredExporters.exporters = nil
+	})
+
+	// fastd of the instance is not running, so its socket is missing
+	writeDiscoveredConfig(t, "discovered0", `status socket "/run/fastd/discovered0.sock";`+"\n")
+	writeDiscoveredConfig(t, "nosocket", "mtu 1406;\n")
+	writeDiscoveredConfig(t, "given", `status socket "/run/fastd/given.sock";`+"\n")
+
+	exported := map[string]bool{"given": true}
+	discoverNewInstances(exported)
+	discoverNewInstances(exported)
+
+	exporters := withDiscoveredExporters(nil)
+	if len(exporters) != 1 || exporters[0].instance != "discovered0" {
+		t.Fatalf("got discovered exporters %v, want only discovered0", exporters)
+	}
+	if !exporters[0].optional || exporters[0].statusSocketPath != "/run/fastd/discovered0.sock" {
+		t.Errorf("got optional %v and socket %s", exporters[0].optional, exporters[0].statusSocketPath)
+	}
+}
+
+func TestParseConfigIgnoresDiscoveryDirectory(t *testing.T) {
+	*discoverConfigDir = t.TempDir()
+	t.Cleanup(func() { *discoverConfigDir = "" })
+	writeDiscoveredConfig(t, "dom0", `status socket "/run/fastd/dom0.sock";`+"\n")
+
+	patterns := configPathPatterns
+	configPathPatterns = []string{filepath.Join(t.TempDir(), "%s.conf")}
+	t.Cleanup(func() { configPathPatterns = patterns })
+
+	if _, err := parseConfig("dom0"); err == nil {
+		t.Error("config of an instance that is not discovered was read from --discover-config-dir")
+	}
+}
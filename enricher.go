@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"net/netip"
+	"regexp"
+	"sort"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Enricher adds labels from a custom data source, like billing IDs or
+// ticket links, to the peers. Forks of the exporter register their
+// enrichers with RegisterEnricher from an init function in a file of their
+// own, and they are enabled by listing their names under enrichers in the
+// config.
+type Enricher interface {
+	// Name identifies the enricher in the config, and in the name of its
+	// metric fastd_peer_enricher_<name>_info.
+	Name() string
+	// Labels are the names of the labels the enricher adds.
+	Labels() []string
+	// Enrich returns the values of the labels for a peer, in the order of
+	// Labels, or false if the enricher knows nothing about it. The address
+	// is invalid for peers that are not connected. It is called for every
+	// peer on each scrape, slow sources have to be cached.
+	Enrich(publicKey string, address netip.Addr) ([]string, bool)
+}
+
+var (
+	enricherNamePattern = regexp.MustCompile(`^[a-z][a-z0-9_]*$`)
+	// registeredEnrichers holds the enrichers compiled in, by name
+	registeredEnrichers = map[string]Enricher{}
+)
+
+// RegisterEnricher makes an enricher available to be enabled in the
+// config. It panics if the name is invalid or already taken.
+func RegisterEnricher(enricher Enricher) {
+	name := enricher.Name()
+	if !enricherNamePattern.MatchString(name) {
+		panic(fmt.Sprintf("invalid enricher name %q", name))
+	}
+	if _, ok := registeredEnrichers[name]; ok {
+		panic(fmt.Sprintf("enricher %s registered twice", name))
+	}
+	registeredEnrichers[name] = enricher
+}
+
+// validateEnrichers checks that the enrichers enabled in the config are
+// registered and enabled once, and that their labels are unique and do not
+// clash with the labels of the peers and the config.
+func (config Config) validateEnrichers() error {
+	enabled := map[string]bool{}
+	for _, name := range config.Enrichers {
+		if enabled[name] {
+			return fmt.Errorf("enricher %s enabled twice", name)
+		}
+		enabled[name] = true
+
+		enricher, ok := registeredEnrichers[name]
+		if !ok {
+			var available []string
+			for name := range registeredEnrichers {
+				available = append(available, name)
+			}
+			sort.Strings(available)
+			return fmt.Errorf("unknown enricher %q, available: %v", name, available)
+		}
+		labels := map[string]bool{}
+		for _, label := range enricher.Labels() {
+			if labels[label] {
+				return fmt.Errorf("label %q of enricher %s repeated", label, name)
+			}
+			labels[label] = true
+			if err := config.checkPeerLabel(label); err != nil {
+				return fmt.Errorf("enricher %s: %w", name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// enrichers returns the enrichers enabled in the config.
+func (config Config) enrichers() []Enricher {
+	enrichers := make([]Enricher, 0, len(config.Enrichers))
+	for _, name := range config.Enrichers {
+		enrichers = append(enrichers, registeredEnrichers[name])
+	}
+	return enrichers
+}
+
+// enricherDescs creates the info metrics of the enabled enrichers.
+func enricherDescs(dynamicLabels []string, staticLabels prometheus.Labels) map[string]*prometheus.Desc {
+	descs := map[string]*prometheus.Desc{}
+	for _, enricher := range exporterConfig.enrichers() {
+		labels := append(append([]string{}, dynamicLabels...), enricher.Labels()...)
+		descs[enricher.Name()] = prometheus.NewDesc(prefixWrapper("peer", "enricher", enricher.Name(), "info"), "labels of the peer from the "+enricher.Name()+" enricher", labels, staticLabels)
+	}
+	return descs
+}
+
+// collectEnrichers exports the labels the enabled enrichers know for a peer.
+func (exporter *PrometheusExporter) collectEnrichers(channel chan<- prometheus.Metric, publicKey string, peer Peer, peerName, interfaceName string) {
+	var address netip.Addr
+	if peer.Connection != nil {
+		address, _ = normalizePeerAddress(peer.Address)
+	}
+	for _, enricher := range exporterConfig.enrichers() {
+		values, ok := enricher.Enrich(publicKey, address)
+		if !ok || len(values) != len(enricher.Labels()) {
+			continue
+		}
+		labelValues := append([]string{publicKey, peerName, interfaceName}, values...)
+		channel <- prometheus.MustNewConstMetric(exporter.enricherInfo[enricher.Name()], prometheus.GaugeValue, 1, labelValues...)
+	}
+}
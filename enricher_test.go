@@ -0,0 +1,73 @@
+package main
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+type testEnricher struct {
+	name   string
+	labels []string
+}
+
+func (enricher testEnricher) Name() string     { return enricher.name }
+func (enricher testEnricher) Labels() []string { return enricher.labels }
+func (enricher testEnricher) Enrich(publicKey string, address netip.Addr) ([]string, bool) {
+	values := make([]string, len(enricher.labels))
+	for i := range values {
+		values[i] = publicKey[:4]
+	}
+	return values, true
+}
+
+// registerTestEnricher makes an enricher available for the duration of a
+// test.
+func registerTestEnricher(t *testing.T, name string, labels ...string) {
+	t.Helper()
+	RegisterEnricher(testEnricher{name, labels})
+	t.Cleanup(func() { delete(registeredEnrichers, name) })
+}
+
+func TestEnricherLabelsChecked(t *testing.T) {
+	registerTestEnricher(t, "repeated", "customer_id", "customer_id")
+	registerTestEnricher(t, "static", "gateway")
+	registerTestEnricher(t, "peer", "public_key")
+	registerTestEnricher(t, "configured", "region")
+	registerTestEnricher(t, "billing", "customer_id")
+
+	for _, config := range []string{
+		"enrichers: [repeated]\n",
+		"enrichers: [static]\n",
+		"enrichers: [peer]\n",
+		"enrichers: [configured]\nlabels:\n  region: darmstadt\n",
+		"enrichers: [billing, billing]\n",
+		"enrichers: [unknown]\n",
+	} {
+		if err := loadTestConfig(t, config); err == nil {
+			t.Errorf("config %q was accepted", config)
+		}
+	}
+	if err := loadTestConfig(t, "enrichers: [billing]\nlabels:\n  region: darmstadt\n"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestEnricherNamespaced makes sure that an enricher named like a metric of
+// the exporter does not break registering the instance.
+func TestEnricherNamespaced(t *testing.T) {
+	registerTestEnricher(t, "registry", "customer_id")
+	if err := loadTestConfig(t, "enrichers: [registry]\n"); err != nil {
+		t.Fatal(err)
+	}
+
+	registry := prometheus.NewPedanticRegistry()
+	if err := registry.Register(testExporter(t, 10)); err != nil {
+		t.Fatal(err)
+	}
+	names := familyNames(t, registry)
+	if !names["fastd_peer_enricher_registry_info"] {
+		t.Errorf("enricher metric is missing in %v", names)
+	}
+}
@@ -0,0 +1,351 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/simplesurance/go-ip-anonymizer/ipanonymizer"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/net/proxy"
+)
+
+const (
+	cymruWhoisAddress = "whois.cymru.com:43"
+	// failed lookups are retried after this time
+	asnNegativeCacheTTL = 5 * time.Minute
+	// asn label value of peers whose ASN could not be looked up
+	asnUnknown = "unknown"
+)
+
+var asnLookupFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: prefixWrapper("asn_lookup_failures_total"),
+	Help: "number of addresses whose ASN could not be looked up",
+}, []string{"method"})
+
+var (
+	// enrichmentDialer establishes all connections of enrichment lookups.
+	enrichmentDialer proxy.ContextDialer = &net.Dialer{}
+	// enrichmentResolver resolves the DNS queries of enrichment lookups.
+	enrichmentResolver = net.DefaultResolver
+)
+
+// setupEnrichmentNetwork routes enrichment lookups through the resolver and
+// proxy configured by --enrichment.dns-server and --enrichment.proxy.
+func setupEnrichmentNetwork() error {
+	if *enrichmentProxy != "" {
+		proxyURL, err := url.Parse(*enrichmentProxy)
+		if err != nil {
+			return fmt.Errorf("invalid enrichment proxy: %w", err)
+		}
+
+		switch proxyURL.Scheme {
+		case "socks5", "socks5h":
+			dialer, err := proxy.FromURL(proxyURL, proxy.Direct)
+			if err != nil {
+				return fmt.Errorf("invalid enrichment proxy: %w", err)
+			}
+			enrichmentDialer = dialer.(proxy.ContextDialer)
+		case "http":
+			enrichmentDialer = &httpConnectDialer{proxy: proxyURL.Host}
+		default:
+			return fmt.Errorf("unsupported enrichment proxy scheme %q", proxyURL.Scheme)
+		}
+
+		if *enrichmentDNSServer == "" {
+			return errors.New("--enrichment.proxy requires --enrichment.dns-server, as the system resolver can not be proxied")
+		}
+	}
+
+	if *enrichmentDNSServer != "" {
+		server := *enrichmentDNSServer
+		if _, _, err := net.SplitHostPort(server); err != nil {
+			server = net.JoinHostPort(server, "53")
+		}
+		if host, _, _ := net.SplitHostPort(server); net.ParseIP(host) == nil {
+			return fmt.Errorf("enrichment DNS server %s must be an IP address", host)
+		}
+
+		enrichmentResolver = &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+				if *enrichmentProxy != "" {
+					// proxies only relay streams, so query via TCP
+					network = "tcp"
+				}
+				return enrichmentDialer.DialContext(ctx, network, server)
+			},
+		}
+
+		if *enrichmentProxy == "" {
+			// resolve the hosts of enrichment services through the configured server as well
+			enrichmentDialer = &net.Dialer{Resolver: enrichmentResolver}
+		}
+	}
+
+	return nil
+}
+
+// httpConnectDialer tunnels connections through an HTTP proxy using CONNECT.
+type httpConnectDialer struct {
+	proxy string
+}
+
+func (dialer *httpConnectDialer) Dial(network, address string) (net.Conn, error) {
+	return dialer.DialContext(context.Background(), network, address)
+}
+
+func (dialer *httpConnectDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	if !strings.HasPrefix(network, "tcp") {
+		return nil, fmt.Errorf("http proxy can not relay %s", network)
+	}
+
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", dialer.proxy)
+	if err != nil {
+		return nil, err
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+
+	request := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: address},
+		Host:   address,
+		Header: http.Header{},
+	}
+	if err = request.Write(conn); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+
+	response, err := http.ReadResponse(bufio.NewReader(conn), request)
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	if response.StatusCode != http.StatusOK {
+		_ = conn.Close()
+		return nil, fmt.Errorf("http proxy refused CONNECT to %s: %s", address, response.Status)
+	}
+
+	_ = conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+// lookupASN resolves the ASN announcing an address through Team Cymru's DNS
+// interface.
+func lookupASN(ctx context.Context, addr netip.Addr) (string, error) {
+	var name strings.Builder
+	if addr.Is4() {
+		ip := addr.As4()
+		fmt.Fprintf(&name, "%d.%d.%d.%d.origin.asn.cymru.com", ip[3], ip[2], ip[1], ip[0])
+	} else {
+		ip := addr.As16()
+		for i := len(ip) - 1; i >= 0; i-- {
+			fmt.Fprintf(&name, "%x.%x.", ip[i]&0xf, ip[i]>>4)
+		}
+		name.WriteString("origin6.asn.cymru.com")
+	}
+
+	records, err := enrichmentResolver.LookupTXT(ctx, name.String())
+	if err != nil {
+		return "", err
+	}
+
+	// records look like "3320 | 80.128.0.0/11 | DE | ripencc | 2003-02-18",
+	// addresses announced by multiple ASNs list all of them in the first field
+	for _, record := range records {
+		fields := strings.Fields(strings.SplitN(record, "|", 2)[0])
+		if len(fields) != 0 {
+			return fields[0], nil
+		}
+	}
+
+	return "", fmt.Errorf("no ASN found for %s", addr)
+}
+
+type asnCacheEntry struct {
+	asn     string
+	expires time.Time
+}
+
+// asnCache remembers the ASNs of anonymized addresses across collections
+// and instances.
+var asnCache = struct {
+	sync.Mutex
+	entries map[netip.Addr]asnCacheEntry
+}{entries: map[netip.Addr]asnCacheEntry{}}
+
+var anonymizer = ipanonymizer.NewWithMask(
+	net.CIDRMask(24, 32),
+	net.CIDRMask(48, 128),
+)
+
+// anonymizeAddr masks an address to its /24 or /48 prefix, which is all that
+// is needed to look up its ASN.
+func anonymizeAddr(addr netip.Addr) netip.Addr {
+	anonIP, err := anonymizer.IPString(addr.String())
+	if err != nil {
+		return addr
+	}
+	if anonAddr, err := netip.ParseAddr(anonIP); err == nil {
+		return anonAddr
+	}
+	return addr
+}
+
+// lookupASNs returns the ASNs of the given peer addresses. Addresses that are
+// not cached are looked up in a single bulk whois query if there are at least
+// --ip-asn-lookup.bulk-threshold of them, e.g. after a fastd restart, and
+// with one DNS query each otherwise.
+func lookupASNs(ctx context.Context, addrs []netip.Addr) map[netip.Addr]string {
+	result := map[netip.Addr]string{}
+	var missing []netip.Addr
+	seen := map[netip.Addr]bool{}
+
+	asnCache.Lock()
+	now := time.Now()
+	for _, addr := range addrs {
+		// link-local, private or otherwise non-routed addresses have no ASN
+		if !isGlobalUnicast(addr) {
+			continue
+		}
+
+		lookupAddr := anonymizeAddr(addr)
+		if entry, ok := asnCache.entries[lookupAddr]; ok && now.Before(entry.expires) {
+			result[addr] = entry.asn
+		} else if !seen[lookupAddr] {
+			seen[lookupAddr] = true
+			missing = append(missing, lookupAddr)
+		}
+	}
+	asnCache.Unlock()
+
+	if len(missing) == 0 {
+		return result
+	}
+
+	var resolved map[netip.Addr]string
+	if *ipAsnLookupBulk > 0 && len(missing) >= *ipAsnLookupBulk {
+		resolved = lookupASNsBulk(ctx, missing)
+		asnLookupFailures.WithLabelValues("bulk").Add(float64(len(missing) - len(resolved)))
+	} else {
+		resolved = map[netip.Addr]string{}
+		for _, addr := range missing {
+			lookupCtx, cancel := context.WithTimeout(ctx, time.Duration(*ipAsnLookupTimeout)*time.Millisecond)
+			lookupCtx, span := tracer.Start(lookupCtx, "LookupASN")
+
+			asn, err := lookupASN(lookupCtx, addr)
+			if err != nil {
+				log.Print(err)
+				span.SetStatus(codes.Error, err.Error())
+				asnLookupFailures.WithLabelValues("dns").Inc()
+			} else {
+				resolved[addr] = asn
+			}
+
+			span.End()
+			cancel()
+		}
+	}
+
+	asnCache.Lock()
+	now = time.Now()
+	for _, addr := range missing {
+		if asn, ok := resolved[addr]; ok {
+			asnCache.entries[addr] = asnCacheEntry{asn: asn, expires: now.Add(*ipAsnLookupCacheTTL)}
+		} else {
+			asnCache.entries[addr] = asnCacheEntry{asn: asnUnknown, expires: now.Add(asnNegativeCacheTTL)}
+		}
+	}
+	for addr, entry := range asnCache.entries {
+		if now.After(entry.expires) {
+			delete(asnCache.entries, addr)
+		}
+	}
+	for _, addr := range addrs {
+		if entry, ok := asnCache.entries[anonymizeAddr(addr)]; ok && isGlobalUnicast(addr) {
+			result[addr] = entry.asn
+		}
+	}
+	asnCache.Unlock()
+
+	return result
+}
+
+// lookupASNsBulk resolves the ASNs of many addresses with a single query to
+// Team Cymru's bulk whois interface.
+func lookupASNsBulk(ctx context.Context, addrs []netip.Addr) map[netip.Addr]string {
+	ctx, span := tracer.Start(ctx, "LookupASNsBulk", trace.WithAttributes(attribute.Int("fastd.addresses", len(addrs))))
+	defer span.End()
+
+	// a bulk query is allowed the time of a few single lookups
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Duration(*ipAsnLookupTimeout)*time.Millisecond)
+	defer cancel()
+
+	result := map[netip.Addr]string{}
+
+	conn, err := enrichmentDialer.DialContext(ctx, "tcp", cymruWhoisAddress)
+	if err != nil {
+		log.Printf("Bulk ASN lookup failed: %v", err)
+		span.SetStatus(codes.Error, err.Error())
+		return result
+	}
+	defer func(conn net.Conn) {
+		_ = conn.Close()
+	}(conn)
+
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+
+	var query strings.Builder
+	query.WriteString("begin\nnoheader\n")
+	for _, addr := range addrs {
+		query.WriteString(addr.String() + "\n")
+	}
+	query.WriteString("end\n")
+	if _, err = conn.Write([]byte(query.String())); err != nil {
+		log.Printf("Bulk ASN lookup failed: %v", err)
+		span.SetStatus(codes.Error, err.Error())
+		return result
+	}
+
+	// answers look like "3320    | 80.128.0.1       | DTAG Internet service provider operations, DE",
+	// the server closes the connection after the last one
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		fields := strings.Split(scanner.Text(), "|")
+		if len(fields) < 2 {
+			continue
+		}
+
+		asn := strings.TrimSpace(fields[0])
+		addr, err := netip.ParseAddr(strings.TrimSpace(fields[1]))
+		if err != nil || asn == "NA" {
+			continue
+		}
+		result[addr] = asn
+	}
+	if err := scanner.Err(); err != nil {
+		log.Printf("Bulk ASN lookup failed: %v", err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+
+	return result
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+type asnCacheFileEntry struct {
+	Addr    netip.Addr `json:"addr"`
+	ASN     string     `json:"asn"`
+	Expires time.Time  `json:"expires"`
+}
+
+// loadASNCache fills the ASN cache from --ip-asn-lookup.cache-file, so a
+// restart does not look up the addresses of all peers at once. A missing
+// file is not an error, it is created on the first shutdown.
+func loadASNCache() error {
+	if *ipAsnLookupCacheFile == "" {
+		return nil
+	}
+
+	data, err := os.ReadFile(*ipAsnLookupCacheFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	var entries []asnCacheFileEntry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		// a corrupt cache only costs lookups, don't refuse to start
+		log.Printf("Ignoring ASN cache %s: %v", *ipAsnLookupCacheFile, err)
+		return nil
+	}
+
+	asnCache.Lock()
+	defer asnCache.Unlock()
+
+	now := time.Now()
+	for _, entry := range entries {
+		if entry.Addr.IsValid() && now.Before(entry.Expires) {
+			asnCache.entries[entry.Addr] = asnCacheEntry{asn: entry.ASN, expires: entry.Expires}
+		}
+	}
+	log.Printf("Loaded %d ASNs from %s", len(asnCache.entries), *ipAsnLookupCacheFile)
+	return nil
+}
+
+// saveASNCache writes the ASN cache to --ip-asn-lookup.cache-file, replacing
+// the previous file atomically.
+func saveASNCache() error {
+	asnCache.Lock()
+	entries := make([]asnCacheFileEntry, 0, len(asnCache.entries))
+	for addr, entry := range asnCache.entries {
+		entries = append(entries, asnCacheFileEntry{Addr: addr, ASN: entry.asn, Expires: entry.expires})
+	}
+	asnCache.Unlock()
+
+	data, err := json.Marshal(entries)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.CreateTemp(filepath.Dir(*ipAsnLookupCacheFile), ".asn-cache")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+
+	if _, err := file.Write(data); err != nil {
+		_ = file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(file.Name(), *ipAsnLookupCacheFile)
+}
+
+// runASNCacheSaver saves the ASN cache every
+// --ip-asn-lookup.cache-save-interval. It is saved on shutdown as well.
+func runASNCacheSaver() {
+	ticker := time.NewTicker(*asnCacheSaveInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if err := saveASNCache(); err != nil {
+			log.Printf("Failed to save ASN cache to %s: %v", *ipAsnLookupCacheFile, err)
+		}
+	}
+}
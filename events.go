@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	eventPeerConnected    = "peer_connected"
+	eventPeerDisconnected = "peer_disconnected"
+	eventSnapshot         = "snapshot"
+)
+
+// Event is a peer lifecycle change or a periodic snapshot of an instance,
+// published to the configured event sinks.
+type Event struct {
+	Type      string    `json:"type"`
+	Time      time.Time `json:"time"`
+	Instance  string    `json:"instance"`
+	PublicKey string    `json:"public_key,omitempty"`
+	Name      string    `json:"name,omitempty"`
+	Address   string    `json:"address,omitempty"`
+	Method    string    `json:"method,omitempty"`
+	// whether the peer is marked critical in the config
+	Critical bool `json:"critical,omitempty"`
+	// uptime of the instance for snapshots, of the session for disconnects
+	UptimeSeconds float64 `json:"uptime_seconds,omitempty"`
+	PeersUp       int     `json:"peers_up,omitempty"`
+	// statistics of the instance for snapshots, of the ended session for
+	// disconnects
+	Statistics *Statistics `json:"statistics,omitempty"`
+}
+
+// eventSink delivers events to an external system.
+type eventSink interface {
+	name() string
+	publish(ctx context.Context, events []Event) error
+}
+
+var eventPublishFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: prefixWrapper("event_publish_failures_total"),
+	Help: "number of event batches that could not be published",
+}, []string{"sink"})
+
+// runEventPoller reads the status of all instances every --events.interval,
+// derives peer lifecycle events from the difference to the previous read and
+// publishes them together with a snapshot of each instance.
+func runEventPoller(exporters []*PrometheusExporter, sinks []eventSink) {
+	for _, sink := range sinks {
+		eventPublishFailures.WithLabelValues(sink.name())
+	}
+	prometheus.MustRegister(eventPublishFailures)
+
+	sessions := map[string]map[string]Peer{}
+	ticker := time.NewTicker(*eventsInterval)
+	defer ticker.Stop()
+
+	for {
+		var events []Event
+		for _, exporter := range exporters {
+			ctx, cancel := context.WithTimeout(context.Background(), exporter.settings.socketTimeout)
+			data, readTime, err := exporter.status(ctx)
+			cancel()
+			if err != nil {
+				// keep the sessions, peers are not gone just because the
+				// status socket could not be read once
+				continue
+			}
+
+			instanceEvents := len(events)
+			previous := sessions[exporter.instance]
+			current := map[string]Peer{}
+			for publicKey, peer := range data.Peers {
+				if peer.Connection == nil {
+					continue
+				}
+				current[publicKey] = peer
+				if _, ok := previous[publicKey]; !ok && previous != nil {
+					events = append(events, Event{
+						Type:      eventPeerConnected,
+						Time:      readTime,
+						Instance:  exporter.instance,
+						PublicKey: publicKey,
+						Name:      publicPeerName(peer.Name),
+						Address:   peer.Address,
+						Method:    peer.Connection.Method,
+						Critical:  exporterConfig.criticalPeer(publicKey, peer.Name),
+					})
+				}
+			}
+			for publicKey, peer := range previous {
+				if _, ok := current[publicKey]; ok {
+					continue
+				}
+				statistics := peer.Connection.Statistics
+				events = append(events, Event{
+					Type:          eventPeerDisconnected,
+					Time:          readTime,
+					Instance:      exporter.instance,
+					PublicKey:     publicKey,
+					Name:          publicPeerName(peer.Name),
+					Address:       peer.Address,
+					Method:        peer.Connection.Method,
+					UptimeSeconds: peer.Connection.Established / 1000,
+					Statistics:    &statistics,
+					Critical:      exporterConfig.criticalPeer(publicKey, peer.Name),
+				})
+			}
+			sessions[exporter.instance] = current
+			if *maintenanceNoEvents && exporter.inMaintenance(readTime) {
+				// planned work should not notify anyone, drop the peer
+				// events of this instance but keep its snapshot
+				events = events[:instanceEvents]
+			}
+
+			statistics := data.Statistics
+			events = append(events, Event{
+				Type:          eventSnapshot,
+				Time:          readTime,
+				Instance:      exporter.instance,
+				UptimeSeconds: data.Uptime / 1000,
+				PeersUp:       len(current),
+				Statistics:    &statistics,
+			})
+		}
+
+		for _, sink := range sinks {
+			ctx, cancel := context.WithTimeout(context.Background(), *eventsInterval)
+			if err := sink.publish(ctx, events); err != nil {
+				log.Printf("Failed to publish %d events to %s: %v", len(events), sink.name(), err)
+				eventPublishFailures.WithLabelValues(sink.name()).Inc()
+			}
+			cancel()
+		}
+
+		<-ticker.C
+	}
+}
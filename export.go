@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	exportFilePrefix = "peers-"
+	exportFileSuffix = ".csv"
+)
+
+var exportColumns = []string{
+	"time", "instance", "public_key", "name", "address", "method", "established_seconds",
+	"rx_packets", "rx_bytes", "tx_packets", "tx_bytes",
+}
+
+// peerExport writes snapshots of the connected peers to CSV files in a
+// directory, starting a new file every --export.rotate-interval.
+type peerExport struct {
+	directory string
+	file      *os.File
+	writer    *csv.Writer
+	opened    time.Time
+}
+
+// runPeerExport appends a snapshot of all connected peers to the current
+// export file every --export.interval and applies the retention afterwards.
+func runPeerExport(exporters []*PrometheusExporter, directory string) {
+	export := &peerExport{directory: directory}
+	ticker := time.NewTicker(*exportInterval)
+	defer ticker.Stop()
+
+	for {
+		if err := export.write(exporters); err != nil {
+			log.Printf("Failed to export peer statistics: %v", err)
+		}
+		if err := export.applyRetention(); err != nil {
+			log.Printf("Failed to apply retention to exported peer statistics: %v", err)
+		}
+
+		<-ticker.C
+	}
+}
+
+func (export *peerExport) write(exporters []*PrometheusExporter) error {
+	now := time.Now()
+	if export.file == nil || now.Sub(export.opened) >= *exportRotateInterval {
+		if err := export.rotate(now); err != nil {
+			return err
+		}
+	}
+
+	for _, exporter := range exporters {
+		ctx, cancel := context.WithTimeout(context.Background(), exporter.settings.socketTimeout)
+		data, readTime, err := exporter.status(ctx)
+		cancel()
+		if err != nil {
+			continue
+		}
+
+		for publicKey, peer := range data.Peers {
+			if peer.Connection == nil {
+				continue
+			}
+			statistics := peer.Connection.Statistics
+			err = export.writer.Write([]string{
+				readTime.UTC().Format(time.RFC3339),
+				exporter.instance,
+				publicKey,
+				publicPeerName(peer.Name),
+				peer.Address,
+				peer.Connection.Method,
+				strconv.FormatFloat(peer.Connection.Established/1000, 'f', 3, 64),
+				strconv.Itoa(statistics.Rx.Count),
+				strconv.Itoa(statistics.Rx.Bytes),
+				strconv.Itoa(statistics.Tx.Count),
+				strconv.Itoa(statistics.Tx.Bytes),
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	export.writer.Flush()
+	return export.writer.Error()
+}
+
+// rotate closes the current export file and starts a new one.
+func (export *peerExport) rotate(now time.Time) error {
+	if export.file != nil {
+		export.writer.Flush()
+		if err := export.file.Close(); err != nil {
+			log.Printf("Failed to close %s: %v", export.file.Name(), err)
+		}
+		export.file = nil
+	}
+
+	path := filepath.Join(export.directory, exportFilePrefix+now.UTC().Format("20060102T150405Z")+exportFileSuffix)
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o640)
+	if err != nil {
+		return err
+	}
+
+	export.file = file
+	export.writer = csv.NewWriter(file)
+	export.opened = now
+	return export.writer.Write(exportColumns)
+}
+
+// applyRetention removes export files older than --export.retention and the
+// oldest files while all of them exceed --export.max-size together. The
+// current file is never removed.
+func (export *peerExport) applyRetention() error {
+	entries, err := os.ReadDir(export.directory)
+	if err != nil {
+		return err
+	}
+
+	var files []os.FileInfo
+	var total int64
+	for _, entry := range entries {
+		name := entry.Name()
+		if !strings.HasPrefix(name, exportFilePrefix) || !strings.HasSuffix(name, exportFileSuffix) {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		files = append(files, info)
+		total += info.Size()
+	}
+	// the file names sort by the time the files were started
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].Name() < files[j].Name()
+	})
+
+	for _, info := range files {
+		if export.file != nil && info.Name() == filepath.Base(export.file.Name()) {
+			continue
+		}
+
+		expired := *exportRetention > 0 && time.Since(info.ModTime()) > *exportRetention
+		oversized := *exportMaxSize > 0 && total > *exportMaxSize
+		if !expired && !oversized {
+			continue
+		}
+
+		if err := os.Remove(filepath.Join(export.directory, info.Name())); err != nil {
+			return fmt.Errorf("failed to remove %s: %w", info.Name(), err)
+		}
+		total -= info.Size()
+	}
+
+	return nil
+}
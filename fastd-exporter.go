@@ -6,29 +6,180 @@ import (
 	"errors"
 	"flag"
 	"fmt"
-	"io/ioutil"
+	"html"
+	"io"
+	"io/fs"
 	"log"
+	"math"
 	"net"
 	"net/http"
+	"net/netip"
 	"os"
+	"os/signal"
+	"os/user"
+	"path"
 	"regexp"
+	"sort"
 	"strconv"
+	"sync"
+	"syscall"
 	"time"
 
 	"strings"
 
-	"github.com/ammario/ipisp/v2"
 	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/client_golang/prometheus/promhttp"
-	"github.com/simplesurance/go-ip-anonymizer/ipanonymizer"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 )
 
+const (
+	defaultConfigPathPattern = "/etc/fastd/%s/fastd.conf"
+	// statusFileScheme prefixes status files given instead of a status socket
+	statusFileScheme = "file://"
+)
+
+// kinds of implausible values in the status output
+const (
+	anomalyUptimeInvalid      = "uptime_invalid"
+	anomalyUptimeBackwards    = "uptime_backwards"
+	anomalyEstablishedInvalid = "established_invalid"
+
+	// durations beyond 20 years in milliseconds are considered garbage
+	maxPlausibleDuration = 20 * 365 * 24 * 3600 * 1000
+	// sessions may appear slightly older than the instance due to rounding
+	establishedSlack = 1000
+)
+
+var errStatusFileStale = errors.New("status file is stale")
+
+var (
+	configPathPatterns stringSliceFlag
+	optionalInstances  stringSliceFlag
+	excludedInstances  stringSliceFlag
+	instanceSockets    stringSliceFlag
+)
+
+func init() {
+	flag.Var(&configPathPatterns, "config-path", "Override fastd config path, %s will be replaced with the fastd instance name. May be given multiple times, the first existing path is used. (default \""+defaultConfigPathPattern+"\")")
+	flag.Var(&excludedInstances, "exclude-instance", "Shell pattern of instances to skip, may be given multiple times.")
+	flag.Var(&instanceSockets, "instance", "Instance and its status socket as name=/run/fastd/name.sock, read without parsing the fastd config, may be given multiple times. Accepts the same sockets as instances given as arguments.")
+	flag.Var(&optionalInstances, "instance.optional", "Instance that does not need to be readable for the exporter to become ready, may be given multiple times.")
+}
+
 var (
-	configPathPattern  = flag.String("config-path", "/etc/fastd/%s/fastd.conf", "Override fastd config path, %s will be replaced with the fastd instance name.")
-	webListenAddress   = flag.String("web.listen-address", ":9281", "Address on which to expose metrics and web interface.")
-	webMetricsPath     = flag.String("web.telemetry-path", "/metrics", "Path under which to expose metrics.")
-	ipAsnLookupEnable  = flag.Bool("ip-asn-lookup.enable", true, "enable usage of ip->asn lookup")
-	ipAsnLookupTimeout = flag.Int("ip-asn-lookup.timeout", 300, "milliseconds to wait for ip->asn lookup to finish")
+	configFile             = flag.String("config", "", "Path to the YAML configuration file of the exporter.")
+	inventoryFile          = flag.String("inventory", "", "Path to a YAML file listing the instances of other hosts and their status sockets, exported with the host label.")
+	webListenAddress       = flag.String("web.listen-address", ":9281", "Comma separated addresses on which to expose metrics and web interface, prefix an address with tcp4:// or tcp6:// to only listen on that address family.")
+	webMetricsPath         = flag.String("web.telemetry-path", "/metrics", "Path under which to expose metrics.")
+	webHealthTimeout       = flag.Duration("web.health-timeout", time.Second, "Timeout for reading each status socket on /healthz/deep.")
+	webReadHeaderTimeout   = flag.Duration("web.read-header-timeout", 10*time.Second, "Time allowed to read the request headers.")
+	webIdleTimeout         = flag.Duration("web.idle-timeout", 60*time.Second, "Time an idle keep-alive connection is kept open.")
+	webWriteTimeout        = flag.Duration("web.write-timeout", 60*time.Second, "Time allowed to write a response, must cover the whole collection.")
+	webMaxRequests         = flag.Int("web.max-requests", 0, "Maximum number of concurrent scrapes, further scrapes are answered with 503. 0 means no limit.")
+	ipAsnLookupEnable      = flag.Bool("ip-asn-lookup.enable", true, "enable usage of ip->asn lookup")
+	ipAsnLookupTimeout     = flag.Int("ip-asn-lookup.timeout", 300, "milliseconds to wait for ip->asn lookup to finish")
+	ipAsnLookupBulk        = flag.Int("ip-asn-lookup.bulk-threshold", 10, "Number of uncached addresses from which ASNs are looked up in a single bulk whois query instead of one DNS query per address.")
+	ipAsnLookupCacheTTL    = flag.Duration("ip-asn-lookup.cache-ttl", 24*time.Hour, "Time to cache the ASN of an address.")
+	ipAsnLookupCacheFile   = flag.String("ip-asn-lookup.cache-file", "", "File to save the ASN cache to on shutdown and load it from on start, so restarts do not look up all peers at once. Disabled if empty.")
+	socketTimeout          = flag.Duration("status-socket.timeout", 5*time.Second, "Time budget for reading the status socket, including retries.")
+	socketAttempts         = flag.Int("status-socket.attempts", 3, "Number of attempts to read the status socket before declaring the instance down.")
+	socketRetryBackoff     = flag.Duration("status-socket.retry-backoff", 100*time.Millisecond, "Backoff before the first retry of a failed status socket read, doubled for every further retry.")
+	ifaceLookupEnable      = flag.Bool("interface-lookup.enable", true, "Resolve the interface of peers from kernel l2tp tunnels when fastd does not report it.")
+	ifaceLabelPlaceholder  = flag.String("interface-label.placeholder", "", "Value of the interface label of peers whose interface is neither reported by fastd nor found by --interface-lookup.enable. Empty values are dropped by Prometheus.")
+	tracingEndpoint        = flag.String("tracing.otlp-endpoint", "", "OTLP/HTTP endpoint (host:port) to export traces of the collection pipeline to. Tracing is disabled if empty.")
+	tracingInsecure        = flag.Bool("tracing.otlp-insecure", false, "Export traces via plain HTTP instead of HTTPS.")
+	stalledPolls           = flag.Int("stalled.polls", 3, "Number of consecutive status reads without received bytes after which an established session is considered stalled. 0 disables stall detection.")
+	enrichmentDNSServer    = flag.String("enrichment.dns-server", "", "DNS server (ip[:port]) to use for enrichment lookups instead of the system resolver.")
+	enrichmentProxy        = flag.String("enrichment.proxy", "", "Proxy (socks5://host:port or http://host:port) to route enrichment lookups through, requires --enrichment.dns-server.")
+	geoipDatabasePath      = flag.String("geoip.database", "", "Path to a MaxMind GeoIP2/GeoLite2 country or city database, enables aggregation of peers by country.")
+	eventsInterval         = flag.Duration("events.interval", time.Minute, "Interval in which instances are polled for peer lifecycle events and snapshots published to the event sinks.")
+	eventsKafkaBrokers     = flag.String("events.kafka-brokers", "", "Comma separated list of Kafka brokers (host:port) to publish events to. Disabled if empty.")
+	eventsKafkaTopic       = flag.String("events.kafka-topic", "fastd-events", "Kafka topic to publish events to.")
+	eventsNATSURL          = flag.String("events.nats-url", "", "NATS server URL(s) to publish events to. Disabled if empty.")
+	eventsNATSSubject      = flag.String("events.nats-subject", "fastd.%s.events", "NATS subject to publish events to, %s will be replaced with the fastd instance name.")
+	snmpAgentXAddress      = flag.String("snmp.agentx-address", "", "AgentX master agent (unix socket path or host:port) to register the fastd SNMP subtree with. Disabled if empty.")
+	snmpBaseOID            = flag.String("snmp.base-oid", "1.3.6.1.4.1.8072.9999.9999.7", "OID under which the instance and peer tables are exposed via SNMP.")
+	exportDirectory        = flag.String("export.directory", "", "Directory to periodically write CSV snapshots of the connected peers to. Disabled if empty.")
+	exportInterval         = flag.Duration("export.interval", 5*time.Minute, "Interval in which snapshots of the connected peers are exported.")
+	exportRotateInterval   = flag.Duration("export.rotate-interval", 24*time.Hour, "Age after which a new export file is started.")
+	exportRetention        = flag.Duration("export.retention", 30*24*time.Hour, "Age after which export files are removed. 0 keeps them forever.")
+	exportMaxSize          = flag.Int64("export.max-size", 0, "Maximum size in bytes of all export files together, the oldest files are removed beyond. 0 means no limit.")
+	rollupsDirectory       = flag.String("rollups.directory", "", "Directory to keep the daily traffic of every peer in, a file per day, served on /api/v1/rollups. Disabled if empty.")
+	rollupsInterval        = flag.Duration("rollups.interval", 5*time.Minute, "Interval in which the traffic of the peers is added to the daily rollups and saved.")
+	rollupsRetention       = flag.Duration("rollups.retention", 90*24*time.Hour, "Age after which daily rollups are removed. 0 keeps them forever.")
+	statusFileMaxAge       = flag.Duration("status-file.max-age", 5*time.Minute, "Age after which a status file given as file:// is considered stale and the instance down. 0 disables the check.")
+	lite                   = flag.Bool("lite", false, "Low-memory profile for embedded gateways: disables enrichment, caching, optional subsystems and all per-peer metrics but up, uptime and traffic.")
+	runAsUser              = flag.String("user", "", "User (name or uid) to switch to once the listener is bound and the fastd configs are read.")
+	runAsGroup             = flag.String("group", "", "Group (name or gid) to switch to along with --user, defaults to the primary group of the user.")
+	peersByPrefixThreshold = flag.Int("peers-by-prefix.threshold", 10, "Minimum number of connected peers from the same /24 or /48 prefix for it to be exported. 0 disables the aggregation.")
+	histogramsNativeFactor = flag.Float64("histograms.native-bucket-factor", 0, "Growth factor between the buckets of native histograms, e.g. 1.1. Native histograms are exposed to scrapers negotiating protobuf. 0 disables them.")
+	histogramsClassic      = flag.Bool("histograms.classic-buckets", true, "Expose the classic buckets of histograms, may be disabled when native histograms are used to keep the bucket cardinality low.")
+	packetSizePerPeer      = flag.Bool("packet-size.per-peer", false, "Export the average packet size of each connected peer in addition to the one of each instance.")
+	webRefreshToken        = flag.String("web.refresh-token", "", "Bearer token required for scrapes with ?refresh=true, which bypass the snapshot cache. Any client may bypass the cache if empty.")
+	frozenPolls            = flag.Int("frozen.polls", 3, "Number of consecutive status reads without the uptime of fastd increasing after which the instance is considered frozen. 0 disables the detection.")
+	remoteDNSInterval      = flag.Duration("remote-dns.interval", 0, "Interval in which the hostnames in the remote statements of configured peers are resolved. 0 disables the checks.")
+	remoteDNSTimeout       = flag.Duration("remote-dns.timeout", 5*time.Second, "Timeout for resolving the hostname of a peer remote.")
+	configHTTPTimeout      = flag.Duration("config-http.timeout", 10*time.Second, "Timeout for fetching fastd configs given as HTTP(S) URLs.")
+	peerMetadataKeys       = flag.String("peer-metadata.keys", "", "Comma separated keys of comments like \"# owner: ...\" in peer files to export as labels of fastd_peer_metadata_info.")
+	pollInterval           = flag.Duration("poll.interval", 0, "Interval in which instances are read between scrapes to track the minimum and maximum throughput of peers. 0 disables the poller.")
+	sessionsWindow         = flag.Duration("sessions.window", 24*time.Hour, "Time window of the completed sessions from which the quantiles of fastd_peers_completed_session_duration_seconds are computed.")
+	verifyHookEnable       = flag.Bool("verify-hook.enable", false, "Accept reports of unknown peers from the fastd on verify hook at /hooks/verify.")
+	verifyHookKeyPrefix    = flag.Int("verify-hook.key-prefix", 0, "Number of leading hex digits of the public key of unknown peers exported in the key_prefix label of fastd_unknown_peer_attempts_total. 0 omits the label.")
+	peerAPIURL             = flag.String("peer-api.url", "", "URL of a peer registry entry, {pubkey} is replaced with the public key of the peer. Enables fastd_peer_registry_info.")
+	peerAPIFields          = flag.String("peer-api.fields", "", "Comma separated fields of the JSON object returned by the peer registry to export as labels of fastd_peer_registry_info.")
+	peerAPICacheTTL        = flag.Duration("peer-api.cache-ttl", time.Hour, "Time to cache the peer registry entry of a peer.")
+	peerAPITimeout         = flag.Duration("peer-api.timeout", 5*time.Second, "Timeout of requests to the peer registry.")
+	consulAddress          = flag.String("consul.address", "", "Address of the local Consul agent, e.g. http://127.0.0.1:8500, enables the Consul integration.")
+	consulToken            = flag.String("consul.token", "", "ACL token for requests to Consul.")
+	consulServiceName      = flag.String("consul.service-name", "fastd-exporter", "Name under which the exporter registers as a service in Consul.")
+	consulKVPrefix         = flag.String("consul.kv-prefix", "", "Consul KV prefix of the peer tags, with one key per public key holding comma separated tags. Empty disables the peer tags.")
+	consulKVInterval       = flag.Duration("consul.kv-interval", time.Minute, "Interval in which the peer tags are read from Consul.")
+	peakWindow             = flag.Duration("peak.window", time.Hour, "Rolling window of fastd_peers_up_peak_window.")
+	handshakeLogEnable     = flag.Bool("handshake-log.enable", false, "Follow the logs of the instances to export the time of the last handshake of each peer.")
+	handshakeLogCommand    = flag.String("handshake-log.command", "journalctl --follow --lines=0 --output=cat --unit=fastd@%s.service", "Command printing the log of an instance as it is written, %s will be replaced with the instance name.")
+	statusTLSCA            = flag.String("status-tls.ca", "", "CA certificates to verify status sockets read over tls:// with, instead of the system CAs.")
+	statusTLSCert          = flag.String("status-tls.cert", "", "Client certificate for status sockets read over tls://.")
+	statusTLSKey           = flag.String("status-tls.key", "", "Key of the client certificate for status sockets read over tls://.")
+	statusTLSServerName    = flag.String("status-tls.server-name", "", "Server name to verify the certificates of status sockets read over tls:// with, instead of their host.")
+	statusTLSInsecure      = flag.Bool("status-tls.insecure-skip-verify", false, "Do not verify the certificates of status sockets read over tls://.")
+	sshIdentityFile        = flag.String("ssh.identity-file", "", "Private key to authenticate with for status sockets read over ssh://. (default ~/.ssh/id_ed25519, id_ecdsa or id_rsa and the SSH agent)")
+	sshKnownHosts          = flag.String("ssh.known-hosts", "", "Known hosts file to verify the hosts of status sockets read over ssh://. (default ~/.ssh/known_hosts)")
+	socketProxy            = flag.String("status-socket.proxy", "", "SOCKS5 proxy (socks5://host:port) to read status sockets given as tcp:// or tls:// through.")
+	agentCollectorAddress  = flag.String("agent.collector-address", "", "Address of a collector to stream snapshots of all instances to over gRPC, enables the agent mode.")
+	agentName              = flag.String("agent.name", "", "Name of the gateway in the gateway label on the collector. (default hostname)")
+	agentInterval          = flag.Duration("agent.interval", 15*time.Second, "Interval in which the agent streams snapshots to the collector.")
+	collectorListenAddress = flag.String("collector.listen-address", "", "Address to accept snapshots from agents on over gRPC, enables the collector mode.")
+	collectorMaxAge        = flag.Duration("collector.max-age", time.Minute, "Age after which the last snapshot from an agent is considered stale and its instance down.")
+	grpcListenAddress      = flag.String("grpc.listen-address", "", "Address to serve the status of the instances on over gRPC (fastd.status.v1.StatusService).")
+	grpcTLSCA              = flag.String("grpc.tls-ca", "", "CA certificates to verify the other side of gRPC connections with.")
+	grpcTLSCert            = flag.String("grpc.tls-cert", "", "Certificate for gRPC connections.")
+	grpcTLSKey             = flag.String("grpc.tls-key", "", "Key of --grpc.tls-cert.")
+	grpcInsecure           = flag.Bool("grpc.insecure", false, "Use plain text instead of mutual TLS for gRPC connections.")
+	debugSnapshots         = flag.Int("debug.snapshots", 0, "Number of raw status payloads to keep per instance for /debug/snapshots/<instance>. 0 disables the journal.")
+	peerNameMaxLength      = flag.Int("peer-name.max-length", 64, "Length in characters peer names are truncated to in labels. 0 disables truncation.")
+	webManagementAddress   = flag.String("web.management-address", "", "Comma separated addresses to serve the peer API, /debug/snapshots and the profiler on instead of along with the metrics, e.g. localhost:9282.")
+	peerLabelsMinimal      = flag.Bool("peer-labels.minimal", false, "Label peer metrics other than the info metrics only with public_key, the name and interface are kept in fastd_peer_info.")
+	peerSamplingModulus    = flag.Int("peer-sampling.modulus", 0, "Only export the per peer metrics of the peers whose hashed public key is divisible by this number, aggregates still cover all peers. 0 or 1 exports all peers.")
+	txRatiosWindow         = flag.Duration("tx-ratios.window", 0, "Window to export the share of dropped and failed tx packets of each instance over, from the status reads of scrapes and the poller. 0 disables the ratios.")
+	statusSocketNetns      = flag.String("status-socket.netns", "", "Network namespace to connect to status sockets from, by name as in ip netns or by path like /proc/<pid>/ns/net. Requires CAP_SYS_ADMIN.")
+	maintenanceNoEvents    = flag.Bool("maintenance.suppress-events", false, "Do not publish peer events of instances in a maintenance window.")
+	logRepeatInterval      = flag.Duration("log.repeat-interval", 10*time.Minute, "Interval in which identical errors, e.g. of an instance that is down, are logged only once. 0 logs every occurrence.")
+	statusSocketStreaming  = flag.Bool("status-socket.streaming", false, "Keep the status socket connection open and update the cached status whenever fastd sends a new one. Falls back to reading the socket on every scrape if fastd closes the connection.")
+	socketSystemdUnit      = flag.String("status-socket.systemd-unit", "", "Systemd unit of an instance, %s will be replaced with the fastd instance name. If set, the status socket of instances whose config does not declare one is taken from --status-socket in the ExecStart of the unit and its drop-ins, e.g. \"fastd@%s.service\".")
+	peersTrendWindow       = flag.Duration("peers-trend.window", 0, "Window to fit the linear trend of connected peers of each instance exported as fastd_peers_trend_per_hour to, from the status reads of scrapes and the poller. 0 disables the trend.")
+	nodesJSONURL           = flag.String("nodes-json.url", "", "URL of a meshviewer or ffmap-backend nodes.json to export the connected peers by the firmware release of their node from, matched by fastd public key or mesh VPN MAC address.")
+	nodesJSONInterval      = flag.Duration("nodes-json.interval", 5*time.Minute, "Interval between fetches of the nodes.json.")
+	peerNamePseudonymKey   = flag.String("peer-name.pseudonym-key", "", "If set, peer names in labels, the APIs, events, exports and rollups are replaced with a stable pseudonym derived from the name with this key, for communities that consider node names personal data.")
+	bridgeExpected         = flag.String("bridge.expected", "", "Bridge or batman-adv interface the interfaces of an instance and its peers should be enslaved to, %s will be replaced with the fastd instance name. Enables fastd_interface_bridged.")
+	fastdVersionBinary     = flag.String("fastd-version.binary", "fastd", "fastd binary to run with --version to export fastd_version_info, if the process of an instance cannot be found. Empty disables the version check.")
+	fastdVersionInterval   = flag.Duration("fastd-version.interval", time.Hour, "Interval between checks of the fastd version.")
+	handshakeStormRatio    = flag.Float64("handshake-storm.ratio", 0, "Handshakes per minute and connected peer, seen with --handshake-log.enable or --verify-hook.enable, above which fastd_handshake_storm is 1. 0 disables the detection.")
+	discoverConfigDir      = flag.String("discover-config-dir", "", "fastd config directory like /etc/fastd, whose subdirectories with a fastd.conf are exported as instances in addition to those given as arguments.")
+	discoverInterval       = flag.Duration("discover-config-dir.interval", 5*time.Minute, "Interval in which --discover-config-dir is scanned again for new instances, which also happens on SIGHUP. 0 only scans it again on SIGHUP.")
+	nat64PrefixList        = flag.String("nat64.prefixes", "64:ff9b::/96", "Comma separated NAT64 prefixes, of a length of 32, 40, 48, 56, 64 or 96 bits, whose addresses are treated as the IPv4 address they embed.")
+	asnCacheSaveInterval   = flag.Duration("ip-asn-lookup.cache-save-interval", 15*time.Minute, "Interval in which the ASN cache is saved to --ip-asn-lookup.cache-file in addition to on shutdown, so a crash does not lose it. 0 only saves it on shutdown.")
+	scrapeMinInterval      = flag.Duration("scrape.min-interval", 0, "Minimum interval between status socket reads, scrapes within this interval are served from the previous snapshot. 0 disables caching.")
 )
 
 // PacketStatistics These are the structs necessary for unmarshalling the data that is being received on fastds unix socket.
@@ -37,12 +188,18 @@ type PacketStatistics struct {
 	Bytes int `json:"bytes"`
 }
 
+func (stats *PacketStatistics) add(other PacketStatistics) {
+	stats.Count += other.Count
+	stats.Bytes += other.Bytes
+}
+
+// Statistics Sections that older fastd releases do not report are left nil.
 type Statistics struct {
-	Rx          PacketStatistics `json:"rx"`
-	RxReordered PacketStatistics `json:"rx_reordered"`
-	Tx          PacketStatistics `json:"tx"`
-	TxDropped   PacketStatistics `json:"tx_dropped"`
-	TxError     PacketStatistics `json:"tx_error"`
+	Rx          PacketStatistics  `json:"rx"`
+	RxReordered *PacketStatistics `json:"rx_reordered"`
+	Tx          PacketStatistics  `json:"tx"`
+	TxDropped   *PacketStatistics `json:"tx_dropped"`
+	TxError     *PacketStatistics `json:"tx_error"`
 }
 
 type Message struct {
@@ -50,6 +207,9 @@ type Message struct {
 	Interface  string          `json:"interface"`
 	Statistics Statistics      `json:"statistics"`
 	Peers      map[string]Peer `json:"peers"`
+
+	// payload the message was decoded from, kept for --debug.snapshots
+	raw json.RawMessage
 }
 
 type Peer struct {
@@ -60,15 +220,220 @@ type Peer struct {
 		Established float64    `json:"established"`
 		Method      string     `json:"method"`
 		Statistics  Statistics `json:"statistics"`
+		// older fastd releases report the mac addresses as part of the connection
+		MAC []string `json:"mac_addresses"`
 	} `json:"connection"`
 	MAC []string `json:"mac_addresses"`
 }
 
+// statusVersion guesses the generation of the fastd release from the sections
+// present in its status output, as fastd does not report its version there.
+func statusVersion(msg Message) string {
+	if msg.Statistics.RxReordered == nil || msg.Statistics.TxDropped == nil || msg.Statistics.TxError == nil {
+		return "legacy"
+	}
+	return "current"
+}
+
+// peerState is what the exporter remembers about a peer between collections.
+type peerState struct {
+	// name reported by fastd and the name exported in labels
+	name          string
+	sanitizedName string
+
+	// last interface the peer was seen on, kept while the peer is disconnected
+	interfaceName string
+	// last address the peer was connected from
+	address netip.Addr
+
+	// rx byte counter at the last status read and the number of consecutive
+	// reads it did not change while the session was established
+	rxBytes        int
+	unchangedPolls int
+
+	// rx and tx byte counters of the session at the status read at bytesRead
+	// and the throughput since the read before, if known
+	bytes           int
+	bytesRead       time.Time
+	throughput      float64
+	throughputKnown bool
+
+	packetSizes packetSizes
+
+	// sessions seen since the exporter started, counted at status reads
+	connected      bool
+	sessions       int
+	connectedAt    time.Time
+	disconnectedAt time.Time
+	// age of the session in seconds at the last status read
+	established float64
+}
+
+// updateSession records the connection state of the peer at a status read.
+func (state *peerState) updateSession(connected bool, readTime time.Time) {
+	if connected && !state.connected {
+		state.sessions += 1
+		state.connectedAt = readTime
+	} else if !connected && state.connected {
+		state.disconnectedAt = readTime
+	}
+	state.connected = connected
+}
+
+// packetSizes derives the average packet size from the deltas of the
+// counters between two status reads.
+type packetSizes struct {
+	rx, tx PacketStatistics
+	// average packet sizes, 0 if unknown or nothing was transferred
+	rxSize, txSize float64
+}
+
+func (sizes *packetSizes) update(rx PacketStatistics, tx PacketStatistics) {
+	sizes.rxSize = averagePacketSize(sizes.rx, rx)
+	sizes.txSize = averagePacketSize(sizes.tx, tx)
+	sizes.rx, sizes.tx = rx, tx
+}
+
+func averagePacketSize(previous PacketStatistics, current PacketStatistics) float64 {
+	packets := current.Count - previous.Count
+	if previous.Count == 0 || packets <= 0 || current.Bytes < previous.Bytes {
+		return 0
+	}
+	return float64(current.Bytes-previous.Bytes) / float64(packets)
+}
+
+func collectPacketSizes(channel chan<- prometheus.Metric, desc *prometheus.Desc, sizes packetSizes, labelValues ...string) {
+	if sizes.rxSize > 0 {
+		channel <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, sizes.rxSize, append(labelValues, "rx")...)
+	}
+	if sizes.txSize > 0 {
+		channel <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, sizes.txSize, append(labelValues, "tx")...)
+	}
+}
+
 type PrometheusExporter struct {
+	instance         string
 	statusSocketPath string
-
-	up     *prometheus.Desc
-	uptime *prometheus.Desc
+	configuredMTU    int
+	configPath       string
+	methods          []string
+	settings         instanceSettings
+
+	// snapshot of the last status socket read, guarded by mutex
+	mutex       sync.Mutex
+	lastRead    time.Time
+	lastMessage Message
+	lastError   error
+	// whether a status read succeeded at least once
+	ready bool
+	// whether fastd keeps the status connection open and sends updates
+	streaming bool
+	// optional instances do not gate readiness of the exporter
+	optional bool
+	// collection is paused for maintenance, until pausedUntil if set
+	paused      bool
+	pausedUntil time.Time
+	// end of the maintenance window started through the API
+	maintenanceUntil time.Time
+	// metrics of instances with a listen address of their own, nil if the
+	// instance is served along with the others
+	registry   *prometheus.Registry
+	registries *exporterRegistries
+
+	// per peer state, guarded by peersMutex
+	peersMutex sync.Mutex
+	peers      map[string]*peerState
+	// time of the status read the peer state was last updated from
+	peersUpdated time.Time
+	packetSizes  packetSizes
+	// uptime at the last status read and the number of consecutive reads it
+	// did not increase
+	lastUptime       float64
+	unchangedUptimes int
+	// number of implausible values in status reads by kind
+	anomalies map[string]int
+	// number of peer names that had to be sanitized
+	sanitizedNames int
+	// number of peers seen from a new address, by ASN of the new address
+	addressChanges map[string]int
+
+	// peers from the fastd config, guarded by peerConfigMutex
+	peerConfigMutex sync.Mutex
+	peerConfig      map[string]peerConfig
+	peerGroups      map[string]peerGroup
+	peerConfigRead  time.Time
+	// problems found in the config by reason and whether the last read had
+	// none
+	configErrors map[string]int
+	configValid  bool
+	keyFiles     keyFileHealth
+
+	// results of resolving the remotes of configured peers, guarded by
+	// remoteChecksMutex
+	remoteChecksMutex sync.Mutex
+	remoteChecks      []remoteCheck
+
+	// throughput of peers seen by the poller, guarded by windowsMutex
+	windowsMutex sync.Mutex
+	windows      map[string]*throughputWindow
+
+	// handshake attempts of unknown peers by key prefix, guarded by
+	// unknownPeersMutex
+	unknownPeersMutex sync.Mutex
+	unknownPeers      map[string]int
+
+	// time of the last handshake seen in the log by peer name or key,
+	// guarded by handshakesMutex
+	handshakesMutex sync.Mutex
+	handshakes      map[string]time.Time
+	// handshake exchanges seen and the times of those of the last minute,
+	// guarded by handshakesMutex
+	handshakeCount  int
+	handshakeWindow []time.Time
+
+	// version of the fastd binary, empty until known, guarded by
+	// versionMutex
+	versionMutex sync.Mutex
+	version      string
+
+	// maxima of connected peers, guarded by peakMutex
+	peakMutex sync.Mutex
+	peak      peakTracker
+
+	// tx counters of recent status reads, guarded by txRatiosMutex
+	txRatiosMutex sync.Mutex
+	txRatios      txRatios
+	// connected peers of recent status reads, guarded by peersTrendMutex
+	peersTrendMutex sync.Mutex
+	peersTrend      peersTrend
+
+	// last status payloads for /debug/snapshots/
+	journal snapshotJournal
+
+	up                  *prometheus.Desc
+	uptime              *prometheus.Desc
+	socketAccessible    *prometheus.Desc
+	socketFileAge       *prometheus.Desc
+	socketFileIsSocket  *prometheus.Desc
+	interfaceBridged    *prometheus.Desc
+	frozen              *prometheus.Desc
+	txDroppedRatio      *prometheus.Desc
+	txErrorRatio        *prometheus.Desc
+	peersTrendPerHour   *prometheus.Desc
+	anomaliesTotal      *prometheus.Desc
+	sanitizedNamesTotal *prometheus.Desc
+	addressChangesByASN *prometheus.Desc
+	statusVersion       *prometheus.Desc
+	versionInfo         *prometheus.Desc
+	handshakeStorm      *prometheus.Desc
+	handshakeAttempts   *prometheus.Desc
+	instanceInfo        *prometheus.Desc
+	instancePaused      *prometheus.Desc
+	maintenance         *prometheus.Desc
+
+	configuredMTUBytes   *prometheus.Desc
+	interfaceMTUBytes    *prometheus.Desc
+	interfaceMTUMismatch *prometheus.Desc
 
 	rxPackets *prometheus.Desc
 	rxBytes   *prometheus.Desc
@@ -85,11 +450,63 @@ type PrometheusExporter struct {
 	txErrorPackets *prometheus.Desc
 	txErrorBytes   *prometheus.Desc
 
-	peersUpTotal *prometheus.Desc
-
-	peerUp     *prometheus.Desc
-	peerUptime *prometheus.Desc
-	peerInfo   *prometheus.Desc
+	peersUpTotal      *prometheus.Desc
+	peersUpPeak       *prometheus.Desc
+	peersUpPeakWindow *prometheus.Desc
+	peersByFamily     *prometheus.Desc
+	peersNAT64        *prometheus.Desc
+	peersBySessionAge *prometheus.Desc
+	peersStalledTotal *prometheus.Desc
+	peersByCountry    *prometheus.Desc
+	peersByFirmware   *prometheus.Desc
+	peersByPrefix     *prometheus.Desc
+	peersTracked      *prometheus.Desc
+	peersSampled      *prometheus.Desc
+	criticalPeerUp    *prometheus.Desc
+	peersBySite       *prometheus.Desc
+	peerASNsDistinct  *prometheus.Desc
+
+	trafficByMethodPackets *prometheus.Desc
+	trafficByMethodBytes   *prometheus.Desc
+	trafficBySitePackets   *prometheus.Desc
+	trafficBySiteBytes     *prometheus.Desc
+
+	peerUp             *prometheus.Desc
+	peerUptime         *prometheus.Desc
+	peerInfo           *prometheus.Desc
+	peerInterfaceInfo  *prometheus.Desc
+	peerStalled        *prometheus.Desc
+	peerFloating       *prometheus.Desc
+	peerGroupPeersUp   *prometheus.Desc
+	peerGroupPeerLimit *prometheus.Desc
+	configValidDesc    *prometheus.Desc
+	configParseErrors  *prometheus.Desc
+	secretKeyValid     *prometheus.Desc
+	secretKeySecure    *prometheus.Desc
+	peerKeyFiles       *prometheus.Desc
+	peerMethod         *prometheus.Desc
+	peerMethodDetail   *prometheus.Desc
+	peerMetadataInfo   *prometheus.Desc
+	metadataKeys       []string
+
+	peerRemoteResolved  *prometheus.Desc
+	peerRemoteAddresses *prometheus.Desc
+	peerThroughputMin   *prometheus.Desc
+	peerThroughputMax   *prometheus.Desc
+	unknownPeerAttempts *prometheus.Desc
+	peerRegistryInfo    *prometheus.Desc
+	// info metrics of the enabled enrichers by name
+	enricherInfo      map[string]*prometheus.Desc
+	peerTagInfo       *prometheus.Desc
+	peerLastHandshake *prometheus.Desc
+
+	averagePacketSize     *prometheus.Desc
+	peerAveragePacketSize *prometheus.Desc
+
+	peersSessionDuration prometheus.HistogramOpts
+	peersThroughput      prometheus.HistogramOpts
+	// durations of ended sessions, kept across collections
+	completedSessions prometheus.Summary
 
 	peerRxPackets          *prometheus.Desc
 	peerRxBytes            *prometheus.Desc
@@ -109,29 +526,113 @@ func prefixWrapper(parts ...string) string {
 	return strings.Join(parts, "_")
 }
 
-func NewPrometheusExporter(instance string, sockName string) PrometheusExporter {
+func NewPrometheusExporter(instance string, config fastdConfig) *PrometheusExporter {
 	staticLabels := prometheus.Labels{
 		"fastd_instance": instance,
 	}
+	if config.gateway != "" {
+		staticLabels["gateway"] = config.gateway
+	}
+	if config.host != "" {
+		staticLabels["host"] = config.host
+	}
+	for _, name := range exporterConfig.labelNames() {
+		staticLabels[name] = exporterConfig.instanceLabel(instance, name)
+	}
 	dynamicLabels := []string{
 		"public_key",
 		"name",
 		"interface",
 	}
 
+	// labels of the peer metrics other than the info metrics
+	peerLabels := dynamicLabels
+	if *peerLabelsMinimal {
+		peerLabels = []string{"public_key"}
+	}
+
 	dynamicPeerInfoLabels := append(dynamicLabels, []string{
 		"method",
 		"asn",
 		"ipaddr_family",
 	}...)
 
-	return PrometheusExporter{
-		statusSocketPath: sockName,
+	metadataKeys := peerMetadataKeyList()
+
+	var unknownPeerLabels []string
+	if *verifyHookKeyPrefix > 0 {
+		unknownPeerLabels = []string{"key_prefix"}
+	}
+
+	return &PrometheusExporter{
+		instance:         instance,
+		statusSocketPath: config.statusSocketPath,
+		configuredMTU:    config.mtu,
+		configPath:       config.path,
+		methods:          config.methods,
+		settings:         exporterConfig.instanceSettings(instance),
+		peers:            map[string]*peerState{},
+		unknownPeers:     map[string]int{},
+		handshakes:       map[string]time.Time{},
+		addressChanges:   map[string]int{},
+		configErrors:     map[string]int{},
+		anomalies: map[string]int{
+			anomalyUptimeInvalid:      0,
+			anomalyUptimeBackwards:    0,
+			anomalyEstablishedInvalid: 0,
+		},
+
+		peersSessionDuration: prometheus.HistogramOpts{
+			Name:        prefixWrapper("peers_session_duration_seconds"),
+			Help:        "distribution of the age of the sessions of connected peers",
+			ConstLabels: staticLabels,
+			Buckets:     prometheus.ExponentialBuckets(60, 4, 8),
+		},
+		completedSessions: prometheus.NewSummary(prometheus.SummaryOpts{
+			Name:        prefixWrapper("peers_completed_session_duration_seconds"),
+			Help:        "quantiles of the duration of sessions that ended within the window, as last seen before they ended",
+			ConstLabels: staticLabels,
+			Objectives:  map[float64]float64{0.5: 0.05, 0.9: 0.01, 0.99: 0.001},
+			MaxAge:      *sessionsWindow,
+			AgeBuckets:  6,
+		}),
+		peersThroughput: prometheus.HistogramOpts{
+			Name:        prefixWrapper("peers_throughput_bytes_per_second"),
+			Help:        "distribution of the rx and tx throughput of connected peers between the last two status reads",
+			ConstLabels: staticLabels,
+			Buckets:     prometheus.ExponentialBuckets(100, 10, 7),
+		},
+
+		anomaliesTotal:        prometheus.NewDesc(prefixWrapper("status_anomalies_total"), "number of implausible time values in the status output that were not exported", []string{"kind"}, staticLabels),
+		addressChangesByASN:   prometheus.NewDesc(prefixWrapper("peer_address_changes_by_asn_total"), "number of times peers were seen from a different address than before, by ASN of the new address", []string{"asn"}, staticLabels),
+		sanitizedNamesTotal:   prometheus.NewDesc(prefixWrapper("peer_names_sanitized_total"), "number of peer names with invalid UTF-8 or control characters or above --peer-name.max-length that were sanitized", nil, staticLabels),
+		frozen:                prometheus.NewDesc(prefixWrapper("frozen"), "whether the uptime of the fastd process stopped increasing while its status socket still answers", nil, staticLabels),
+		txDroppedRatio:        prometheus.NewDesc(prefixWrapper("tx_dropped_ratio"), "share of the packets to send that were dropped within --tx-ratios.window", nil, staticLabels),
+		txErrorRatio:          prometheus.NewDesc(prefixWrapper("tx_error_ratio"), "share of the packets to send that failed within --tx-ratios.window", nil, staticLabels),
+		peersTrendPerHour:     prometheus.NewDesc(prefixWrapper("peers_trend_per_hour"), "slope of a linear fit of the number of connected peers within --peers-trend.window, in peers per hour", nil, staticLabels),
+		averagePacketSize:     prometheus.NewDesc(prefixWrapper("average_packet_size_bytes"), "average size of the packets transferred between the last two status reads", []string{"direction"}, staticLabels),
+		peerAveragePacketSize: prometheus.NewDesc(prefixWrapper("peer_average_packet_size_bytes"), "average size of the packets of the peer transferred between the last two status reads", append(peerLabels, "direction"), staticLabels),
 
 		// global metrics
 		up:     prometheus.NewDesc(prefixWrapper("up"), "whether the fastd process is up", nil, staticLabels),
 		uptime: prometheus.NewDesc(prefixWrapper("uptime_seconds"), "uptime of the fastd process", nil, staticLabels),
 
+		socketAccessible:   prometheus.NewDesc(prefixWrapper("status_socket_accessible"), "whether the status socket could be connected to, reason describes why not", []string{"reason"}, staticLabels),
+		socketFileAge:      prometheus.NewDesc(prefixWrapper("status_socket_age_seconds"), "time since the status socket was last modified, which is usually when fastd created it", nil, staticLabels),
+		interfaceBridged:   prometheus.NewDesc(prefixWrapper("interface_bridged"), "whether the interface of the instance or of a connected peer is enslaved to the expected bridge", []string{"interface"}, staticLabels),
+		socketFileIsSocket: prometheus.NewDesc(prefixWrapper("status_socket_is_socket"), "whether the status socket is a socket, 0 for a regular file left behind e.g. after a crash", nil, staticLabels),
+		instanceInfo:       prometheus.NewDesc(prefixWrapper("instance_info"), "display name of the instance from the configuration file, or its name", []string{"display_name"}, staticLabels),
+		instancePaused:     prometheus.NewDesc(prefixWrapper("instance_paused"), "whether the collection of the instance is paused for maintenance", nil, staticLabels),
+		maintenance:        prometheus.NewDesc(prefixWrapper("maintenance"), "whether the instance is in a planned maintenance window", nil, staticLabels),
+		handshakeAttempts:  prometheus.NewDesc(prefixWrapper("handshake_attempts_total"), "number of handshake exchanges seen in the log or reported by the verify hook", nil, staticLabels),
+		handshakeStorm:     prometheus.NewDesc(prefixWrapper("handshake_storm"), "whether the handshakes of the last minute exceed --handshake-storm.ratio per connected peer", nil, staticLabels),
+		versionInfo:        prometheus.NewDesc(prefixWrapper("version_info"), "version of the fastd binary of the instance, of the running process if it can be found", []string{"version"}, staticLabels),
+		statusVersion:      prometheus.NewDesc(prefixWrapper("status_version_info"), "generation of the status output format detected for the fastd process", []string{"version"}, staticLabels),
+
+		configuredMTUBytes:   prometheus.NewDesc(prefixWrapper("config_mtu_bytes"), "mtu configured in the fastd config", nil, staticLabels),
+		interfaceMTUBytes:    prometheus.NewDesc(prefixWrapper("interface_mtu_bytes"), "live mtu of a fastd interface", []string{"interface"}, staticLabels),
+		interfaceMTUMismatch: prometheus.NewDesc(prefixWrapper("interface_mtu_mismatch"), "whether the mtu of a fastd interface differs from the configured mtu", []string{"interface"}, staticLabels),
+
 		rxPackets:          prometheus.NewDesc(prefixWrapper("rx_packets"), "rx packet count", nil, staticLabels),
 		rxBytes:            prometheus.NewDesc(prefixWrapper("rx_bytes"), "rx byte count", nil, staticLabels),
 		rxReorderedPackets: prometheus.NewDesc(prefixWrapper("rx_reordered_packets"), "rx reordered packets count", nil, staticLabels),
@@ -144,31 +645,89 @@ func NewPrometheusExporter(instance string, sockName string) PrometheusExporter
 		txErrorPackets:   prometheus.NewDesc(prefixWrapper("tx_error_packets"), "tx error packets count", nil, staticLabels),
 		txErrorBytes:     prometheus.NewDesc(prefixWrapper("tx_error_bytes"), "tx error bytes count", nil, staticLabels),
 
-		peersUpTotal: prometheus.NewDesc(prefixWrapper("peers_up_total"), "number of connected peers", nil, staticLabels),
+		peersUpTotal:      prometheus.NewDesc(prefixWrapper("peers_up_total"), "number of connected peers", nil, staticLabels),
+		peersUpPeak:       prometheus.NewDesc(prefixWrapper("peers_up_peak"), "maximum number of connected peers seen at a status read since the exporter started", nil, staticLabels),
+		peersUpPeakWindow: prometheus.NewDesc(prefixWrapper("peers_up_peak_window"), "maximum number of connected peers seen at a status read within --peak.window", nil, staticLabels),
+		peersByFamily:     prometheus.NewDesc(prefixWrapper("peers_by_address_family"), "number of connected peers by address family of their remote address", []string{"ipaddr_family"}, staticLabels),
+		peersBySessionAge: prometheus.NewDesc(prefixWrapper("peers_by_session_age"), "number of connected peers by age of their session", []string{"bucket"}, staticLabels),
+		peersNAT64:        prometheus.NewDesc(prefixWrapper("peers_nat64"), "number of connected peers whose remote address is in a NAT64 prefix, counted as IPv4 by address family", nil, staticLabels),
+		peersStalledTotal: prometheus.NewDesc(prefixWrapper("peers_stalled_total"), "number of connected peers whose session is stalled", nil, staticLabels),
+		peersByCountry:    prometheus.NewDesc(prefixWrapper("peers_by_country"), "number of connected peers by country of their remote address", []string{"country_code"}, staticLabels),
+		peersByFirmware:   prometheus.NewDesc(prefixWrapper("peers_by_firmware"), "number of connected peers by the firmware release their node reports in the nodes.json", []string{"release"}, staticLabels),
+		peersByPrefix:     prometheus.NewDesc(prefixWrapper("peers_by_prefix"), "number of connected peers by /24 or /48 prefix of their remote address, for prefixes with at least --peers-by-prefix.threshold peers", []string{"prefix"}, staticLabels),
+		peersTracked:      prometheus.NewDesc(prefixWrapper("peers_tracked"), "number of peers the exporter keeps state about between status reads", nil, staticLabels),
+		peersSampled:      prometheus.NewDesc(prefixWrapper("peers_sampled"), "number of peers in the sample whose per peer metrics are exported with --peer-sampling.modulus", nil, staticLabels),
+		peerASNsDistinct:  prometheus.NewDesc(prefixWrapper("peer_asns_distinct"), "number of distinct ASNs of the remote addresses of connected peers", nil, staticLabels),
+		peersBySite:       prometheus.NewDesc(prefixWrapper("peers_by_site"), "number of connected peers by configured site", []string{"site"}, staticLabels),
+
+		trafficByMethodPackets: prometheus.NewDesc(prefixWrapper("traffic_by_method_packets"), "packets of the current sessions of connected peers by method", []string{"method", "direction"}, staticLabels),
+		trafficByMethodBytes:   prometheus.NewDesc(prefixWrapper("traffic_by_method_bytes"), "bytes of the current sessions of connected peers by method", []string{"method", "direction"}, staticLabels),
+		trafficBySitePackets:   prometheus.NewDesc(prefixWrapper("traffic_by_site_packets"), "packets of the current sessions of connected peers by configured site", []string{"site", "direction"}, staticLabels),
+		trafficBySiteBytes:     prometheus.NewDesc(prefixWrapper("traffic_by_site_bytes"), "bytes of the current sessions of connected peers by configured site", []string{"site", "direction"}, staticLabels),
 
 		// per peer metrics
-		peerUp:     prometheus.NewDesc(prefixWrapper("peer_up"), "whether the peer is connected", dynamicLabels, staticLabels),
-		peerUptime: prometheus.NewDesc(prefixWrapper("peer_uptime_seconds"), "peer session uptime", dynamicLabels, staticLabels),
-
-		peerInfo: prometheus.NewDesc(prefixWrapper("peer_info"), "general info about a peer (connection method, ASN, IP Version)", dynamicPeerInfoLabels, staticLabels),
-
-		peerRxPackets:          prometheus.NewDesc(prefixWrapper("peer_rx_packets"), "peer rx packets count", dynamicLabels, staticLabels),
-		peerRxBytes:            prometheus.NewDesc(prefixWrapper("peer_rx_bytes"), "peer rx bytes count", dynamicLabels, staticLabels),
-		peerRxReorderedPackets: prometheus.NewDesc(prefixWrapper("peer_rx_reordered_packets"), "peer rx reordered packets count", dynamicLabels, staticLabels),
-		peerRxReorderedBytes:   prometheus.NewDesc(prefixWrapper("peer_rx_reordered_bytes"), "peer rx reordered bytes count", dynamicLabels, staticLabels),
-
-		peerTxPackets:        prometheus.NewDesc(prefixWrapper("peer_tx_packets"), "peer rx packet count", dynamicLabels, staticLabels),
-		peerTxBytes:          prometheus.NewDesc(prefixWrapper("peer_tx_bytes"), "peer rx bytes count", dynamicLabels, staticLabels),
-		peerTxDroppedPackets: prometheus.NewDesc(prefixWrapper("peer_tx_dropped_packets"), "peer tx dropped packets count", dynamicLabels, staticLabels),
-		peerTxDroppedBytes:   prometheus.NewDesc(prefixWrapper("peer_tx_dropped_bytes"), "peer tx dropped bytes count", dynamicLabels, staticLabels),
-		peerTxErrorPackets:   prometheus.NewDesc(prefixWrapper("peer_tx_error_packets"), "peer tx error packets count", dynamicLabels, staticLabels),
-		peerTxErrorBytes:     prometheus.NewDesc(prefixWrapper("peer_tx_error_bytes"), "peer tx error bytes count", dynamicLabels, staticLabels),
+		peerUp:     prometheus.NewDesc(prefixWrapper("peer_up"), "whether the peer is connected", peerLabels, staticLabels),
+		peerUptime: prometheus.NewDesc(prefixWrapper("peer_uptime_seconds"), "peer session uptime", peerLabels, staticLabels),
+
+		criticalPeerUp: prometheus.NewDesc(prefixWrapper("critical_peer_up"), "whether the peer marked critical in the config is connected, 0 for critical peers fastd does not know", peerLabels, staticLabels),
+
+		peerInfo:            prometheus.NewDesc(prefixWrapper("peer_info"), "general info about a peer (connection method, ASN, IP Version)", dynamicPeerInfoLabels, staticLabels),
+		peerInterfaceInfo:   prometheus.NewDesc(prefixWrapper("peer_interface_info"), "interface of a peer, when fastd runs with an interface per peer", dynamicLabels, staticLabels),
+		peerStalled:         prometheus.NewDesc(prefixWrapper("peer_stalled"), "whether the session is established but received no data for several status reads", peerLabels, staticLabels),
+		peerRemoteResolved:  prometheus.NewDesc(prefixWrapper("peer_remote_resolved"), "whether the hostname of a remote of the configured peer could be resolved", []string{"public_key", "name", "remote"}, staticLabels),
+		peerRemoteAddresses: prometheus.NewDesc(prefixWrapper("peer_remote_addresses"), "number of addresses the hostname of a remote of the configured peer resolved to", []string{"public_key", "name", "remote"}, staticLabels),
+		peerThroughputMin:   prometheus.NewDesc(prefixWrapper("peer_throughput_min_bytes_per_second"), "minimum rx and tx throughput of the peer between two polls since the last scrape", peerLabels, staticLabels),
+		peerThroughputMax:   prometheus.NewDesc(prefixWrapper("peer_throughput_max_bytes_per_second"), "maximum rx and tx throughput of the peer between two polls since the last scrape", peerLabels, staticLabels),
+		unknownPeerAttempts: prometheus.NewDesc(prefixWrapper("unknown_peer_attempts_total"), "number of handshake attempts of peers unknown to fastd reported by the verify hook", unknownPeerLabels, staticLabels),
+		peerRegistryInfo:    prometheus.NewDesc(prefixWrapper("peer_registry_info"), "fields of the peer from the peer registry", append(append([]string{}, dynamicLabels...), registryFieldList...), staticLabels),
+		enricherInfo:        enricherDescs(dynamicLabels, staticLabels),
+		peerTagInfo:         prometheus.NewDesc(prefixWrapper("peer_tag_info"), "tags of the peer from the Consul KV store", append(dynamicLabels, "tag"), staticLabels),
+		peerLastHandshake:   prometheus.NewDesc(prefixWrapper("peer_last_handshake_timestamp_seconds"), "time of the last session the peer established, including rekeying, as seen in the log", peerLabels, staticLabels),
+		metadataKeys:        metadataKeys,
+		peerMetadataInfo:    prometheus.NewDesc(prefixWrapper("peer_metadata_info"), "metadata from the comments in the peer file", append(append([]string{}, dynamicLabels...), metadataKeys...), staticLabels),
+		peerMethod:          prometheus.NewDesc(prefixWrapper("peer_method"), "state set of the method of the session, 1 for the method in use and 0 for the other known methods", append(peerLabels, "method"), staticLabels),
+		peerMethodDetail:    prometheus.NewDesc(prefixWrapper("peer_method_detail_info"), "components of the method of the session, the cipher, the message authentication and the offload", append(append([]string{}, dynamicLabels...), "cipher", "mac", "offload"), staticLabels),
+		peerFloating:        prometheus.NewDesc(prefixWrapper("peer_floating"), "whether the peer is configured with float yes and may connect from any address", peerLabels, staticLabels),
+		peerGroupPeersUp:    prometheus.NewDesc(prefixWrapper("peer_group_peers_up"), "number of connected peers of the peer group, including its nested groups", []string{"group"}, staticLabels),
+		peerGroupPeerLimit:  prometheus.NewDesc(prefixWrapper("peer_group_peer_limit"), "peer limit of the peer group", []string{"group"}, staticLabels),
+		configValidDesc:     prometheus.NewDesc(prefixWrapper("config_valid"), "whether the fastd config of the instance and its peers were read without problems the last time", nil, staticLabels),
+		secretKeyValid:      prometheus.NewDesc(prefixWrapper("secret_key_valid"), "whether the fastd config declares a valid secret key", nil, staticLabels),
+		secretKeySecure:     prometheus.NewDesc(prefixWrapper("secret_key_file_secure"), "whether the file declaring the secret key is neither writable by its group nor accessible by other users", nil, staticLabels),
+		peerKeyFiles:        prometheus.NewDesc(prefixWrapper("peer_key_files"), "number of peer files in the peer directories by state", []string{"state"}, staticLabels),
+		configParseErrors:   prometheus.NewDesc(prefixWrapper("config_parse_errors_total"), "number of problems found while reading the fastd config of the instance and its peers", []string{"reason"}, staticLabels),
+
+		peerRxPackets:          prometheus.NewDesc(prefixWrapper("peer_rx_packets"), "peer rx packets count", peerLabels, staticLabels),
+		peerRxBytes:            prometheus.NewDesc(prefixWrapper("peer_rx_bytes"), "peer rx bytes count", peerLabels, staticLabels),
+		peerRxReorderedPackets: prometheus.NewDesc(prefixWrapper("peer_rx_reordered_packets"), "peer rx reordered packets count", peerLabels, staticLabels),
+		peerRxReorderedBytes:   prometheus.NewDesc(prefixWrapper("peer_rx_reordered_bytes"), "peer rx reordered bytes count", peerLabels, staticLabels),
+
+		peerTxPackets:        prometheus.NewDesc(prefixWrapper("peer_tx_packets"), "peer rx packet count", peerLabels, staticLabels),
+		peerTxBytes:          prometheus.NewDesc(prefixWrapper("peer_tx_bytes"), "peer rx bytes count", peerLabels, staticLabels),
+		peerTxDroppedPackets: prometheus.NewDesc(prefixWrapper("peer_tx_dropped_packets"), "peer tx dropped packets count", peerLabels, staticLabels),
+		peerTxDroppedBytes:   prometheus.NewDesc(prefixWrapper("peer_tx_dropped_bytes"), "peer tx dropped bytes count", peerLabels, staticLabels),
+		peerTxErrorPackets:   prometheus.NewDesc(prefixWrapper("peer_tx_error_packets"), "peer tx error packets count", peerLabels, staticLabels),
+		peerTxErrorBytes:     prometheus.NewDesc(prefixWrapper("peer_tx_error_bytes"), "peer tx error bytes count", peerLabels, staticLabels),
 	}
 }
 
-func (exporter PrometheusExporter) Describe(channel chan<- *prometheus.Desc) {
+func (exporter *PrometheusExporter) Describe(channel chan<- *prometheus.Desc) {
 	channel <- exporter.up
 	channel <- exporter.uptime
+	channel <- exporter.socketAccessible
+	channel <- exporter.socketFileAge
+	channel <- exporter.socketFileIsSocket
+	channel <- exporter.interfaceBridged
+	channel <- exporter.statusVersion
+	channel <- exporter.versionInfo
+	channel <- exporter.handshakeAttempts
+	channel <- exporter.handshakeStorm
+	channel <- exporter.instanceInfo
+	channel <- exporter.instancePaused
+	channel <- exporter.maintenance
+
+	channel <- exporter.configuredMTUBytes
+	channel <- exporter.interfaceMTUBytes
+	channel <- exporter.interfaceMTUMismatch
 
 	channel <- exporter.rxPackets
 	channel <- exporter.rxBytes
@@ -179,12 +738,69 @@ func (exporter PrometheusExporter) Describe(channel chan<- *prometheus.Desc) {
 	channel <- exporter.txBytes
 	channel <- exporter.txDroppedPackets
 	channel <- exporter.txDroppedBytes
+	channel <- exporter.txErrorPackets
+	channel <- exporter.txErrorBytes
 
 	channel <- exporter.peersUpTotal
+	channel <- exporter.peersUpPeak
+	channel <- exporter.peersUpPeakWindow
+	channel <- exporter.peersByFamily
+	channel <- exporter.peersNAT64
+	channel <- exporter.peersBySessionAge
+	channel <- exporter.peersStalledTotal
+	channel <- exporter.peersByCountry
+	channel <- exporter.peersByFirmware
+	channel <- exporter.peersByPrefix
+	channel <- exporter.peersTracked
+	channel <- exporter.peersSampled
+	channel <- exporter.criticalPeerUp
+	channel <- exporter.peersBySite
+	channel <- exporter.peerASNsDistinct
+
+	channel <- exporter.trafficByMethodPackets
+	channel <- exporter.trafficByMethodBytes
+	channel <- exporter.trafficBySitePackets
+	channel <- exporter.trafficBySiteBytes
 
 	channel <- exporter.peerUp
 	channel <- exporter.peerUptime
 	channel <- exporter.peerInfo
+	channel <- exporter.peerInterfaceInfo
+	channel <- exporter.peerStalled
+	channel <- exporter.peerFloating
+	channel <- exporter.peerGroupPeersUp
+	channel <- exporter.peerGroupPeerLimit
+	channel <- exporter.configValidDesc
+	channel <- exporter.configParseErrors
+	channel <- exporter.secretKeyValid
+	channel <- exporter.secretKeySecure
+	channel <- exporter.peerKeyFiles
+	channel <- exporter.peerMethod
+	channel <- exporter.peerMethodDetail
+	channel <- exporter.peerMetadataInfo
+	channel <- exporter.peerRemoteResolved
+	channel <- exporter.peerRemoteAddresses
+	channel <- exporter.peerThroughputMin
+	channel <- exporter.peerThroughputMax
+	channel <- exporter.unknownPeerAttempts
+	channel <- exporter.peerRegistryInfo
+	for _, desc := range exporter.enricherInfo {
+		channel <- desc
+	}
+	channel <- exporter.peerTagInfo
+	channel <- exporter.peerLastHandshake
+	channel <- exporter.frozen
+	channel <- exporter.txDroppedRatio
+	channel <- exporter.txErrorRatio
+	channel <- exporter.peersTrendPerHour
+	channel <- exporter.anomaliesTotal
+	channel <- exporter.sanitizedNamesTotal
+	channel <- exporter.addressChangesByASN
+	channel <- exporter.averagePacketSize
+	channel <- exporter.peerAveragePacketSize
+	newHistogram(exporter.peersSessionDuration).Describe(channel)
+	newHistogram(exporter.peersThroughput).Describe(channel)
+	exporter.completedSessions.Describe(channel)
 
 	channel <- exporter.peerRxPackets
 	channel <- exporter.peerRxBytes
@@ -199,201 +815,1632 @@ func (exporter PrometheusExporter) Describe(channel chan<- *prometheus.Desc) {
 	channel <- exporter.peerTxErrorBytes
 }
 
-func (exporter PrometheusExporter) Collect(channel chan<- prometheus.Metric) {
-	data, err := readFromStatusSocket(exporter.statusSocketPath)
+// status returns the current status of the fastd instance. Consecutive calls
+// within --scrape.min-interval are answered from the previous snapshot.
+// The time of the status read is returned along with the status.
+func (exporter *PrometheusExporter) status(ctx context.Context) (Message, time.Time, error) {
+	exporter.mutex.Lock()
+	defer exporter.mutex.Unlock()
+
+	if *scrapeMinInterval > 0 && time.Since(exporter.lastRead) < *scrapeMinInterval {
+		trace.SpanFromContext(ctx).AddEvent("served cached status")
+		return exporter.lastMessage, exporter.lastRead, exporter.lastError
+	}
+	if exporter.streaming && time.Since(exporter.lastRead) < streamMaxAge {
+		trace.SpanFromContext(ctx).AddEvent("served streamed status")
+		return exporter.lastMessage, exporter.lastRead, exporter.lastError
+	}
+
+	exporter.lastMessage, exporter.lastError = readStatus(ctx, exporter.statusSocketPath, exporter.settings)
+	exporter.lastRead = time.Now()
+	if exporter.lastError == nil {
+		exporter.ready = true
+		exporter.journal.record(exporter.lastMessage, exporter.lastRead)
+	}
+
+	return exporter.lastMessage, exporter.lastRead, exporter.lastError
+}
+
+// invalidate discards the cached status, so the next read goes to the
+// status socket.
+func (exporter *PrometheusExporter) invalidate() {
+	exporter.mutex.Lock()
+	defer exporter.mutex.Unlock()
+
+	exporter.lastRead = time.Time{}
+}
+
+// instanceKey identifies the instance in the responses of the exporter.
+// Instances received from agents are prefixed with their gateway, as every
+// gateway tends to run the same instances.
+func (exporter *PrometheusExporter) instanceKey() string {
+	if key, ok := agentSnapshotKey(exporter.statusSocketPath); ok {
+		return key
+	}
+	return exporter.instance
+}
+
+// isReady reports whether the instance was read successfully at least once
+// or is optional.
+func (exporter *PrometheusExporter) isReady() bool {
+	exporter.mutex.Lock()
+	defer exporter.mutex.Unlock()
+
+	return exporter.ready || exporter.optional
+}
+
+// startBackground starts following the instance between scrapes, as far
+// as enabled.
+func (exporter *PrometheusExporter) startBackground() {
+	if *statusSocketStreaming {
+		go exporter.runStatusStream()
+	}
+	if *fastdVersionBinary != "" {
+		go exporter.runVersionCheck()
+	}
+	if *handshakeLogEnable {
+		go exporter.runHandshakeLog()
+	}
+}
+
+func (exporter *PrometheusExporter) Collect(channel chan<- prometheus.Metric) {
+	exporter.collect(channel, true)
+}
+
+// collect sends the metrics of the instance, with peerMetrics the per peer
+// metrics as well. Without, the peers are only counted for the aggregates.
+func (exporter *PrometheusExporter) collect(channel chan<- prometheus.Metric, peerMetrics bool) {
+	ctx, span := tracer.Start(context.Background(), "Collect", trace.WithAttributes(attribute.String("fastd.instance", exporter.instance)))
+	defer span.End()
+
+	channel <- prometheus.MustNewConstMetric(exporter.instanceInfo, prometheus.GaugeValue, 1, exporterConfig.instanceDisplayName(exporter.instance))
+	channel <- prometheus.MustNewConstMetric(exporter.maintenance, prometheus.GaugeValue, boolToFloat64(exporter.inMaintenance(time.Now())))
+	paused := exporter.isPaused()
+	channel <- prometheus.MustNewConstMetric(exporter.instancePaused, prometheus.GaugeValue, boolToFloat64(paused))
+	if paused {
+		return
+	}
+
+	exporter.collectSocketFile(channel)
+	if *fastdVersionBinary != "" {
+		exporter.collectVersion(channel)
+	}
+
+	data, readTime, err := exporter.status(ctx)
 	if err != nil {
-		log.Print(err)
+		logRepeated("%v", err)
+		span.SetStatus(codes.Error, err.Error())
+
+		reason := socketErrorReason(err)
+		if reason == "permission_denied" {
+			logSocketPermissions(exporter.statusSocketPath)
+		}
+
 		channel <- prometheus.MustNewConstMetric(exporter.up, prometheus.GaugeValue, 0)
-	} else {
-		channel <- prometheus.MustNewConstMetric(exporter.up, prometheus.GaugeValue, 1)
+		channel <- prometheus.MustNewConstMetric(exporter.socketAccessible, prometheus.GaugeValue, boolToFloat64(reason == ""), reason)
+		return
 	}
 
-	channel <- prometheus.MustNewConstMetric(exporter.uptime, prometheus.GaugeValue, data.Uptime/1000)
+	channel <- prometheus.MustNewConstMetric(exporter.up, prometheus.GaugeValue, 1)
+	channel <- prometheus.MustNewConstMetric(exporter.socketAccessible, prometheus.GaugeValue, 1, "")
 
-	channel <- prometheus.MustNewConstMetric(exporter.rxPackets, prometheus.CounterValue, float64(data.Statistics.Rx.Count))
-	channel <- prometheus.MustNewConstMetric(exporter.rxBytes, prometheus.CounterValue, float64(data.Statistics.Rx.Bytes))
-	channel <- prometheus.MustNewConstMetric(exporter.rxReorderedPackets, prometheus.CounterValue, float64(data.Statistics.RxReordered.Count))
-	channel <- prometheus.MustNewConstMetric(exporter.rxReorderedBytes, prometheus.CounterValue, float64(data.Statistics.RxReordered.Bytes))
+	channel <- prometheus.MustNewConstMetric(exporter.statusVersion, prometheus.GaugeValue, 1, statusVersion(data))
 
-	channel <- prometheus.MustNewConstMetric(exporter.txPackets, prometheus.CounterValue, float64(data.Statistics.Tx.Count))
-	channel <- prometheus.MustNewConstMetric(exporter.txBytes, prometheus.CounterValue, float64(data.Statistics.Tx.Bytes))
-	channel <- prometheus.MustNewConstMetric(exporter.txDroppedPackets, prometheus.CounterValue, float64(data.Statistics.Tx.Count))
-	channel <- prometheus.MustNewConstMetric(exporter.txDroppedBytes, prometheus.CounterValue, float64(data.Statistics.TxDropped.Bytes))
+	collectPacketStatistics(channel, exporter.rxPackets, exporter.rxBytes, &data.Statistics.Rx)
+	collectPacketStatistics(channel, exporter.rxReorderedPackets, exporter.rxReorderedBytes, data.Statistics.RxReordered)
+
+	collectPacketStatistics(channel, exporter.txPackets, exporter.txBytes, &data.Statistics.Tx)
+	collectPacketStatistics(channel, exporter.txDroppedPackets, exporter.txDroppedBytes, data.Statistics.TxDropped)
+	collectPacketStatistics(channel, exporter.txErrorPackets, exporter.txErrorBytes, data.Statistics.TxError)
 
 	peersUpTotal := 0
+	peersByFamily := map[string]int{"IPv4": 0, "IPv6": 0}
+	peersNAT64 := 0
+	peersBySessionAge := map[string]int{}
+	for _, bucket := range sessionAgeBuckets {
+		peersBySessionAge[bucket.label] = 0
+	}
+	trafficByMethod := map[string]*Statistics{}
+	peersByCountry := map[string]int{}
+	peersByFirmware := map[string]int{}
+	peersByPrefix := map[netip.Prefix]int{}
+	peersBySite := map[string]int{}
+	trafficBySite := map[string]*Statistics{}
+
+	var peerASNs map[netip.Addr]string
+	if exporter.settings.asnLookup {
+		var addrs []netip.Addr
+		for publicKey, peer := range data.Peers {
+			if peer.Connection != nil && exporter.settings.enriched(publicKey, peer.Name) {
+				addrs = append(addrs, parsePeerAddress(peer.Address))
+			}
+		}
+		peerASNs = lookupASNs(ctx, addrs)
+
+		distinct := map[string]bool{}
+		for _, asn := range peerASNs {
+			if asn != "" && asn != asnUnknown {
+				distinct[asn] = true
+			}
+		}
+		channel <- prometheus.MustNewConstMetric(exporter.peerASNsDistinct, prometheus.GaugeValue, float64(len(distinct)))
+	}
+
+	exporter.peersMutex.Lock()
+	defer exporter.peersMutex.Unlock()
+
+	// cached snapshots must not advance state that counts status reads
+	freshRead := readTime.After(exporter.peersUpdated)
+	exporter.peersUpdated = readTime
+	uptimeValid := plausibleDuration(data.Uptime)
+	if !uptimeValid && freshRead {
+		exporter.anomalies[anomalyUptimeInvalid] += 1
+	}
+	// a restart resets the counters along with the uptime
+	if uptimeValid && data.Uptime < exporter.lastUptime && data.Statistics.Rx.Count >= exporter.packetSizes.rx.Count {
+		uptimeValid = false
+		if freshRead {
+			exporter.anomalies[anomalyUptimeBackwards] += 1
+		}
+	}
+	if uptimeValid {
+		channel <- prometheus.MustNewConstMetric(exporter.uptime, prometheus.GaugeValue, data.Uptime/1000)
+	}
+
+	if freshRead {
+		exporter.packetSizes.update(data.Statistics.Rx, data.Statistics.Tx)
+
+		if data.Uptime <= exporter.lastUptime {
+			exporter.unchangedUptimes += 1
+		} else {
+			exporter.unchangedUptimes = 0
+		}
+		exporter.lastUptime = data.Uptime
+	}
+	if exporter.settings.frozenPolls > 0 {
+		channel <- prometheus.MustNewConstMetric(exporter.frozen, prometheus.GaugeValue, boolToFloat64(exporter.unchangedUptimes >= exporter.settings.frozenPolls))
+	}
+	collectPacketSizes(channel, exporter.averagePacketSize, exporter.packetSizes)
+	peersStalledTotal := 0
+	peersSampled := 0
+
+	sessionDurations := newHistogram(exporter.peersSessionDuration)
+	throughputs := newHistogram(exporter.peersThroughput)
+
+	for publicKey, state := range exporter.peers {
+		if _, ok := data.Peers[publicKey]; !ok {
+			// peers fastd forgot about, like dynamic peers, ended their session too
+			if freshRead && state.connected && state.established > 0 {
+				exporter.completedSessions.Observe(state.established)
+			}
+			delete(exporter.peers, publicKey)
+		}
+	}
 
-	anonymize := ipanonymizer.NewWithMask(
-		net.CIDRMask(24, 32),
-		net.CIDRMask(48, 128),
-	)
+	tunnels := &tunnelInterfaceLookup{}
+	// interfaces of the instance and its connected peers, to check whether
+	// they are bridged
+	interfaces := map[string]bool{}
+	if data.Interface != "" {
+		interfaces[data.Interface] = true
+	}
+	var peerConfigs map[string]peerConfig
+	var methods []string
+	if !*lite {
+		peerConfigs = exporter.peerConfigs()
+		methods = exporter.knownMethods(data)
+	}
 
 	for publicKey, peer := range data.Peers {
-		peerName := peer.Name
-		interfaceName := data.Interface
+		state, ok := exporter.peers[publicKey]
+		if !ok {
+			state = &peerState{}
+			exporter.peers[publicKey] = state
+		}
+
+		peerName := exporter.peerName(peer, state)
+		interfaceName := exporter.peerInterface(data, peer, state, tunnels)
+		if peer.Connection != nil && state.interfaceName != "" {
+			interfaces[state.interfaceName] = true
+		}
 		method := ""
-		ipAddrFamily := "IPv6"
+		peerLabels := []string{publicKey, peerName, interfaceName}
+		if *peerLabelsMinimal {
+			peerLabels = []string{publicKey}
+		}
+		if exporterConfig.criticalPeer(publicKey, peer.Name) {
+			channel <- prometheus.MustNewConstMetric(exporter.criticalPeerUp, prometheus.GaugeValue, boolToFloat64(peer.Connection != nil), peerLabels...)
+		}
+		// peers outside of the sample still count for the aggregates
+		sampled := peerSampled(publicKey)
+		if sampled {
+			peersSampled += 1
+		}
+		perPeer := sampled && peerMetrics
+
+		if perPeer && data.Interface == "" && state.interfaceName != "" && !*lite {
+			channel <- prometheus.MustNewConstMetric(exporter.peerInterfaceInfo, prometheus.GaugeValue, 1, publicKey, peerName, interfaceName)
+		}
+		if config, ok := peerConfigs[publicKey]; ok && perPeer {
+			channel <- prometheus.MustNewConstMetric(exporter.peerFloating, prometheus.GaugeValue, boolToFloat64(config.floating), peerLabels...)
+
+			if len(exporter.metadataKeys) != 0 {
+				labelValues := []string{publicKey, peerName, interfaceName}
+				for _, key := range exporter.metadataKeys {
+					labelValues = append(labelValues, config.metadata[key])
+				}
+				channel <- prometheus.MustNewConstMetric(exporter.peerMetadataInfo, prometheus.GaugeValue, 1, labelValues...)
+			}
+		}
+
+		if *peerAPIURL != "" && perPeer {
+			if fields, ok := registryFields(publicKey); ok {
+				labelValues := []string{publicKey, peerName, interfaceName}
+				for _, field := range registryFieldList {
+					labelValues = append(labelValues, fields[field])
+				}
+				channel <- prometheus.MustNewConstMetric(exporter.peerRegistryInfo, prometheus.GaugeValue, 1, labelValues...)
+			}
+		}
+		if len(exporter.enricherInfo) != 0 && perPeer && exporter.settings.enriched(publicKey, peer.Name) {
+			exporter.collectEnrichers(channel, publicKey, peer, peerName, interfaceName)
+		}
+		if *consulAddress != "" && *consulKVPrefix != "" && perPeer {
+			exporter.collectConsulTags(channel, publicKey, peerName, interfaceName)
+		}
 
-		if interfaceName == "" {
-			interfaceName = peer.Interface
+		if freshRead {
+			if peer.Connection == nil && state.connected && state.established > 0 {
+				exporter.completedSessions.Observe(state.established)
+				state.established = 0
+			}
+			state.updateSession(peer.Connection != nil, readTime)
 		}
 
 		if peer.Connection == nil {
-			channel <- prometheus.MustNewConstMetric(exporter.peerUp, prometheus.GaugeValue, float64(0), publicKey, peerName, interfaceName)
+			if perPeer {
+				channel <- prometheus.MustNewConstMetric(exporter.peerUp, prometheus.GaugeValue, float64(0), peerLabels...)
+			}
+			state.unchangedPolls = 0
+			state.bytesRead = time.Time{}
+			state.throughputKnown = false
+			state.packetSizes = packetSizes{}
 		} else {
 			peersUpTotal += 1
 
 			method = peer.Connection.Method
 
-			peerIp, _, _ := net.SplitHostPort(peer.Address)
-			if strings.Contains(peerIp, ".") {
-				ipAddrFamily = "IPv4"
+			peerAddr, nat64 := normalizePeerAddress(peer.Address)
+			ipAddrFamily := addressFamily(peerAddr)
+			peersByFamily[ipAddrFamily] += 1
+			if nat64 {
+				peersNAT64 += 1
+			}
+			enriched := exporter.settings.enriched(publicKey, peer.Name)
+			if exporter.settings.geoip {
+				// peers that are not enriched still count, so the sum
+				// matches the connected peers
+				country := "unknown"
+				if enriched {
+					country = lookupCountry(peerAddr)
+				}
+				peersByCountry[country] += 1
+			}
+			if *nodesJSONURL != "" && enriched {
+				peersByFirmware[peerRelease(publicKey, peer)] += 1
+			}
+			if prefix, ok := peerPrefix(peerAddr); ok && exporter.settings.peersByPrefixThreshold > 0 {
+				peersByPrefix[prefix] += 1
+			}
+
+			if len(exporterConfig.Sites) != 0 {
+				site := peerSite(publicKey, peerAddr)
+				siteTraffic, ok := trafficBySite[site]
+				if !ok {
+					siteTraffic = &Statistics{}
+					trafficBySite[site] = siteTraffic
+				}
+				siteTraffic.Rx.add(peer.Connection.Statistics.Rx)
+				siteTraffic.Tx.add(peer.Connection.Statistics.Tx)
+				peersBySite[site] += 1
+			}
+
+			traffic, ok := trafficByMethod[method]
+			if !ok {
+				traffic = &Statistics{}
+				trafficByMethod[method] = traffic
 			}
+			traffic.Rx.add(peer.Connection.Statistics.Rx)
+			traffic.Tx.add(peer.Connection.Statistics.Tx)
 
 			peerAsn := ""
+			if enriched {
+				peerAsn = peerASNs[peerAddr]
+			}
+			if freshRead && exporter.settings.asnLookup && enriched {
+				// sessions ending and coming back from another address are
+				// counted too, that is how CGN mostly shows up
+				if state.address.IsValid() && state.address != peerAddr {
+					exporter.addressChanges[peerAsn] += 1
+				}
+				state.address = peerAddr
+			}
 
-			if *ipAsnLookupEnable {
-				anonIP, err := anonymize.IPString(peerIp)
-				if err == nil {
-					peerIp = anonIP
+			if perPeer {
+				channel <- prometheus.MustNewConstMetric(exporter.peerUp, prometheus.GaugeValue, float64(1), peerLabels...)
+			}
+			establishedValid := plausibleDuration(peer.Connection.Established) && (!uptimeValid || peer.Connection.Established <= data.Uptime+establishedSlack)
+			if establishedValid {
+				if perPeer {
+					channel <- prometheus.MustNewConstMetric(exporter.peerUptime, prometheus.GaugeValue, peer.Connection.Established/1000, peerLabels...)
 				}
+				state.established = peer.Connection.Established / 1000
+				peersBySessionAge[sessionAgeBucket(state.established)] += 1
+			} else if freshRead {
+				exporter.anomalies[anomalyEstablishedInvalid] += 1
+			}
 
-				ctx, cancel := context.WithTimeout(context.Background(), time.Duration(*ipAsnLookupTimeout)*time.Millisecond)
-				defer cancel()
+			statistics := &peer.Connection.Statistics
 
-				asnlookup, err := ipisp.LookupIP(ctx, net.ParseIP(peerIp))
-				if err != nil {
-					log.Print(err)
-				} else {
-					peerAsn = strconv.Itoa(int(asnlookup.ASN))
+			if perPeer {
+				collectPacketStatistics(channel, exporter.peerRxPackets, exporter.peerRxBytes, &statistics.Rx, peerLabels...)
+				collectPacketStatistics(channel, exporter.peerTxPackets, exporter.peerTxBytes, &statistics.Tx, peerLabels...)
+			}
+			if *lite {
+				continue
+			}
+
+			if perPeer {
+				channel <- prometheus.MustNewConstMetric(exporter.peerInfo, prometheus.GaugeValue, float64(1), publicKey, peerName, interfaceName, method, peerAsn, ipAddrFamily)
+				for _, knownMethod := range methods {
+					channel <- prometheus.MustNewConstMetric(exporter.peerMethod, prometheus.GaugeValue, boolToFloat64(knownMethod == method), append(peerLabels, knownMethod)...)
 				}
+				cipher, mac, offload := methodComponents(method)
+				channel <- prometheus.MustNewConstMetric(exporter.peerMethodDetail, prometheus.GaugeValue, 1, publicKey, peerName, interfaceName, cipher, mac, offload)
 			}
 
-			channel <- prometheus.MustNewConstMetric(exporter.peerUp, prometheus.GaugeValue, float64(1), publicKey, peerName, interfaceName)
-			channel <- prometheus.MustNewConstMetric(exporter.peerUptime, prometheus.GaugeValue, peer.Connection.Established/1000, publicKey, peerName, interfaceName)
+			if freshRead {
+				if statistics.Rx.Bytes == state.rxBytes {
+					state.unchangedPolls += 1
+				} else {
+					state.unchangedPolls = 0
+				}
+				state.rxBytes = statistics.Rx.Bytes
 
-			channel <- prometheus.MustNewConstMetric(exporter.peerInfo, prometheus.GaugeValue, float64(1), publicKey, peerName, interfaceName, method, peerAsn, ipAddrFamily)
+				bytes := statistics.Rx.Bytes + statistics.Tx.Bytes
+				// counters going backwards mean the session was re-established
+				state.throughputKnown = !state.bytesRead.IsZero() && bytes >= state.bytes
+				if state.throughputKnown {
+					state.throughput = float64(bytes-state.bytes) / readTime.Sub(state.bytesRead).Seconds()
+				}
+				state.bytes = bytes
+				state.bytesRead = readTime
 
-			channel <- prometheus.MustNewConstMetric(exporter.peerRxPackets, prometheus.CounterValue, float64(peer.Connection.Statistics.Rx.Count), publicKey, peerName, interfaceName)
-			channel <- prometheus.MustNewConstMetric(exporter.peerRxBytes, prometheus.CounterValue, float64(peer.Connection.Statistics.Rx.Bytes), publicKey, peerName, interfaceName)
-			channel <- prometheus.MustNewConstMetric(exporter.peerRxReorderedPackets, prometheus.CounterValue, float64(peer.Connection.Statistics.RxReordered.Count), publicKey, peerName, interfaceName)
-			channel <- prometheus.MustNewConstMetric(exporter.peerRxReorderedBytes, prometheus.CounterValue, float64(peer.Connection.Statistics.RxReordered.Bytes), publicKey, peerName, interfaceName)
+				state.packetSizes.update(statistics.Rx, statistics.Tx)
+			}
+			if exporter.settings.packetSizePerPeer && perPeer {
+				collectPacketSizes(channel, exporter.peerAveragePacketSize, state.packetSizes, peerLabels...)
+			}
+			if establishedValid {
+				sessionDurations.Observe(peer.Connection.Established / 1000)
+			}
+			if state.throughputKnown {
+				throughputs.Observe(state.throughput)
+			}
+			if *pollInterval > 0 && perPeer {
+				exporter.collectThroughputWindow(channel, publicKey, peerLabels)
+			}
+			if *handshakeLogEnable && perPeer {
+				// the log has the name as fastd reports it, not sanitized
+				exporter.collectLastHandshake(channel, publicKey, peer.Name, peerLabels)
+			}
+			if exporter.settings.stalledPolls > 0 {
+				stalled := state.unchangedPolls >= exporter.settings.stalledPolls
+				if stalled {
+					peersStalledTotal += 1
+				}
+				if perPeer {
+					channel <- prometheus.MustNewConstMetric(exporter.peerStalled, prometheus.GaugeValue, boolToFloat64(stalled), peerLabels...)
+				}
+			}
 
-			channel <- prometheus.MustNewConstMetric(exporter.peerTxPackets, prometheus.CounterValue, float64(peer.Connection.Statistics.Tx.Count), publicKey, peerName, interfaceName)
-			channel <- prometheus.MustNewConstMetric(exporter.peerTxBytes, prometheus.CounterValue, float64(peer.Connection.Statistics.Tx.Bytes), publicKey, peerName, interfaceName)
-			channel <- prometheus.MustNewConstMetric(exporter.peerTxDroppedPackets, prometheus.CounterValue, float64(peer.Connection.Statistics.TxDropped.Count), publicKey, peerName, interfaceName)
-			channel <- prometheus.MustNewConstMetric(exporter.peerTxDroppedBytes, prometheus.CounterValue, float64(peer.Connection.Statistics.TxDropped.Bytes), publicKey, peerName, interfaceName)
-			channel <- prometheus.MustNewConstMetric(exporter.peerTxErrorPackets, prometheus.CounterValue, float64(peer.Connection.Statistics.TxError.Count), publicKey, peerName, interfaceName)
-			channel <- prometheus.MustNewConstMetric(exporter.peerTxErrorBytes, prometheus.CounterValue, float64(peer.Connection.Statistics.TxError.Bytes), publicKey, peerName, interfaceName)
+			if perPeer {
+				collectPacketStatistics(channel, exporter.peerRxReorderedPackets, exporter.peerRxReorderedBytes, statistics.RxReordered, peerLabels...)
+				collectPacketStatistics(channel, exporter.peerTxDroppedPackets, exporter.peerTxDroppedBytes, statistics.TxDropped, peerLabels...)
+				collectPacketStatistics(channel, exporter.peerTxErrorPackets, exporter.peerTxErrorBytes, statistics.TxError, peerLabels...)
+			}
 		}
 	}
 
 	channel <- prometheus.MustNewConstMetric(exporter.peersUpTotal, prometheus.GaugeValue, float64(peersUpTotal))
-}
-
-func readFromStatusSocket(sock string) (Message, error) {
-	conn, err := net.DialTimeout("unix", sock, 2*time.Second)
-	if err != nil {
-		return Message{}, err
+	for _, publicKey := range exporterConfig.missingCriticalPeers(data) {
+		labelValues := []string{publicKey, "", ""}
+		if *peerLabelsMinimal {
+			labelValues = labelValues[:1]
+		}
+		channel <- prometheus.MustNewConstMetric(exporter.criticalPeerUp, prometheus.GaugeValue, 0, labelValues...)
+	}
+	if *peerSamplingModulus > 1 {
+		channel <- prometheus.MustNewConstMetric(exporter.peersSampled, prometheus.GaugeValue, float64(peersSampled))
+	}
+	if freshRead {
+		exporter.recordPeersUp(peersUpTotal, readTime)
+		exporter.recordTxSample(data.Statistics, readTime)
+		exporter.recordPeersTrend(peersUpTotal, readTime)
+	}
+	exporter.peakMutex.Lock()
+	channel <- prometheus.MustNewConstMetric(exporter.peersUpPeak, prometheus.GaugeValue, float64(exporter.peak.total))
+	channel <- prometheus.MustNewConstMetric(exporter.peersUpPeakWindow, prometheus.GaugeValue, float64(exporter.peak.windowPeak()))
+	exporter.peakMutex.Unlock()
+	channel <- prometheus.MustNewConstMetric(exporter.peersTracked, prometheus.GaugeValue, float64(len(exporter.peers)))
+	if exporter.settings.stalledPolls > 0 {
+		channel <- prometheus.MustNewConstMetric(exporter.peersStalledTotal, prometheus.GaugeValue, float64(peersStalledTotal))
+	}
+	channel <- prometheus.MustNewConstMetric(exporter.peersNAT64, prometheus.GaugeValue, float64(peersNAT64))
+	for bucket, count := range peersBySessionAge {
+		channel <- prometheus.MustNewConstMetric(exporter.peersBySessionAge, prometheus.GaugeValue, float64(count), bucket)
+	}
+	for family, count := range peersByFamily {
+		channel <- prometheus.MustNewConstMetric(exporter.peersByFamily, prometheus.GaugeValue, float64(count), family)
+	}
+	for country, count := range peersByCountry {
+		channel <- prometheus.MustNewConstMetric(exporter.peersByCountry, prometheus.GaugeValue, float64(count), country)
+	}
+	for release, count := range peersByFirmware {
+		channel <- prometheus.MustNewConstMetric(exporter.peersByFirmware, prometheus.GaugeValue, float64(count), release)
+	}
+	for prefix, count := range peersByPrefix {
+		if count >= exporter.settings.peersByPrefixThreshold {
+			channel <- prometheus.MustNewConstMetric(exporter.peersByPrefix, prometheus.GaugeValue, float64(count), prefix.String())
+		}
+	}
+	for site, count := range peersBySite {
+		channel <- prometheus.MustNewConstMetric(exporter.peersBySite, prometheus.GaugeValue, float64(count), site)
+	}
+	for site, traffic := range trafficBySite {
+		channel <- prometheus.MustNewConstMetric(exporter.trafficBySitePackets, prometheus.GaugeValue, float64(traffic.Rx.Count), site, "rx")
+		channel <- prometheus.MustNewConstMetric(exporter.trafficBySiteBytes, prometheus.GaugeValue, float64(traffic.Rx.Bytes), site, "rx")
+		channel <- prometheus.MustNewConstMetric(exporter.trafficBySitePackets, prometheus.GaugeValue, float64(traffic.Tx.Count), site, "tx")
+		channel <- prometheus.MustNewConstMetric(exporter.trafficBySiteBytes, prometheus.GaugeValue, float64(traffic.Tx.Bytes), site, "tx")
+	}
+	for method, traffic := range trafficByMethod {
+		channel <- prometheus.MustNewConstMetric(exporter.trafficByMethodPackets, prometheus.GaugeValue, float64(traffic.Rx.Count), method, "rx")
+		channel <- prometheus.MustNewConstMetric(exporter.trafficByMethodBytes, prometheus.GaugeValue, float64(traffic.Rx.Bytes), method, "rx")
+		channel <- prometheus.MustNewConstMetric(exporter.trafficByMethodPackets, prometheus.GaugeValue, float64(traffic.Tx.Count), method, "tx")
+		channel <- prometheus.MustNewConstMetric(exporter.trafficByMethodBytes, prometheus.GaugeValue, float64(traffic.Tx.Bytes), method, "tx")
 	}
-	defer func(conn net.Conn) {
-		_ = conn.Close()
-	}(conn)
 
-	decoder := json.NewDecoder(conn)
-	msg := Message{}
-	err = decoder.Decode(&msg)
-	if err != nil {
-		return Message{}, err
+	for kind, count := range exporter.anomalies {
+		channel <- prometheus.MustNewConstMetric(exporter.anomaliesTotal, prometheus.CounterValue, float64(count), kind)
+	}
+	channel <- prometheus.MustNewConstMetric(exporter.sanitizedNamesTotal, prometheus.CounterValue, float64(exporter.sanitizedNames))
+	if exporter.settings.asnLookup {
+		for asn, count := range exporter.addressChanges {
+			channel <- prometheus.MustNewConstMetric(exporter.addressChangesByASN, prometheus.CounterValue, float64(count), asn)
+		}
 	}
+	sessionDurations.Collect(channel)
+	exporter.completedSessions.Collect(channel)
+	throughputs.Collect(channel)
 
-	return msg, nil
+	exporter.collectMTU(channel, data)
+	if exporter.settings.bridge != "" {
+		exporter.collectBridges(channel, interfaces)
+	}
+	if *txRatiosWindow > 0 {
+		exporter.collectTxRatios(channel)
+	}
+	if *peersTrendWindow > 0 {
+		exporter.collectPeersTrend(channel)
+	}
+	if !*lite {
+		exporter.collectPeerGroups(channel, data, peerConfigs)
+		exporter.collectConfigErrors(channel)
+		exporter.collectKeyFiles(channel)
+	}
+	exporter.collectRemoteChecks(channel)
+	if *verifyHookEnable {
+		exporter.collectUnknownPeers(channel)
+	}
+	if *handshakeStormRatio > 0 && (*handshakeLogEnable || *verifyHookEnable) {
+		exporter.collectHandshakeStorm(channel, peersUpTotal)
+	}
 }
 
-type fastdConfig struct {
-	statusSocketPath string
+// newHistogram creates a histogram for a single collection, with native
+// and classic buckets as configured.
+func newHistogram(opts prometheus.HistogramOpts) prometheus.Histogram {
+	opts.NativeHistogramBucketFactor = *histogramsNativeFactor
+	if !*histogramsClassic {
+		opts.Buckets = nil
+	}
+	return prometheus.NewHistogram(opts)
 }
 
-func parseConfig(instance string) (fastdConfig, error) {
-	/*
-	 * Parses a fastd configuration and extracts the status socket, where the exporter
-	 * will pull metrics from.
-	 *
-	 * Returns statusSocketPath, err
-	 * Errors when the configuration could not be read, no status socket is defined or the status socket does not exist
-	 */
-	data, err := ioutil.ReadFile(fmt.Sprintf(*configPathPattern, instance))
-	if err != nil {
-		return fastdConfig{}, err
+// peerMetadataKeyList returns the keys of --peer-metadata.keys.
+func peerMetadataKeyList() []string {
+	var keys []string
+	for _, key := range strings.Split(*peerMetadataKeys, ",") {
+		if key = strings.TrimSpace(key); key != "" {
+			keys = append(keys, strings.ReplaceAll(strings.ToLower(key), "-", "_"))
+		}
 	}
+	return keys
+}
 
-	statusSocketPattern := regexp.MustCompile("status socket \"([^\"]+)\";")
-	match := statusSocketPattern.FindSubmatch(data)
-	if len(match) == 0 {
-		return fastdConfig{}, errors.New(fmt.Sprintf("Instance %s is missing 'status socket' declaration.", instance))
+// knownMethods returns the methods configured for the instance followed by
+// any other methods in use by its peers.
+func (exporter *PrometheusExporter) knownMethods(data Message) []string {
+	methods := append([]string{}, exporter.methods...)
+	for _, peer := range data.Peers {
+		if peer.Connection == nil {
+			continue
+		}
+
+		known := false
+		for _, method := range methods {
+			if method == peer.Connection.Method {
+				known = true
+				break
+			}
+		}
+		if !known {
+			methods = append(methods, peer.Connection.Method)
+		}
 	}
 
-	statusSocketPath := string(match[1])
-	return checkSocket(statusSocketPath)
+	return methods
 }
 
-func checkSocket(statusSocketPath string) (fastdConfig, error) {
-	if _, err := os.Stat(statusSocketPath); err == nil {
-		return fastdConfig{statusSocketPath}, nil
-	} else {
-		return fastdConfig{}, errors.New(fmt.Sprintf("Status socket at %s does not exist. Is the fastd instance up?.", statusSocketPath))
+// collectMTU compares the configured mtu with the live mtu of the instance
+// interface and all per peer interfaces. Must be called with peersMutex held.
+func (exporter *PrometheusExporter) collectMTU(channel chan<- prometheus.Metric, data Message) {
+	if exporter.configuredMTU == 0 {
+		return
 	}
-}
 
-func main() {
-	flag.Parse()
+	channel <- prometheus.MustNewConstMetric(exporter.configuredMTUBytes, prometheus.GaugeValue, float64(exporter.configuredMTU))
 
-	instances := flag.Args()
-	if len(instances) == 0 {
-		log.Fatal("No instances specified, aborting.")
+	interfaces := map[string]bool{}
+	if data.Interface != "" {
+		interfaces[data.Interface] = true
+	}
+	for _, state := range exporter.peers {
+		if state.interfaceName != "" {
+			interfaces[state.interfaceName] = true
+		}
 	}
 
-	instancePattern := regexp.MustCompile(`^([a-zA-Z0-9\._-]+)(=((/[a-zA-Z0-9\._-]+)+))?$`)
+	for interfaceName := range interfaces {
+		iface, err := net.InterfaceByName(interfaceName)
+		if err != nil {
+			// per peer interfaces vanish with their session
+			continue
+		}
 
-	for i := 0; i < len(instances); i++ {
-		instance := instancePattern.FindStringSubmatch(instances[i])
+		channel <- prometheus.MustNewConstMetric(exporter.interfaceMTUBytes, prometheus.GaugeValue, float64(iface.MTU), interfaceName)
+		channel <- prometheus.MustNewConstMetric(exporter.interfaceMTUMismatch, prometheus.GaugeValue, boolToFloat64(iface.MTU != exporter.configuredMTU), interfaceName)
+	}
+}
 
-		var config fastdConfig
-		var err error
+// readStatus reads the status socket and retries transient failures with
+// exponential backoff, e.g. while fastd recreates its socket during a reload.
+// All attempts share the --status-socket.timeout budget.
+func readStatus(ctx context.Context, sock string, settings instanceSettings) (Message, error) {
+	ctx, span := tracer.Start(ctx, "ReadStatus", trace.WithAttributes(attribute.String("fastd.status_socket", sock)))
+	defer span.End()
 
-		if instance == nil || len(instance) != 5 {
-			log.Fatalf("Invalid instance definition: %s", instances[i])
-		}
+	deadline := time.Now().Add(settings.socketTimeout)
+	if ctxDeadline, ok := ctx.Deadline(); ok && ctxDeadline.Before(deadline) {
+		deadline = ctxDeadline
+	}
+	backoff := *socketRetryBackoff
 
-		// check if there is an provided socket path
-		if instance[3] != "" {
-			// use provided socket path
-			config, err = checkSocket(instance[3])
+	for attempt := 1; ; attempt++ {
+		span.SetAttributes(attribute.Int("fastd.attempts", attempt))
+
+		var msg Message
+		var err error
+		if path, ok := statusFilePath(sock); ok {
+			msg, err = readFromStatusFile(path)
+		} else if key, ok := agentSnapshotKey(sock); ok {
+			msg, err = readAgentSnapshot(key)
 		} else {
-			// parse config to get socket path
-			config, err = parseConfig(instance[1])
+			msg, err = readFromStatusSocket(ctx, sock, settings, deadline)
 		}
-
 		if err != nil {
-			log.Fatal(err)
+			span.RecordError(err)
+		}
+		if err == nil || attempt >= settings.socketAttempts || socketErrorReason(err) == "permission_denied" || errors.Is(err, errStatusFileStale) {
+			return msg, err
+		}
+
+		if time.Now().Add(backoff).After(deadline) {
+			return msg, err
 		}
-		log.Printf("Reading fastd data for %v from %v", instance[1], config.statusSocketPath)
-		go prometheus.MustRegister(NewPrometheusExporter(instance[1], config.statusSocketPath))
+		time.Sleep(backoff)
+		backoff *= 2
 	}
+}
 
-	// Expose the registered metrics via HTTP.
-	http.Handle(*webMetricsPath, promhttp.Handler())
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		_, err := w.Write([]byte(`<html>
-				<head><title>fastd exporter</title></head>
-				<body>
-				<h1>fastd exporter</h1>
-				<p><a href="` + *webMetricsPath + `">Metrics</a></p>
-				</body>
-				</html>`))
-		if err != nil {
-			return
+// peerInterface returns the interface a peer's packets arrive on. In per peer
+// interface mode fastd only reports the interface while the peer is connected,
+// so the last known interface is kept to give disconnected peers consistent
+// labels. If fastd reports no interface at all, the kernel's l2tp tunnels are
+// searched for the peer's address. Peers without any interface are labeled
+// with --interface-label.placeholder.
+func (exporter *PrometheusExporter) peerInterface(data Message, peer Peer, state *peerState, tunnels *tunnelInterfaceLookup) string {
+	if peer.Interface != "" {
+		state.interfaceName = peer.Interface
+	} else if data.Interface != "" {
+		state.interfaceName = data.Interface
+	} else if exporter.settings.interfaceLookup && peer.Connection != nil {
+		if interfaceName := tunnels.lookup(peer.Address); interfaceName != "" {
+			state.interfaceName = interfaceName
 		}
-	})
+	}
 
-	log.Fatal(http.ListenAndServe(*webListenAddress, nil))
+	if state.interfaceName == "" {
+		// an empty label is the same as no label to Prometheus, which
+		// breaks joins on it
+		return *ifaceLabelPlaceholder
+	}
+	return state.interfaceName
+}
+
+// tunnelInterfaceLookup resolves peer addresses to l2tp tunnel interfaces.
+// The kernel's tunnels are only dumped once per collection and only if needed.
+type tunnelInterfaceLookup struct {
+	done       bool
+	interfaces map[string]string
+}
+
+func (lookup *tunnelInterfaceLookup) lookup(address string) string {
+	if !lookup.done {
+		lookup.done = true
+
+		var err error
+		lookup.interfaces, err = lookupTunnelInterfaces()
+		if err != nil {
+			log.Printf("Failed to look up l2tp tunnel interfaces: %v", err)
+		}
+	}
+
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return ""
+	}
+	// fastd and the kernel may format addresses differently
+	if ip := net.ParseIP(strings.SplitN(host, "%", 2)[0]); ip != nil {
+		host = ip.String()
+	}
+
+	return lookup.interfaces[net.JoinHostPort(host, port)]
+}
+
+// nat64Prefixes are the prefixes of --nat64.prefixes.
+var nat64Prefixes []netip.Prefix
+
+// parseNAT64Prefixes parses a comma separated list of NAT64 prefixes. The
+// prefix lengths are those RFC 6052 defines the address format for.
+func parseNAT64Prefixes(list string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, value := range strings.Split(list, ",") {
+		if value = strings.TrimSpace(value); value == "" {
+			continue
+		}
+		prefix, err := netip.ParsePrefix(value)
+		if err != nil {
+			return nil, err
+		}
+		switch prefix.Bits() {
+		case 32, 40, 48, 56, 64, 96:
+		default:
+			return nil, fmt.Errorf("NAT64 prefix %s is not of a length of 32, 40, 48, 56, 64 or 96 bits", value)
+		}
+		if !prefix.Addr().Is6() || prefix.Addr().Is4In6() {
+			return nil, fmt.Errorf("NAT64 prefix %s is not an IPv6 prefix", value)
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+// nat64Address returns the IPv4 address embedded in an address of a NAT64
+// prefix. It follows the prefix as laid out in RFC 6052 section 2.2, where
+// bits 64 to 71 are always skipped.
+func nat64Address(addr netip.Addr, prefix netip.Prefix) netip.Addr {
+	bytes := addr.As16()
+	var embedded [4]byte
+	position := prefix.Bits() / 8
+	for i := range embedded {
+		if position == 8 {
+			position += 1
+		}
+		embedded[i] = bytes[position]
+		position += 1
+	}
+	return netip.AddrFrom4(embedded)
+}
+
+// parsePeerAddress parses a peer address as reported by fastd, e.g.
+// "192.0.2.1:10000" or "[fe80::1%eth0]:10000". IPv4-mapped and NAT64
+// addresses are normalized to the IPv4 address of the peer and the zone is
+// dropped. The zero Addr is returned for peers without a valid address.
+func parsePeerAddress(address string) netip.Addr {
+	addr, _ := normalizePeerAddress(address)
+	return addr
+}
+
+// normalizePeerAddress is parsePeerAddress, additionally reporting whether
+// the peer connected through NAT64.
+func normalizePeerAddress(address string) (netip.Addr, bool) {
+	addrPort, err := netip.ParseAddrPort(address)
+	if err != nil {
+		return netip.Addr{}, false
+	}
+
+	addr := addrPort.Addr().Unmap().WithZone("")
+	for _, prefix := range nat64Prefixes {
+		if prefix.Contains(addr) {
+			return nat64Address(addr, prefix), true
+		}
+	}
+	return addr, false
+}
+
+// addressFamily returns the value of the ipaddr_family label for an address.
+func addressFamily(addr netip.Addr) string {
+	switch {
+	case addr.Is4():
+		return "IPv4"
+	case addr.Is6():
+		return "IPv6"
+	default:
+		return "unknown"
+	}
+}
+
+// sessionAgeBuckets are the buckets of fastd_peers_by_session_age, a session
+// is in the first bucket it is younger than.
+var sessionAgeBuckets = []struct {
+	label string
+	below float64
+}{
+	{"<1m", 60},
+	{"<1h", 60 * 60},
+	{"<1d", 24 * 60 * 60},
+	{">=1d", math.Inf(1)},
+}
+
+// sessionAgeBucket returns the bucket of a session age in seconds.
+func sessionAgeBucket(age float64) string {
+	for _, bucket := range sessionAgeBuckets {
+		if age < bucket.below {
+			return bucket.label
+		}
+	}
+	return sessionAgeBuckets[len(sessionAgeBuckets)-1].label
+}
+
+// plausibleDuration reports whether a duration in milliseconds from the
+// status output can be exported.
+func plausibleDuration(milliseconds float64) bool {
+	return milliseconds >= 0 && milliseconds < maxPlausibleDuration
+}
+
+// peerPrefix returns the /24 or /48 prefix of an address, the size commonly
+// assigned to a single network.
+func peerPrefix(addr netip.Addr) (netip.Prefix, bool) {
+	bits := 48
+	if addr.Is4() {
+		bits = 24
+	}
+
+	prefix, err := addr.Prefix(bits)
+	return prefix, err == nil
+}
+
+func isGlobalUnicast(addr netip.Addr) bool {
+	return addr.IsGlobalUnicast() && !addr.IsPrivate()
+}
+
+// collectPacketStatistics emits the packet and byte counters of a statistics
+// section, sections missing from the status output are skipped.
+func collectPacketStatistics(channel chan<- prometheus.Metric, packets *prometheus.Desc, bytes *prometheus.Desc, stats *PacketStatistics, labelValues ...string) {
+	if stats == nil {
+		return
+	}
+
+	channel <- prometheus.MustNewConstMetric(packets, prometheus.CounterValue, float64(stats.Count), labelValues...)
+	channel <- prometheus.MustNewConstMetric(bytes, prometheus.CounterValue, float64(stats.Bytes), labelValues...)
+}
+
+// statusFilePath returns the path of a file:// status specification.
+func statusFilePath(sock string) (string, bool) {
+	if !strings.HasPrefix(sock, statusFileScheme) {
+		return "", false
+	}
+	return strings.TrimPrefix(sock, statusFileScheme), true
+}
+
+func readFromStatusSocket(ctx context.Context, sock string, settings instanceSettings, deadline time.Time) (Message, error) {
+	_, dialSpan := tracer.Start(ctx, "Dial")
+	conn, err := dialStatusSocket(ctx, sock, settings, deadline)
+	dialSpan.End()
+	if err != nil {
+		return Message{}, err
+	}
+	defer func(conn net.Conn) {
+		_ = conn.Close()
+	}(conn)
+
+	err = conn.SetDeadline(deadline)
+	if err != nil {
+		return Message{}, err
+	}
+
+	_, decodeSpan := tracer.Start(ctx, "Decode")
+	defer decodeSpan.End()
+
+	return decodeStatus(conn)
+}
+
+// readFromStatusFile reads a status dump of fastd, e.g. copied out of a
+// container, and fails if it was not updated within --status-file.max-age.
+func readFromStatusFile(path string) (Message, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return Message{}, err
+	}
+	defer func(file *os.File) {
+		_ = file.Close()
+	}(file)
+
+	info, err := file.Stat()
+	if err != nil {
+		return Message{}, err
+	}
+	if age := time.Since(info.ModTime()); *statusFileMaxAge > 0 && age > *statusFileMaxAge {
+		return Message{}, fmt.Errorf("status file %s was last updated %s ago: %w", path, age.Round(time.Second), errStatusFileStale)
+	}
+
+	return decodeStatus(file)
+}
+
+// decodeStatus decodes the status output of fastd.
+func decodeStatus(reader io.Reader) (Message, error) {
+	return decodeStatusMessage(json.NewDecoder(reader))
+}
+
+// decodeStatusMessage decodes the next status message from a decoder.
+func decodeStatusMessage(decoder *json.Decoder) (Message, error) {
+	msg := Message{}
+	if *debugSnapshots > 0 {
+		var raw json.RawMessage
+		if err := decoder.Decode(&raw); err != nil {
+			return Message{}, err
+		}
+		if err := json.Unmarshal(raw, &msg); err != nil {
+			return Message{}, err
+		}
+		msg.raw = raw
+	} else if err := decoder.Decode(&msg); err != nil {
+		return Message{}, err
+	}
+
+	// move fields that older fastd releases report elsewhere to their current location
+	for publicKey, peer := range msg.Peers {
+		if len(peer.MAC) == 0 && peer.Connection != nil {
+			peer.MAC = peer.Connection.MAC
+			msg.Peers[publicKey] = peer
+		}
+	}
+
+	return msg, nil
+}
+
+type fastdConfig struct {
+	// path of the fastd config, empty if the status socket was given
+	path             string
+	statusSocketPath string
+	// mtu configured for the fastd interfaces, 0 if unknown
+	mtu int
+	// methods offered to peers in the order of preference
+	methods []string
+	// gateway of instances received from agents
+	gateway string
+	// host of instances from the inventory
+	host string
+}
+
+func parseConfig(instance string) (fastdConfig, error) {
+	/*
+	 * Parses a fastd configuration and extracts the status socket, where the exporter
+	 * will pull metrics from.
+	 *
+	 * Returns statusSocketPath, err
+	 * Errors when the configuration could not be read, no status socket is defined or the status socket does not exist
+	 */
+	patterns := []string(configPathPatterns)
+	if len(patterns) == 0 {
+		patterns = exporterConfig.ConfigPaths
+	}
+	if len(patterns) == 0 {
+		patterns = []string{defaultConfigPathPattern}
+	}
+	return parseConfigFrom(instance, patterns, true)
+}
+
+// parseConfigFrom parses the fastd configuration of an instance at the first
+// of the path patterns that exists. With requireSocket, the status socket
+// has to exist as well.
+func parseConfigFrom(instance string, patterns []string, requireSocket bool) (fastdConfig, error) {
+	// use the first path that exists, or the last one to report it missing
+	var path string
+	var data []byte
+	var err error
+	for _, pattern := range patterns {
+		path = fmt.Sprintf(pattern, instance)
+		if data, err = readConfigSource(path); !errors.Is(err, fs.ErrNotExist) {
+			break
+		}
+	}
+	if err != nil {
+		return fastdConfig{}, err
+	}
+	// unreadable includes are counted once the exporter reads the peers
+	data = inlineIncludes(path, data, 0, map[string]int{})
+
+	var statusSocketPath string
+	statusSocketPattern := regexp.MustCompile("status socket \"([^\"]+)\";")
+	if match := statusSocketPattern.FindSubmatch(data); len(match) != 0 {
+		statusSocketPath = string(match[1])
+	} else if *socketSystemdUnit == "" {
+		return fastdConfig{}, errors.New(fmt.Sprintf("Instance %s is missing 'status socket' declaration.", instance))
+	} else if statusSocketPath, err = socketFromSystemdUnit(instance); err != nil {
+		return fastdConfig{}, fmt.Errorf("Instance %s is missing 'status socket' declaration and its systemd unit does not set one: %v", instance, err)
+	}
+	config := fastdConfig{statusSocketPath: statusSocketPath}
+	if requireSocket {
+		if config, err = checkSocket(statusSocketPath); err != nil {
+			return fastdConfig{}, err
+		}
+	}
+
+	config.path = path
+
+	methodPattern := regexp.MustCompile(`(?m)^\s*method\s+"([^"]+)"\s*;`)
+	for _, match := range methodPattern.FindAllSubmatch(data, -1) {
+		config.methods = append(config.methods, string(match[1]))
+	}
+
+	mtuPattern := regexp.MustCompile(`(?m)^\s*mtu\s+(\d+)\s*;`)
+	if match := mtuPattern.FindSubmatch(data); len(match) != 0 {
+		config.mtu, _ = strconv.Atoi(string(match[1]))
+	}
+
+	return config, nil
+}
+
+// readConfigFile reads a fastd configuration and inlines the files referenced
+// by its include statements. Peer includes are not followed. Includes that
+// cannot be read are skipped and counted in problems.
+func readConfigFile(path string, depth int, problems map[string]int) ([]byte, error) {
+	if depth > 10 {
+		return nil, fmt.Errorf("includes nested too deeply at %s", path)
+	}
+
+	data, err := readConfigSource(path)
+	if err != nil {
+		return nil, err
+	}
+	return inlineIncludes(path, data, depth, problems), nil
+}
+
+// inlineIncludes replaces the include statements in the configuration read
+// from path with the files they reference. Includes that cannot be read are
+// logged, counted in problems and left out, so a broken include does not
+// keep the rest of the config from being read.
+func inlineIncludes(path string, data []byte, depth int, problems map[string]int) []byte {
+	return configIncludePattern.ReplaceAllFunc(data, func(statement []byte) []byte {
+		includePath := resolveConfigPath(path, string(configIncludePattern.FindSubmatch(statement)[1]))
+
+		included, err := readConfigFile(includePath, depth+1, problems)
+		if err != nil {
+			logRepeated("Skipping include %s of %s: %v", includePath, path, err)
+			problems[configErrorRead] += 1
+			return nil
+		}
+		return included
+	})
+}
+
+func checkSocket(statusSocketPath string) (fastdConfig, error) {
+	if isRemoteStatusSocket(statusSocketPath) {
+		return fastdConfig{statusSocketPath: statusSocketPath}, nil
+	}
+
+	path := statusSocketPath
+	if filePath, ok := statusFilePath(statusSocketPath); ok {
+		path = filePath
+	}
+
+	if _, err := os.Stat(path); err == nil {
+		return fastdConfig{statusSocketPath: statusSocketPath}, nil
+	} else {
+		return fastdConfig{}, errors.New(fmt.Sprintf("Status socket at %s does not exist. Is the fastd instance up?.", statusSocketPath))
+	}
+}
+
+// socketErrorReason classifies why the status socket could not be connected
+// to. Errors that occurred after the connection was established, e.g. while
+// decoding, return an empty reason.
+func socketErrorReason(err error) string {
+	var pathErr *fs.PathError
+	if errors.As(err, &pathErr) {
+		// reading a status file
+		switch {
+		case errors.Is(err, fs.ErrPermission):
+			return "permission_denied"
+		case errors.Is(err, fs.ErrNotExist):
+			return "not_found"
+		default:
+			return "error"
+		}
+	}
+
+	var opErr *net.OpError
+	if !errors.As(err, &opErr) || opErr.Op != "dial" {
+		return ""
+	}
+
+	switch {
+	case errors.Is(err, syscall.EACCES), errors.Is(err, syscall.EPERM):
+		return "permission_denied"
+	case errors.Is(err, syscall.ENOENT):
+		return "not_found"
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return "connection_refused"
+	case opErr.Timeout():
+		return "timeout"
+	default:
+		return "error"
+	}
+}
+
+// logSocketPermissions logs ownership and mode of the status socket along
+// with the credentials of the exporter, which is the information needed to
+// fix the most common setup problem.
+func logSocketPermissions(statusSocketPath string) {
+	if path, ok := statusFilePath(statusSocketPath); ok {
+		statusSocketPath = path
+	}
+
+	info, err := os.Stat(statusSocketPath)
+	if err != nil {
+		logRepeated("%v", err)
+		return
+	}
+
+	owner, group := "?", "?"
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		owner = lookupUserName(strconv.Itoa(int(stat.Uid)))
+		group = lookupGroupName(strconv.Itoa(int(stat.Gid)))
+	}
+
+	groups, _ := os.Getgroups()
+	logRepeated("Permission denied on status socket %s (owner %s, group %s, mode %s), exporter runs as uid %s gid %s with groups %v",
+		statusSocketPath, owner, group, info.Mode(),
+		lookupUserName(strconv.Itoa(os.Getuid())), lookupGroupName(strconv.Itoa(os.Getgid())), groups)
+}
+
+func lookupUserName(uid string) string {
+	if u, err := user.LookupId(uid); err == nil {
+		return fmt.Sprintf("%s(%s)", uid, u.Username)
+	}
+	return uid
+}
+
+func lookupGroupName(gid string) string {
+	if g, err := user.LookupGroupId(gid); err == nil {
+		return fmt.Sprintf("%s(%s)", gid, g.Name)
+	}
+	return gid
+}
+
+func boolToFloat64(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// refreshHandler discards the cached status of all instances before serving
+// requests with ?refresh=true, so they see the current state while debugging.
+func refreshHandler(exporters []*PrometheusExporter, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("refresh") == "true" {
+			if *webRefreshToken != "" && r.Header.Get("Authorization") != "Bearer "+*webRefreshToken {
+				http.Error(w, "refresh requires a valid bearer token", http.StatusForbidden)
+				return
+			}
+			for _, exporter := range withAgentExporters(exporters) {
+				exporter.invalidate()
+			}
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// webListeners binds the comma separated addresses, each given as host:port
+// or as tcp4://host:port or tcp6://host:port to restrict the address family.
+func webListeners(addresses string) ([]net.Listener, error) {
+	var listeners []net.Listener
+	for _, address := range strings.Split(addresses, ",") {
+		address = strings.TrimSpace(address)
+		network := "tcp"
+		for _, family := range []string{"tcp4", "tcp6"} {
+			if strings.HasPrefix(address, family+"://") {
+				network = family
+				address = strings.TrimPrefix(address, family+"://")
+			}
+		}
+
+		listener, err := net.Listen(network, address)
+		if err != nil {
+			return nil, err
+		}
+		log.Printf("Listening on %s (%s)", listener.Addr(), network)
+		listeners = append(listeners, listener)
+	}
+
+	return listeners, nil
+}
+
+func main() {
+	if len(os.Args) > 1 && os.Args[1] == "top" {
+		if err := runTop(os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "bench" {
+		if err := runBench(os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	flag.Parse()
+	configHTTPClient = &http.Client{Timeout: *configHTTPTimeout}
+
+	if err := loadConfig(*configFile); err != nil {
+		log.Fatal(err)
+	}
+	if exporterConfig.ListenAddress != "" && !flagSet("web.listen-address") {
+		*webListenAddress = exporterConfig.ListenAddress
+	}
+	if *lite {
+		applyLiteProfile()
+	}
+	registerConfigInfo()
+	for _, key := range peerMetadataKeyList() {
+		if err := exporterConfig.checkPeerLabel(key); err != nil {
+			log.Fatalf("Invalid peer metadata key: %v", err)
+		}
+	}
+	if !*histogramsClassic && *histogramsNativeFactor <= 1 {
+		log.Fatal("--histograms.classic-buckets=false requires native histograms")
+	}
+	if err := setupTracing(); err != nil {
+		log.Fatal(err)
+	}
+	if err := setupEnrichmentNetwork(); err != nil {
+		log.Fatal(err)
+	}
+	prefixes, err := parseNAT64Prefixes(*nat64PrefixList)
+	if err != nil {
+		log.Fatal(err)
+	}
+	nat64Prefixes = prefixes
+	if err := setupGeoIP(); err != nil {
+		log.Fatal(err)
+	}
+	if err := loadASNCache(); err != nil {
+		log.Fatal(err)
+	}
+	if err := setupPeerRegistry(); err != nil {
+		log.Fatal(err)
+	}
+	if err := setupNodesJSON(); err != nil {
+		log.Fatal(err)
+	}
+	if err := setupStatusTLS(); err != nil {
+		log.Fatal(err)
+	}
+	if *handshakeLogEnable {
+		if err := validateHandshakeLogCommand(); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if *agentName == "" {
+		*agentName, _ = os.Hostname()
+	}
+	for _, instance := range instanceSockets {
+		if !strings.Contains(instance, "=") {
+			log.Fatalf("Invalid --instance %s, expected name=socket", instance)
+		}
+	}
+	instances := append(flag.Args(), instanceSockets...)
+	// instances given on the command line take precedence over those of
+	// the config, which take precedence over discovered ones
+	given := func(name string) bool {
+		for _, instance := range instances {
+			if strings.SplitN(instance, "=", 2)[0] == name {
+				return true
+			}
+		}
+		return false
+	}
+	for _, instance := range exporterConfig.instanceSockets() {
+		if !given(strings.SplitN(instance, "=", 2)[0]) {
+			instances = append(instances, instance)
+		}
+	}
+	// discovered instances whose config declares no status socket are
+	// skipped
+	discovered := map[string]bool{}
+	if *discoverConfigDir != "" {
+		names, err := discoverInstances(*discoverConfigDir)
+		if err != nil {
+			log.Fatalf("Failed to discover instances: %v", err)
+		}
+		for _, name := range names {
+			if !given(name) {
+				discovered[name] = true
+				instances = append(instances, name)
+			}
+		}
+	}
+	var hosts inventory
+	if *inventoryFile != "" {
+		var err error
+		if hosts, err = loadInventory(*inventoryFile); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if len(instances) == 0 && len(hosts) == 0 && *collectorListenAddress == "" {
+		log.Fatal("No instances specified, aborting.")
+	}
+
+	for _, pattern := range excludedInstances {
+		if _, err := path.Match(pattern, ""); err != nil {
+			log.Fatalf("Invalid instance pattern %q: %v", pattern, err)
+		}
+	}
+
+	instancePattern := regexp.MustCompile(`^([a-zA-Z0-9\._-]+)(=((file://)?(/[a-zA-Z0-9\._-]+)+|(tcp|tls)://[a-zA-Z0-9\._:\[\]-]+))?$`)
+	var exporters []*PrometheusExporter
+	addExporter := func(instance string, config fastdConfig) {
+		// instances are told apart by their name, e.g. in the config and
+		// the API, the host label of the inventory is not enough
+		for _, exporter := range exporters {
+			if exporter.instance == instance {
+				log.Fatalf("Instance %v is given more than once", instance)
+			}
+		}
+		log.Printf("Reading fastd data for %v from %v", instance, config.statusSocketPath)
+		exporter := NewPrometheusExporter(instance, config)
+		exporter.optional = optionalInstances.contains(instance) || discovered[instance]
+		if exporterConfig.Instances[instance].ListenAddress != "" {
+			exporter.registry = prometheus.NewRegistry()
+			exporter.registries = newExporterRegistries()
+		}
+		if exporter.settings.socketProxy != "" {
+			if _, err := socksDialer(exporter.settings.socketProxy, &net.Dialer{}); err != nil {
+				log.Fatal(err)
+			}
+		}
+		exporters = append(exporters, exporter)
+		go func() {
+			if err := exporter.exporterRegistries().register(exporter); err != nil {
+				log.Fatalf("Failed to register instance %v: %v", instance, err)
+			}
+		}()
+	}
+
+	for i := 0; i < len(instances); i++ {
+		instance := instancePattern.FindStringSubmatch(instances[i])
+
+		var config fastdConfig
+		var err error
+
+		if instance == nil || len(instance) != 7 {
+			log.Fatalf("Invalid instance definition: %s", instances[i])
+		}
+
+		if excludedInstances.matches(instance[1]) || !exporterConfig.instanceEnabled(instance[1]) {
+			log.Printf("Skipping disabled instance %v", instance[1])
+			continue
+		}
+
+		// check if there is an provided socket path
+		if instance[3] != "" {
+			// use provided socket path
+			config, err = checkSocket(instance[3])
+		} else if discovered[instance[1]] {
+			config, err = parseDiscoveredConfig(instance[1])
+		} else {
+			// parse config to get socket path
+			config, err = parseConfig(instance[1])
+		}
+
+		if err != nil && discovered[instance[1]] {
+			log.Printf("Skipping discovered instance %v: %v", instance[1], err)
+			continue
+		} else if err != nil {
+			log.Fatal(err)
+		}
+		if *collectorListenAddress != "" {
+			// all instances of a collector are labeled with their gateway
+			config.gateway = *agentName
+		}
+		addExporter(instance[1], config)
+	}
+
+	for _, host := range hosts.sorted() {
+		var names []string
+		for instance := range hosts[host] {
+			names = append(names, instance)
+		}
+		sort.Strings(names)
+
+		for _, instance := range names {
+			if excludedInstances.matches(instance) || !exporterConfig.instanceEnabled(instance) {
+				log.Printf("Skipping disabled instance %v of %v", instance, host)
+				continue
+			}
+
+			config, err := checkSocket(hosts[host][instance])
+			if err != nil {
+				log.Fatal(err)
+			}
+			config.host = host
+			addExporter(instance, config)
+		}
+	}
+
+	for _, exporter := range exporters {
+		if exporter.settings.asnLookup {
+			asnLookupFailures.WithLabelValues("dns")
+			asnLookupFailures.WithLabelValues("bulk")
+			prometheus.MustRegister(asnLookupFailures)
+			break
+		}
+	}
+
+	if len(exporterConfig.Plugins) != 0 {
+		for _, exporter := range exporters {
+			for _, plugin := range exporterConfig.Plugins {
+				pluginFailures.WithLabelValues(plugin.Name, exporter.instance)
+			}
+			exporter.registerer().MustRegister(pluginCollector{exporter})
+		}
+		prometheus.MustRegister(pluginFailures)
+	}
+
+	// Expose the registered metrics via HTTP. The default mux is not used as
+	// net/http/pprof registers itself there.
+	mux := http.NewServeMux()
+	prometheus.MustRegister(httpRequestDuration, httpResponseSize)
+	handleMetrics(mux, "", exporters, defaultExporterRegistries, prometheus.DefaultRegisterer, prometheus.DefaultGatherer)
+	go awaitReadiness(exporters)
+
+	var sinks []eventSink
+	if *eventsKafkaBrokers != "" {
+		sinks = append(sinks, newKafkaSink(*eventsKafkaBrokers, *eventsKafkaTopic))
+	}
+	if *eventsNATSURL != "" {
+		sink, err := newNATSSink(*eventsNATSURL, *eventsNATSSubject)
+		if err != nil {
+			log.Fatal(err)
+		}
+		sinks = append(sinks, sink)
+	}
+	if len(sinks) != 0 {
+		go runEventPoller(exporters, sinks)
+	}
+	if *remoteDNSInterval > 0 {
+		go runRemoteChecks(exporters)
+	}
+	if *pollInterval > 0 && !*lite {
+		go runPoller(exporters)
+	}
+	if *consulAddress != "" && *consulKVPrefix != "" {
+		go runConsulTags()
+	}
+	if *nodesJSONURL != "" {
+		go runNodesJSON()
+	}
+	for _, exporter := range exporters {
+		exporter.startBackground()
+	}
+	if *discoverConfigDir != "" {
+		exported := map[string]bool{}
+		for _, exporter := range exporters {
+			exported[exporter.instance] = true
+		}
+		// given instances stay with their own config even if skipped
+		for _, instance := range instances {
+			if name := strings.SplitN(instance, "=", 2)[0]; !discovered[name] {
+				exported[name] = true
+			}
+		}
+		go runDiscovery(exported)
+	}
+	if *ipAsnLookupCacheFile != "" && *asnCacheSaveInterval > 0 {
+		go runASNCacheSaver()
+	}
+	if *agentCollectorAddress != "" {
+		go runAgent(exporters)
+	}
+	if *collectorListenAddress != "" {
+		if err := runCollector(); err != nil {
+			log.Fatalf("Failed to start collector: %v", err)
+		}
+	}
+	if *grpcListenAddress != "" {
+		if err := runStatusAPI(exporters); err != nil {
+			log.Fatalf("Failed to start gRPC status API: %v", err)
+		}
+	}
+	if *exportDirectory != "" {
+		go runPeerExport(exporters, *exportDirectory)
+	}
+	if *rollupsDirectory != "" {
+		if err := loadRollups(); err != nil {
+			log.Fatalf("Failed to load rollups from %s: %v", *rollupsDirectory, err)
+		}
+		go runRollups(exporters)
+	}
+	if *snmpAgentXAddress != "" {
+		if err := runSNMPSubagent(*snmpAgentXAddress, *snmpBaseOID, exporters); err != nil {
+			log.Fatalf("Failed to register with AgentX master agent: %v", err)
+		}
+	}
+
+	management := managementMux(mux)
+	mux.Handle("/healthz/deep", instrumentHandler("healthz_deep", deepHealthHandler(exporters)))
+	mux.Handle("/readyz", instrumentHandler("readyz", readinessHandler(exporters)))
+	management.Handle("/api/v1/peers/", instrumentHandler("api_peers", peerAPIHandler(exporters)))
+	management.Handle("/api/v1/instances/", instrumentHandler("api_instances", pauseHandler(exporters)))
+	if *rollupsDirectory != "" {
+		management.Handle("/api/v1/rollups", instrumentHandler("api_rollups", rollupsHandler()))
+	}
+	if *debugSnapshots > 0 {
+		management.Handle("/debug/snapshots/", instrumentHandler("debug_snapshots", snapshotsHandler(exporters)))
+	}
+	if *verifyHookEnable {
+		mux.Handle("/hooks/verify", instrumentHandler("hooks_verify", verifyHookHandler(exporters)))
+	}
+	var instanceList strings.Builder
+	for _, exporter := range exporters {
+		instanceList.WriteString("<li>" + html.EscapeString(exporterConfig.instanceDisplayName(exporter.instance)) + " (" + html.EscapeString(exporter.instance) + ")</li>")
+	}
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		_, err := w.Write([]byte(`<html>
+				<head><title>fastd exporter</title></head>
+				<body>
+				<h1>fastd exporter</h1>
+				<p><a href="` + *webMetricsPath + `">Metrics</a></p>
+				<h2>Instances</h2>
+				<ul>` + instanceList.String() + `</ul>
+				</body>
+				</html>`))
+		if err != nil {
+			return
+		}
+	})
+
+	server := &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: *webReadHeaderTimeout,
+		IdleTimeout:       *webIdleTimeout,
+		WriteTimeout:      *webWriteTimeout,
+	}
+	listeners, err := webListeners(*webListenAddress)
+	if err != nil {
+		log.Fatal(err)
+	}
+	instanceListeners := map[*PrometheusExporter][]net.Listener{}
+	for _, exporter := range exporters {
+		if exporter.registry == nil {
+			continue
+		}
+		instanceListeners[exporter], err = webListeners(exporterConfig.Instances[exporter.instance].ListenAddress)
+		if err != nil {
+			log.Fatalf("Failed to listen for instance %s: %v", exporter.instance, err)
+		}
+	}
+	var managementListeners []net.Listener
+	if *webManagementAddress != "" {
+		managementListeners, err = webListeners(*webManagementAddress)
+		if err != nil {
+			log.Fatalf("Failed to listen for management: %v", err)
+		}
+	}
+
+	if *runAsUser != "" {
+		if err := dropPrivileges(*runAsUser, *runAsGroup); err != nil {
+			log.Fatal(err)
+		}
+	} else if *runAsGroup != "" {
+		log.Fatal("--group requires --user")
+	}
+
+	if *consulAddress != "" {
+		if err := registerConsulService(listeners[0], exporters); err != nil {
+			log.Fatalf("Failed to register with Consul: %v", err)
+		}
+	}
+
+	errs := make(chan error)
+	servers := []*http.Server{server}
+	for _, listener := range listeners {
+		go func(listener net.Listener) {
+			errs <- server.Serve(listener)
+		}(listener)
+	}
+	managementServer := &http.Server{
+		Handler:           management,
+		ReadHeaderTimeout: *webReadHeaderTimeout,
+		IdleTimeout:       *webIdleTimeout,
+		// profiles take longer than the write timeout of metrics
+	}
+	servers = append(servers, managementServer)
+	for _, listener := range managementListeners {
+		go func(listener net.Listener) {
+			errs <- managementServer.Serve(listener)
+		}(listener)
+	}
+	for exporter, listeners := range instanceListeners {
+		instanceServer := &http.Server{
+			Handler:           instanceHandler(exporter),
+			ReadHeaderTimeout: *webReadHeaderTimeout,
+			IdleTimeout:       *webIdleTimeout,
+			WriteTimeout:      *webWriteTimeout,
+		}
+		servers = append(servers, instanceServer)
+		for _, listener := range listeners {
+			go func(listener net.Listener) {
+				errs <- instanceServer.Serve(listener)
+			}(listener)
+		}
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	select {
+	case err := <-errs:
+		log.Fatal(err)
+	case received := <-signals:
+		log.Printf("Received %s, shutting down", received)
+	}
+
+	// let running scrapes finish
+	ctx, cancel := context.WithTimeout(context.Background(), *webWriteTimeout)
+	defer cancel()
+	for _, server := range servers {
+		if err := server.Shutdown(ctx); err != nil {
+			log.Printf("Failed to shut down the HTTP server: %v", err)
+		}
+	}
+
+	if *ipAsnLookupCacheFile != "" {
+		if err := saveASNCache(); err != nil {
+			log.Fatalf("Failed to save ASN cache to %s: %v", *ipAsnLookupCacheFile, err)
+		}
+	}
 }
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestNormalizePeerAddress(t *testing.T) {
+	for _, test := range []struct {
+		prefix  string
+		address string
+		want    string
+		nat64   bool
+	}{
+		{"64:ff9b::/96", "192.0.2.33:10000", "192.0.2.33", false},
+		{"64:ff9b::/96", "[::ffff:192.0.2.33]:10000", "192.0.2.33", false},
+		{"64:ff9b::/96", "[fe80::1%eth0]:10000", "fe80::1", false},
+		{"64:ff9b::/96", "[2001:db8::1]:10000", "2001:db8::1", false},
+		{"64:ff9b::/96", "invalid", "invalid IP", false},
+		{"64:ff9b::/96", "[64:ff9b::192.0.2.33]:10000", "192.0.2.33", true},
+		{"64:ff9b:1::/48", "[64:ff9b:1:c000:2:2100::]:10000", "192.0.2.33", true},
+		// the examples of RFC 6052 section 2.4
+		{"2001:db8::/32", "[2001:db8:c000:221::]:10000", "192.0.2.33", true},
+		{"2001:db8:100::/40", "[2001:db8:1c0:2:21::]:10000", "192.0.2.33", true},
+		{"2001:db8:122::/48", "[2001:db8:122:c000:2:2100::]:10000", "192.0.2.33", true},
+		{"2001:db8:122:300::/56", "[2001:db8:122:3c0:0:221::]:10000", "192.0.2.33", true},
+		{"2001:db8:122:344::/64", "[2001:db8:122:344:c0:2:2100:0]:10000", "192.0.2.33", true},
+		{"2001:db8:122:344::/96", "[2001:db8:122:344::192.0.2.33]:10000", "192.0.2.33", true},
+	} {
+		prefixes, err := parseNAT64Prefixes(test.prefix)
+		if err != nil {
+			t.Fatal(err)
+		}
+		nat64Prefixes = prefixes
+
+		addr, nat64 := normalizePeerAddress(test.address)
+		if addr.String() != test.want || nat64 != test.nat64 {
+			t.Errorf("%s in %s: got %s and NAT64 %v, want %s and %v", test.address, test.prefix, addr, nat64, test.want, test.nat64)
+		}
+	}
+	nat64Prefixes = nil
+}
+
+func TestParseNAT64PrefixesInvalid(t *testing.T) {
+	for _, list := range []string{"64:ff9b::/95", "192.0.2.0/32", "::ffff:0:0/96", "64:ff9b::"} {
+		if _, err := parseNAT64Prefixes(list); err == nil {
+			t.Errorf("invalid NAT64 prefixes %q were accepted", list)
+		}
+	}
+	if prefixes, err := parseNAT64Prefixes(""); err != nil || prefixes != nil {
+		t.Errorf("empty list: got %v, %v", prefixes, err)
+	}
+}
+
+// writeConfigFiles creates the files of a fastd config in a directory and
+// reads the configs of instances from it for the duration of a test.
+func writeConfigFiles(t *testing.T, files map[string]string) string {
+	t.Helper()
+	directory := t.TempDir()
+	for name, content := range files {
+		content = strings.ReplaceAll(content, "$DIR", directory)
+		if err := os.WriteFile(filepath.Join(directory, name), []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	patterns := configPathPatterns
+	configPathPatterns = []string{filepath.Join(directory, "%s.conf")}
+	t.Cleanup(func() { configPathPatterns = patterns })
+	return directory
+}
+
+func TestParseConfig(t *testing.T) {
+	directory := writeConfigFiles(t, map[string]string{
+		"dom0.conf": `interface "dom0";
+  mtu 1406;
+# method "null";
+method "salsa2012+umac";
+include "methods.conf";
+include peers from "peers";
+status socket "$DIR/dom0.sock";
+`,
+		"methods.conf": "\tmethod  \"null@l2tp\" ;\nmethod \"null\";\n",
+		"dom0.sock":    "",
+	})
+
+	config, err := parseConfig("dom0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := fastdConfig{
+		path:             filepath.Join(directory, "dom0.conf"),
+		statusSocketPath: filepath.Join(directory, "dom0.sock"),
+		mtu:              1406,
+		methods:          []string{"salsa2012+umac", "null@l2tp", "null"},
+	}
+	if !reflect.DeepEqual(config, want) {
+		t.Errorf("got %+v, want %+v", config, want)
+	}
+}
+
+func TestParseConfigInvalid(t *testing.T) {
+	writeConfigFiles(t, map[string]string{
+		"nosocket.conf": "mtu 1406;\n",
+		"down.conf":     `status socket "$DIR/down.sock";` + "\n",
+		"loop.conf":     `include "loop.conf";` + "\n",
+	})
+
+	for _, instance := range []string{"nosocket", "down", "loop", "missing"} {
+		if config, err := parseConfig(instance); err == nil {
+			t.Errorf("config of %s was accepted: %+v", instance, config)
+		}
+	}
+}
+
+// TestParseConfigUnreadableInclude makes sure that an include that cannot
+// be read is skipped and counted instead of failing the instance.
+func TestParseConfigUnreadableInclude(t *testing.T) {
+	directory := writeConfigFiles(t, map[string]string{
+		"dom0.conf": `include "missing.conf";` + "\n" + `mtu 1406;` + "\n" + `status socket "$DIR/dom0.conf";` + "\n",
+	})
+
+	config, err := parseConfig("dom0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.mtu != 1406 || config.statusSocketPath != filepath.Join(directory, "dom0.conf") {
+		t.Errorf("got %+v", config)
+	}
+
+	exporter := NewPrometheusExporter("dom0", config)
+	exporter.peerConfigs()
+	if exporter.configErrors[configErrorRead] != 1 || exporter.configValid {
+		t.Errorf("got config errors %v and valid %v, want one read failure", exporter.configErrors, exporter.configValid)
+	}
+}
+
+// TestExporterGatherPedantic makes sure that the metrics collected from a
+// status match their descriptions, which would otherwise break the scrape.
+func TestExporterGatherPedantic(t *testing.T) {
+	if err := loadTestConfig(t, "labels:\n  region: darmstadt\n"); err != nil {
+		t.Fatal(err)
+	}
+	registry := prometheus.NewPedanticRegistry()
+	if err := registry.Register(testExporter(t, 50)); err != nil {
+		t.Fatal(err)
+	}
+
+	// collectors keeping state between scrapes have to stay consistent
+	for i := 0; i < 2; i++ {
+		names := familyNames(t, registry)
+		if !names["fastd_peers_up_total"] || !names["fastd_peer_up"] {
+			t.Errorf("gather %d is missing metrics of the status: %v", i, names)
+		}
+	}
+}
+
+// serveStatus answers connections to a status socket with a synthetic
+// status and returns the number of connections accepted so far.
+func serveStatus(t *testing.T, path string) func() int64 {
+	t.Helper()
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = listener.Close() })
+
+	var connections int64
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt64(&connections, 1)
+			_ = json.NewEncoder(conn).Encode(benchStatus(3, 0.5))
+			_ = conn.Close()
+		}
+	}()
+	return func() int64 { return atomic.LoadInt64(&connections) }
+}
+
+func TestScrapeMinInterval(t *testing.T) {
+	interval := *scrapeMinInterval
+	*scrapeMinInterval = time.Minute
+	t.Cleanup(func() { *scrapeMinInterval = interval })
+
+	path := filepath.Join(t.TempDir(), "fastd.sock")
+	connections := serveStatus(t, path)
+	exporter := NewPrometheusExporter("dom0", fastdConfig{statusSocketPath: path})
+
+	for i := 0; i < 2; i++ {
+		if _, _, err := exporter.status(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := connections(); got != 1 {
+		t.Errorf("two reads within the interval connected %d times, want once", got)
+	}
+
+	exporter.mutex.Lock()
+	exporter.lastRead = exporter.lastRead.Add(-*scrapeMinInterval)
+	exporter.mutex.Unlock()
+	if _, _, err := exporter.status(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if got := connections(); got != 2 {
+		t.Errorf("read after the interval connected %d times in total, want twice", got)
+	}
+}
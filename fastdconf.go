@@ -0,0 +1,302 @@
+package main
+
+import (
+	"log"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// peerConfigTTL is how long the peer configs of an instance are used before
+// they are read again, as peers are added and removed while fastd runs.
+const peerConfigTTL = time.Minute
+
+var (
+	peerIncludePattern = regexp.MustCompile(`include\s+peers\s+from\s+"([^"]+)"\s*;`)
+	peerBlockPattern   = regexp.MustCompile(`peer\s+"([^"]+)"\s*\{([^}]*)\}`)
+	peerKeyPattern     = regexp.MustCompile(`key\s+"([0-9a-fA-F]{64})"\s*;`)
+	peerFloatPattern   = regexp.MustCompile(`float\s+(yes|no)\s*;`)
+	peerRemotePattern  = regexp.MustCompile(`remote\s+(?:(ipv4|ipv6)\s+)?"([^"]+)"\s+port\s+\d+\s*;`)
+	commentPattern     = regexp.MustCompile(`(?m)(#|//).*$`)
+	metadataPattern    = regexp.MustCompile(`(?m)^\s*#\s*([A-Za-z][A-Za-z0-9_-]*)\s*:\s*(.*?)\s*$`)
+	peerGroupPattern   = regexp.MustCompile(`peer\s+group\s+"([^"]+)"\s*\{`)
+	peerLimitPattern   = regexp.MustCompile(`peer\s+limit\s+(\d+)\s*;`)
+)
+
+// fastd puts peers outside of any peer group into the default group
+const defaultPeerGroup = "default"
+
+// reasons of fastd_config_parse_errors_total
+const (
+	configErrorRead          = "read_failed"
+	configErrorPeerDirectory = "peer_directory_unreadable"
+	configErrorPeerFile      = "peer_file_unreadable"
+	configErrorPeerKey       = "peer_key_missing"
+)
+
+var configErrorReasons = []string{configErrorRead, configErrorPeerDirectory, configErrorPeerFile, configErrorPeerKey}
+
+// peerConfig is what the fastd config says about a peer.
+type peerConfig struct {
+	name     string
+	floating bool
+	// hostnames of the remote statements
+	remotes []peerRemote
+	// metadata from comments like "# owner: ..." in the peer file
+	metadata map[string]string
+	// innermost peer group the peer is defined in
+	group string
+}
+
+// peerGroup is a peer group of the fastd config.
+type peerGroup struct {
+	// group the group is nested in, empty for the default group
+	parent string
+	// peer limit of the group, -1 if it has none
+	limit int
+	// statements directly in the group, without those of nested groups
+	statements []byte
+}
+
+type peerRemote struct {
+	host string
+	// ipv4 or ipv6 if the remote is restricted to an address family
+	family string
+}
+
+// readPeerConfigs reads the peers defined in a fastd config, both inline and
+// in peer directories, and returns them by public key along with the peer
+// groups by name. Relative peer directories are resolved against the
+// directory of the config. Problems found are counted in problems by reason.
+func readPeerConfigs(configPath string, data []byte, problems map[string]int) (map[string]peerConfig, map[string]peerGroup) {
+	peers := map[string]peerConfig{}
+	groups := parsePeerGroups(commentPattern.ReplaceAll(data, nil))
+	for name, group := range groups {
+		readGroupPeers(configPath, name, group.statements, peers, problems)
+	}
+	return peers, groups
+}
+
+// parsePeerGroups splits the statements of a fastd config into those of its
+// peer groups, including the default group around them.
+func parsePeerGroups(data []byte) map[string]peerGroup {
+	groups := map[string]peerGroup{defaultPeerGroup: {limit: -1}}
+
+	opening := map[int]string{}
+	for _, match := range peerGroupPattern.FindAllSubmatchIndex(data, -1) {
+		opening[match[1]-1] = string(data[match[2]:match[3]])
+	}
+
+	type openGroup struct {
+		name  string
+		depth int
+	}
+	stack := []openGroup{{name: defaultPeerGroup}}
+	statements := map[string][]byte{}
+	depth := 0
+	for i, c := range data {
+		current := stack[len(stack)-1]
+		switch {
+		case c == '{':
+			depth++
+			if name, ok := opening[i]; ok {
+				groups[name] = peerGroup{parent: current.name, limit: -1}
+				stack = append(stack, openGroup{name: name, depth: depth})
+				continue
+			}
+		case c == '}':
+			depth--
+			if len(stack) > 1 && current.depth == depth+1 {
+				stack = stack[:len(stack)-1]
+				continue
+			}
+		}
+		statements[current.name] = append(statements[current.name], c)
+	}
+
+	for name, group := range groups {
+		group.statements = statements[name]
+		// the limits of peers in nested groups are not the limit of the group
+		withoutPeers := peerBlockPattern.ReplaceAll(group.statements, nil)
+		if match := peerLimitPattern.FindSubmatch(withoutPeers); match != nil {
+			group.limit, _ = strconv.Atoi(string(match[1]))
+		}
+		groups[name] = group
+	}
+	return groups
+}
+
+// readGroupPeers reads the peers defined directly in a peer group into
+// peers.
+func readGroupPeers(configPath string, groupName string, data []byte, peers map[string]peerConfig, problems map[string]int) {
+	for _, match := range peerBlockPattern.FindAllSubmatch(data, -1) {
+		if publicKey, config, ok := parsePeerConfig(string(match[1]), match[2]); ok {
+			config.group = groupName
+			peers[publicKey] = config
+		} else {
+			log.Printf("Peer %s in %s has no valid key", match[1], configPath)
+			problems[configErrorPeerKey] += 1
+		}
+	}
+
+	for _, match := range peerIncludePattern.FindAllSubmatch(data, -1) {
+		// the trailing slash resolves the peers relative to the directory
+		directory := resolveConfigPath(configPath, string(match[1]))
+		if !strings.HasSuffix(directory, "/") {
+			directory += "/"
+		}
+
+		names, err := listPeerDirectory(directory)
+		if err != nil {
+			log.Printf("Failed to read peer directory %s: %v", directory, err)
+			problems[configErrorPeerDirectory] += 1
+			continue
+		}
+		for _, name := range names {
+			// fastd skips hidden files and editor backups as well
+			if strings.HasPrefix(name, ".") || strings.HasSuffix(name, "~") {
+				continue
+			}
+
+			peerData, err := readConfigSource(resolveConfigPath(directory, name))
+			if err != nil {
+				log.Printf("Failed to read peer config %s: %v", name, err)
+				problems[configErrorPeerFile] += 1
+				continue
+			}
+			if publicKey, config, ok := parsePeerConfig(name, peerData); ok {
+				config.group = groupName
+				peers[publicKey] = config
+			} else {
+				log.Printf("Peer config %s has no valid key", resolveConfigPath(directory, name))
+				problems[configErrorPeerKey] += 1
+			}
+		}
+	}
+}
+
+// parsePeerConfig parses the statements of a single peer and the metadata
+// in its comments.
+func parsePeerConfig(name string, data []byte) (string, peerConfig, bool) {
+	config := peerConfig{name: name, metadata: map[string]string{}}
+	for _, match := range metadataPattern.FindAllSubmatch(data, -1) {
+		key := strings.ReplaceAll(strings.ToLower(string(match[1])), "-", "_")
+		config.metadata[key] = string(match[2])
+	}
+
+	data = commentPattern.ReplaceAll(data, nil)
+	match := peerKeyPattern.FindSubmatch(data)
+	if match == nil {
+		return "", peerConfig{}, false
+	}
+	if match := peerFloatPattern.FindSubmatch(data); match != nil {
+		config.floating = string(match[1]) == "yes"
+	}
+	for _, match := range peerRemotePattern.FindAllSubmatch(data, -1) {
+		config.remotes = append(config.remotes, peerRemote{host: string(match[2]), family: string(match[1])})
+	}
+
+	return strings.ToLower(string(match[1])), config, true
+}
+
+// peerConfigs returns the peer configs of the instance, read again from its
+// fastd config once they are older than peerConfigTTL. It is empty for
+// instances that were given with their status socket.
+func (exporter *PrometheusExporter) peerConfigs() map[string]peerConfig {
+	if exporter.configPath == "" {
+		return nil
+	}
+
+	exporter.peerConfigMutex.Lock()
+	defer exporter.peerConfigMutex.Unlock()
+
+	if exporter.peerConfig != nil && time.Since(exporter.peerConfigRead) < peerConfigTTL {
+		return exporter.peerConfig
+	}
+
+	problems := map[string]int{}
+	data, err := readConfigFile(exporter.configPath, 0, problems)
+	if err != nil {
+		logRepeated("Failed to read peers of %s: %v", exporter.instance, err)
+		exporter.configErrors[configErrorRead] += 1
+		exporter.configValid = false
+		return exporter.peerConfig
+	}
+
+	exporter.peerConfig, exporter.peerGroups = readPeerConfigs(exporter.configPath, data, problems)
+	exporter.peerConfigRead = time.Now()
+	exporter.configValid = len(problems) == 0
+	if !isConfigURL(exporter.configPath) {
+		exporter.keyFiles = checkKeyFiles(exporter.configPath, data)
+	}
+	for reason, count := range problems {
+		exporter.configErrors[reason] += count
+	}
+	return exporter.peerConfig
+}
+
+// collectConfigErrors exports the problems found while reading the fastd
+// config of the instance, so broken configs rolled out by automation alert
+// instead of only being logged.
+func (exporter *PrometheusExporter) collectConfigErrors(channel chan<- prometheus.Metric) {
+	if exporter.configPath == "" {
+		return
+	}
+
+	exporter.peerConfigMutex.Lock()
+	defer exporter.peerConfigMutex.Unlock()
+
+	channel <- prometheus.MustNewConstMetric(exporter.configValidDesc, prometheus.GaugeValue, boolToFloat64(exporter.configValid))
+	for _, reason := range configErrorReasons {
+		channel <- prometheus.MustNewConstMetric(exporter.configParseErrors, prometheus.CounterValue, float64(exporter.configErrors[reason]), reason)
+	}
+}
+
+// peerGroupConfigs returns the peer groups of the instance, read along with
+// the peer configs.
+func (exporter *PrometheusExporter) peerGroupConfigs() map[string]peerGroup {
+	exporter.peerConfigs()
+
+	exporter.peerConfigMutex.Lock()
+	defer exporter.peerConfigMutex.Unlock()
+
+	return exporter.peerGroups
+}
+
+// collectPeerGroups exports the peer limit of the peer groups and their
+// connected peers, including those of nested groups. Connected peers not in
+// the config, like those accepted by a verify hook, count for the default
+// group.
+func (exporter *PrometheusExporter) collectPeerGroups(channel chan<- prometheus.Metric, data Message, peerConfigs map[string]peerConfig) {
+	groups := exporter.peerGroupConfigs()
+	if len(groups) == 0 {
+		return
+	}
+
+	connected := map[string]int{}
+	for publicKey, peer := range data.Peers {
+		if peer.Connection == nil {
+			continue
+		}
+		group := defaultPeerGroup
+		if config, ok := peerConfigs[publicKey]; ok {
+			group = config.group
+		}
+		// parents are known, but guard against cycles of groups with
+		// the same name
+		for hops := 0; group != "" && hops <= len(groups); hops++ {
+			connected[group] += 1
+			group = groups[group].parent
+		}
+	}
+
+	for name, group := range groups {
+		channel <- prometheus.MustNewConstMetric(exporter.peerGroupPeersUp, prometheus.GaugeValue, float64(connected[name]), name)
+		if group.limit >= 0 {
+			channel <- prometheus.MustNewConstMetric(exporter.peerGroupPeerLimit, prometheus.GaugeValue, float64(group.limit), name)
+		}
+	}
+}
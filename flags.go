@@ -0,0 +1,49 @@
+package main
+
+import (
+	"flag"
+	"path"
+	"strings"
+)
+
+// flagSet reports whether a flag was given on the command line.
+func flagSet(name string) bool {
+	set := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
+}
+
+// stringSliceFlag collects the values of a flag that may be given multiple times.
+type stringSliceFlag []string
+
+func (values *stringSliceFlag) String() string {
+	return strings.Join(*values, ", ")
+}
+
+func (values *stringSliceFlag) Set(value string) error {
+	*values = append(*values, value)
+	return nil
+}
+
+func (values stringSliceFlag) contains(value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// matches reports whether value matches any of the values as a shell pattern.
+func (values stringSliceFlag) matches(value string) bool {
+	for _, pattern := range values {
+		if matched, _ := path.Match(pattern, value); matched {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"net"
+	"net/netip"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// geoipDatabase is the database opened from --geoip.database, nil if none is
+// configured.
+var geoipDatabase *maxminddb.Reader
+
+func setupGeoIP() error {
+	if *geoipDatabasePath == "" {
+		return nil
+	}
+
+	var err error
+	geoipDatabase, err = maxminddb.Open(*geoipDatabasePath)
+	return err
+}
+
+// lookupCountry returns the ISO country code of an address, or "unknown" if
+// the database has no country for it.
+func lookupCountry(addr netip.Addr) string {
+	var record struct {
+		Country struct {
+			ISOCode string `maxminddb:"iso_code"`
+		} `maxminddb:"country"`
+	}
+
+	if addr.IsValid() {
+		if err := geoipDatabase.Lookup(net.IP(addr.AsSlice()), &record); err == nil && record.Country.ISOCode != "" {
+			return record.Country.ISOCode
+		}
+	}
+
+	return "unknown"
+}
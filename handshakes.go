@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os/exec"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// delay before the log command is started again after it exited
+const handshakeLogRestartDelay = 10 * time.Second
+
+// fastd logs established sessions, including those of rekeying, with the
+// name of the peer, or its key if it has no name, in angle brackets
+var handshakeLogPattern = regexp.MustCompile(`(?:new session with|connection with) <([^>]+)> established`)
+
+// runHandshakeLog follows the log of an instance with --handshake-log.command
+// and records the time of every session the peers established.
+func (exporter *PrometheusExporter) runHandshakeLog() {
+	args := strings.Fields(strings.ReplaceAll(*handshakeLogCommand, "%s", exporter.instance))
+
+	for {
+		command := exec.Command(args[0], args[1:]...)
+		stdout, err := command.StdoutPipe()
+		if err == nil {
+			err = command.Start()
+		}
+		if err != nil {
+			log.Printf("Failed to follow the log of %s: %v", exporter.instance, err)
+			time.Sleep(handshakeLogRestartDelay)
+			continue
+		}
+
+		scanner := bufio.NewScanner(stdout)
+		for scanner.Scan() {
+			exporter.recordLogLine(scanner.Text(), time.Now())
+		}
+
+		err = command.Wait()
+		log.Printf("Log command of %s exited: %v", exporter.instance, err)
+		time.Sleep(handshakeLogRestartDelay)
+	}
+}
+
+// recordLogLine records the established session or the handshake exchange
+// a line of the log is about, if any.
+func (exporter *PrometheusExporter) recordLogLine(line string, lineTime time.Time) {
+	if match := handshakeLogPattern.FindStringSubmatch(line); match != nil {
+		exporter.recordHandshake(match[1], lineTime)
+	} else if handshakeAttemptPattern.MatchString(line) {
+		exporter.recordHandshakeAttempt(lineTime)
+	}
+}
+
+// recordHandshake records a handshake of the peer with the given name or
+// key.
+func (exporter *PrometheusExporter) recordHandshake(peer string, handshakeTime time.Time) {
+	exporter.handshakesMutex.Lock()
+	defer exporter.handshakesMutex.Unlock()
+
+	exporter.handshakes[peer] = handshakeTime
+}
+
+// collectLastHandshake exports the time of the last handshake of a peer
+// seen in the log, if any.
+func (exporter *PrometheusExporter) collectLastHandshake(channel chan<- prometheus.Metric, publicKey, peerName string, labelValues []string) {
+	exporter.handshakesMutex.Lock()
+	defer exporter.handshakesMutex.Unlock()
+
+	handshakeTime, ok := exporter.handshakes[peerName]
+	if !ok {
+		handshakeTime, ok = exporter.handshakes[publicKey]
+	}
+	if !ok {
+		return
+	}
+
+	channel <- prometheus.MustNewConstMetric(exporter.peerLastHandshake, prometheus.GaugeValue, float64(handshakeTime.UnixNano())/1e9, labelValues...)
+}
+
+// validateHandshakeLogCommand checks --handshake-log.command.
+func validateHandshakeLogCommand() error {
+	if len(strings.Fields(*handshakeLogCommand)) == 0 {
+		return fmt.Errorf("--handshake-log.enable requires --handshake-log.command")
+	}
+	return nil
+}
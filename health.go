@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+type instanceHealth struct {
+	Up            bool    `json:"up"`
+	Paused        bool    `json:"paused,omitempty"`
+	Maintenance   bool    `json:"maintenance,omitempty"`
+	Error         string  `json:"error,omitempty"`
+	UptimeSeconds float64 `json:"uptime_seconds,omitempty"`
+	Peers         int     `json:"peers"`
+	PeersUp       int     `json:"peers_up"`
+}
+
+// health reads the status socket of the instance for /healthz/deep. Paused
+// instances are not read at all.
+func (exporter *PrometheusExporter) health(ctx context.Context) instanceHealth {
+	health := instanceHealth{Paused: exporter.isPaused(), Maintenance: exporter.inMaintenance(time.Now())}
+	if health.Paused {
+		return health
+	}
+
+	data, err := readStatus(ctx, exporter.statusSocketPath, exporter.settings)
+	if err != nil {
+		health.Error = err.Error()
+		return health
+	}
+	health.Up = true
+	health.UptimeSeconds = data.Uptime / 1000
+	health.Peers = len(data.Peers)
+	for _, peer := range data.Peers {
+		if peer.Connection != nil {
+			health.PeersUp += 1
+		}
+	}
+	return health
+}
+
+// deepHealthHandler reads the status socket of every instance and reports the
+// results as JSON. It answers with 503 if any of the instances is down,
+// except for those paused or in maintenance, as they are down on purpose.
+func deepHealthHandler(exporters []*PrometheusExporter) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), *webHealthTimeout)
+		defer cancel()
+
+		var mutex sync.Mutex
+		var wg sync.WaitGroup
+		results := map[string]instanceHealth{}
+
+		for _, exporter := range withAgentExporters(exporters) {
+			wg.Add(1)
+			go func(exporter *PrometheusExporter) {
+				defer wg.Done()
+
+				health := exporter.health(ctx)
+
+				mutex.Lock()
+				results[exporter.instanceKey()] = health
+				mutex.Unlock()
+			}(exporter)
+		}
+		wg.Wait()
+
+		status := http.StatusOK
+		for _, health := range results {
+			if !health.Up && !health.Paused && !health.Maintenance {
+				status = http.StatusServiceUnavailable
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		err := json.NewEncoder(w).Encode(map[string]interface{}{"instances": results})
+		if err != nil {
+			log.Print(err)
+		}
+	})
+}
+
+// awaitReadiness reads the instances that were not read successfully yet until
+// all of them were, then notifies systemd that the exporter is ready.
+func awaitReadiness(exporters []*PrometheusExporter) {
+	for {
+		ready := true
+		for _, exporter := range exporters {
+			if exporter.isReady() {
+				continue
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), exporter.settings.socketTimeout)
+			_, _, err := exporter.status(ctx)
+			cancel()
+			if err != nil {
+				ready = false
+			}
+		}
+
+		if ready {
+			log.Print("All instances are ready")
+			if err := sdNotify("READY=1"); err != nil {
+				log.Printf("Failed to notify systemd: %v", err)
+			}
+			return
+		}
+
+		time.Sleep(time.Second)
+	}
+}
+
+// readinessHandler answers with 200 once every instance that is not optional
+// was read successfully at least once, and with 503 before.
+func readinessHandler(exporters []*PrometheusExporter) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var pending []string
+		for _, exporter := range withAgentExporters(exporters) {
+			if !exporter.isReady() {
+				pending = append(pending, exporter.instanceKey())
+			}
+		}
+
+		if len(pending) != 0 {
+			http.Error(w, fmt.Sprintf("waiting for instances: %s", strings.Join(pending, ", ")), http.StatusServiceUnavailable)
+			return
+		}
+
+		_, _ = w.Write([]byte("ready\n"))
+	})
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestDeepHealthPausedInstances(t *testing.T) {
+	directory := t.TempDir()
+	paused := NewPrometheusExporter("dom0", fastdConfig{statusSocketPath: filepath.Join(directory, "dom0.sock")})
+	maintenance := NewPrometheusExporter("dom1", fastdConfig{statusSocketPath: filepath.Join(directory, "dom1.sock")})
+	handler := deepHealthHandler([]*PrometheusExporter{paused, maintenance})
+
+	get := func() (int, map[string]instanceHealth) {
+		t.Helper()
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/healthz/deep", nil))
+		var body struct {
+			Instances map[string]instanceHealth `json:"instances"`
+		}
+		if err := json.NewDecoder(recorder.Body).Decode(&body); err != nil {
+			t.Fatal(err)
+		}
+		return recorder.Code, body.Instances
+	}
+
+	// both instances are down on purpose
+	paused.pause(0)
+	maintenance.startMaintenance(time.Hour)
+	code, instances := get()
+	if code != http.StatusOK {
+		t.Errorf("got status %d while the instances are paused or in maintenance, want 200", code)
+	}
+	if health := instances["dom0"]; !health.Paused || health.Error != "" {
+		t.Errorf("paused instance was read: %+v", health)
+	}
+	if health := instances["dom1"]; !health.Maintenance || health.Up || health.Error == "" {
+		t.Errorf("got %+v for the instance in maintenance", health)
+	}
+
+	paused.resume()
+	if code, _ := get(); code != http.StatusServiceUnavailable {
+		t.Errorf("got status %d after resuming a down instance, want 503", code)
+	}
+}
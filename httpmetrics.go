@@ -0,0 +1,38 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	httpRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    prefixWrapper("exporter", "http_request_duration_seconds"),
+		Help:    "time taken to serve HTTP requests, including reading the status sockets for scrapes",
+		Buckets: []float64{0.01, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30},
+	}, []string{"handler", "fastd_instance", "code"})
+	httpResponseSize = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    prefixWrapper("exporter", "http_response_size_bytes"),
+		Help:    "size of the HTTP responses of the exporter",
+		Buckets: prometheus.ExponentialBuckets(1024, 4, 8),
+	}, []string{"handler", "fastd_instance"})
+)
+
+// instrumentHandler measures the duration and the size of the responses of
+// a handler, so problems on the side of the scrapers can be told apart from
+// slow status sockets. Scrapes in flight are already counted by promhttp in
+// promhttp_metric_handler_requests_in_flight.
+func instrumentHandler(name string, handler http.Handler) http.Handler {
+	return instrumentInstanceHandler(name, "", handler)
+}
+
+// instrumentInstanceHandler instruments a handler that serves a single
+// instance with a listen address of its own.
+func instrumentInstanceHandler(name string, instance string, handler http.Handler) http.Handler {
+	labels := prometheus.Labels{"handler": name, "fastd_instance": instance}
+	return promhttp.InstrumentHandlerDuration(httpRequestDuration.MustCurryWith(labels),
+		promhttp.InstrumentHandlerResponseSize(httpResponseSize.MustCurryWith(labels), handler),
+	)
+}
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// registerer returns the registry the metrics of the instance are
+// registered with.
+func (exporter *PrometheusExporter) registerer() prometheus.Registerer {
+	if exporter.registry != nil {
+		return exporter.registry
+	}
+	return prometheus.DefaultRegisterer
+}
+
+// instanceHandler serves the metrics of an instance with a listen address
+// of its own under --web.telemetry-path.
+func instanceHandler(exporter *PrometheusExporter) http.Handler {
+	mux := http.NewServeMux()
+	handleMetrics(mux, exporter.instance, []*PrometheusExporter{exporter}, exporter.registries, exporter.registry, exporter.registry)
+	return mux
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+
+	"gopkg.in/yaml.v3"
+)
+
+// inventory lists the status sockets of the instances on other hosts, by
+// host and instance name, so one exporter can monitor a small fleet of
+// gateways.
+type inventory map[string]map[string]string
+
+var inventoryNamePattern = regexp.MustCompile(`^[a-zA-Z0-9\._-]+$`)
+
+// loadInventory reads the inventory from --inventory. Instance names must be
+// unique across the hosts, as instances are told apart by their name
+// everywhere but in the host label, e.g. in the config, the API and events.
+func loadInventory(path string) (inventory, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var hosts inventory
+	if err := yaml.Unmarshal(data, &hosts); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+	seen := map[string]string{}
+	for _, host := range hosts.sorted() {
+		if !inventoryNamePattern.MatchString(host) {
+			return nil, fmt.Errorf("invalid host %q in %s", host, path)
+		}
+		for instance, sock := range hosts[host] {
+			if !inventoryNamePattern.MatchString(instance) || sock == "" {
+				return nil, fmt.Errorf("invalid instance %q of host %s in %s", instance, host, path)
+			}
+			if other, ok := seen[instance]; ok {
+				return nil, fmt.Errorf("instance %s of host %s in %s is also on host %s", instance, host, path, other)
+			}
+			seen[instance] = host
+		}
+	}
+	return hosts, nil
+}
+
+// sorted returns the hosts of the inventory in order.
+func (hosts inventory) sorted() []string {
+	names := make([]string, 0, len(hosts))
+	for host := range hosts {
+		names = append(names, host)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func writeInventory(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "inventory.yml")
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadInventory(t *testing.T) {
+	hosts, err := loadInventory(writeInventory(t, `gw02:
+  dom2: /run/fastd/gw02-dom2.sock
+gw01:
+  dom0: tcp://gw01.example.net:9999
+  dom1: ssh://prometheus@gw01.example.net/run/fastd/dom1.sock
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want := []string{"gw01", "gw02"}; !reflect.DeepEqual(hosts.sorted(), want) {
+		t.Errorf("got hosts %v, want %v", hosts.sorted(), want)
+	}
+	if sock := hosts["gw01"]["dom1"]; sock != "ssh://prometheus@gw01.example.net/run/fastd/dom1.sock" {
+		t.Errorf("got status socket %s for dom1", sock)
+	}
+}
+
+func TestLoadInventoryInvalid(t *testing.T) {
+	for name, content := range map[string]string{
+		"host name":          "gw/01:\n  dom0: /run/fastd/dom0.sock\n",
+		"instance name":      "gw01:\n  dom 0: /run/fastd/dom0.sock\n",
+		"empty socket":       "gw01:\n  dom0: \"\"\n",
+		"duplicate instance": "gw01:\n  dom0: /run/fastd/dom0.sock\ngw02:\n  dom0: /run/fastd/dom0.sock\n",
+		"not a map":          "- gw01\n",
+	} {
+		if _, err := loadInventory(writeInventory(t, content)); err == nil {
+			t.Errorf("%s: invalid inventory was accepted", name)
+		}
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// snapshotJournal keeps the last --debug.snapshots raw status payloads of an
+// instance in a ring buffer.
+type snapshotJournal struct {
+	mutex   sync.Mutex
+	entries []journalEntry
+	// index of the oldest entry once the buffer is full
+	next int
+}
+
+type journalEntry struct {
+	Time   time.Time       `json:"time"`
+	Status json.RawMessage `json:"status"`
+}
+
+// record adds the payload of a status read, replacing the oldest one once
+// the journal is full.
+func (journal *snapshotJournal) record(data Message, readTime time.Time) {
+	if *debugSnapshots <= 0 || data.raw == nil {
+		return
+	}
+
+	journal.mutex.Lock()
+	defer journal.mutex.Unlock()
+
+	entry := journalEntry{Time: readTime, Status: data.raw}
+	if len(journal.entries) < *debugSnapshots {
+		journal.entries = append(journal.entries, entry)
+		return
+	}
+	journal.entries[journal.next] = entry
+	journal.next = (journal.next + 1) % len(journal.entries)
+}
+
+// snapshots returns the payloads in the journal, newest first.
+func (journal *snapshotJournal) snapshots() []journalEntry {
+	journal.mutex.Lock()
+	defer journal.mutex.Unlock()
+
+	entries := make([]journalEntry, 0, len(journal.entries))
+	for i := len(journal.entries) - 1; i >= 0; i-- {
+		entries = append(entries, journal.entries[(journal.next+i)%len(journal.entries)])
+	}
+	return entries
+}
+
+// snapshotsHandler serves /debug/snapshots/<instance> with the journal of
+// the instance.
+func snapshotsHandler(exporters []*PrometheusExporter) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		instance := strings.TrimPrefix(r.URL.Path, "/debug/snapshots/")
+		for _, exporter := range exporters {
+			if exporter.instance != instance {
+				continue
+			}
+
+			w.Header().Set("Content-Type", "application/json")
+			if err := json.NewEncoder(w).Encode(exporter.journal.snapshots()); err != nil {
+				log.Print(err)
+			}
+			return
+		}
+		http.Error(w, "unknown instance", http.StatusNotFound)
+	})
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// kafkaSink publishes events as JSON to a Kafka topic, keyed by instance so
+// the events of an instance stay in order.
+type kafkaSink struct {
+	writer *kafka.Writer
+}
+
+func newKafkaSink(brokers string, topic string) *kafkaSink {
+	return &kafkaSink{
+		writer: &kafka.Writer{
+			Addr:         kafka.TCP(strings.Split(brokers, ",")...),
+			Topic:        topic,
+			Balancer:     &kafka.Hash{},
+			RequiredAcks: kafka.RequireOne,
+		},
+	}
+}
+
+func (sink *kafkaSink) name() string {
+	return "kafka"
+}
+
+func (sink *kafkaSink) publish(ctx context.Context, events []Event) error {
+	messages := make([]kafka.Message, 0, len(events))
+	for _, event := range events {
+		value, err := json.Marshal(event)
+		if err != nil {
+			return err
+		}
+		messages = append(messages, kafka.Message{
+			Key:   []byte(event.Instance),
+			Value: value,
+			Time:  event.Time,
+		})
+	}
+
+	return sink.writer.WriteMessages(ctx, messages...)
+}
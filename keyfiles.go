@@ -0,0 +1,130 @@
+package main
+
+import (
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	secretPattern        = regexp.MustCompile(`secret\s+"([^"]*)"\s*;`)
+	secretKeyPattern     = regexp.MustCompile(`^[0-9a-fA-F]{64}$`)
+	configIncludePattern = regexp.MustCompile(`(?m)^\s*include\s+"([^"]+)"\s*;`)
+)
+
+// states of the peer files in fastd_peer_key_files
+const (
+	keyFileOK         = "ok"
+	keyFileUnreadable = "unreadable"
+	keyFileInvalid    = "invalid_key"
+	keyFileInsecure   = "insecure_permissions"
+)
+
+var keyFileStates = []string{keyFileOK, keyFileUnreadable, keyFileInvalid, keyFileInsecure}
+
+// keyFileHealth is what was found about the secret key and the peer key
+// files of an instance, the usual suspects when fastd does not come up
+// after a migration.
+type keyFileHealth struct {
+	// whether the config declares a valid secret key, and whether the file
+	// declaring it is protected from other users
+	secretValid  bool
+	secretSecure bool
+	// number of peer files by state
+	peerFiles map[string]int
+}
+
+// checkKeyFiles checks the secret key of a local fastd config and the peer
+// files in the peer directories of the config read from it.
+func checkKeyFiles(configPath string, data []byte) keyFileHealth {
+	health := keyFileHealth{peerFiles: map[string]int{}}
+
+	if secretPath, secret, ok := findSecret(configPath, 0); ok {
+		health.secretValid = secretKeyPattern.MatchString(secret)
+		if info, err := os.Stat(secretPath); err == nil {
+			// group read is fine for a fastd group, anything else is not
+			health.secretSecure = info.Mode().Perm()&0o027 == 0
+		}
+	}
+
+	for _, match := range peerIncludePattern.FindAllSubmatch(commentPattern.ReplaceAll(data, nil), -1) {
+		directory := resolveConfigPath(configPath, string(match[1]))
+		if !strings.HasSuffix(directory, "/") {
+			directory += "/"
+		}
+
+		names, err := listPeerDirectory(directory)
+		if err != nil {
+			continue
+		}
+		for _, name := range names {
+			// fastd skips hidden files and editor backups as well
+			if strings.HasPrefix(name, ".") || strings.HasSuffix(name, "~") {
+				continue
+			}
+			health.peerFiles[checkPeerFile(resolveConfigPath(directory, name))] += 1
+		}
+	}
+	return health
+}
+
+// checkPeerFile returns the state of a peer file. Peer files are public, but
+// whoever can write to them can replace the key of the peer.
+func checkPeerFile(path string) string {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return keyFileUnreadable
+	}
+	if _, _, ok := parsePeerConfig(path, data); !ok {
+		return keyFileInvalid
+	}
+	if info, err := os.Stat(path); err == nil && info.Mode().Perm()&0o002 != 0 {
+		return keyFileInsecure
+	}
+	return keyFileOK
+}
+
+// findSecret returns the file declaring the secret key of a fastd config,
+// following its includes, and the secret.
+func findSecret(path string, depth int) (string, string, bool) {
+	if depth > 10 {
+		return "", "", false
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", "", false
+	}
+	data = commentPattern.ReplaceAll(data, nil)
+	if match := secretPattern.FindSubmatch(data); match != nil {
+		return path, string(match[1]), true
+	}
+	for _, match := range configIncludePattern.FindAllSubmatch(data, -1) {
+		if secretPath, secret, ok := findSecret(resolveConfigPath(path, string(match[1])), depth+1); ok {
+			return secretPath, secret, true
+		}
+	}
+	return "", "", false
+}
+
+// collectKeyFiles exports the health of the key files of the instance, for
+// instances with a local fastd config.
+func (exporter *PrometheusExporter) collectKeyFiles(channel chan<- prometheus.Metric) {
+	if exporter.configPath == "" || isConfigURL(exporter.configPath) {
+		return
+	}
+
+	exporter.peerConfigMutex.Lock()
+	defer exporter.peerConfigMutex.Unlock()
+
+	if exporter.keyFiles.peerFiles == nil {
+		return
+	}
+	channel <- prometheus.MustNewConstMetric(exporter.secretKeyValid, prometheus.GaugeValue, boolToFloat64(exporter.keyFiles.secretValid))
+	channel <- prometheus.MustNewConstMetric(exporter.secretKeySecure, prometheus.GaugeValue, boolToFloat64(exporter.keyFiles.secretSecure))
+	for _, state := range keyFileStates {
+		channel <- prometheus.MustNewConstMetric(exporter.peerKeyFiles, prometheus.GaugeValue, float64(exporter.keyFiles.peerFiles[state]), state)
+	}
+}
@@ -0,0 +1,193 @@
+//go:build linux
+
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// l2tp generic netlink interface, see include/uapi/linux/l2tp.h
+const (
+	l2tpGenlName      = "l2tp"
+	l2tpCmdTunnelGet  = 4
+	l2tpCmdSessionGet = 8
+	l2tpAttrIfname    = 8
+	l2tpAttrConnID    = 9
+	l2tpAttrIPDaddr   = 25
+	l2tpAttrUDPDport  = 27
+	l2tpAttrIP6Daddr  = 32
+)
+
+var nativeEndian binary.ByteOrder = func() binary.ByteOrder {
+	i := uint16(1)
+	if *(*byte)(unsafe.Pointer(&i)) == 1 {
+		return binary.LittleEndian
+	}
+	return binary.BigEndian
+}()
+
+// lookupTunnelInterfaces maps the remote address of the kernel's l2tp tunnels,
+// formatted like fastd formats peer addresses, to the interface of the
+// tunnel's session. fastd sets those up for peers using the null@l2tp method.
+func lookupTunnelInterfaces() (map[string]string, error) {
+	fd, err := unix.Socket(unix.AF_NETLINK, unix.SOCK_RAW|unix.SOCK_CLOEXEC, unix.NETLINK_GENERIC)
+	if err != nil {
+		return nil, err
+	}
+	defer func(fd int) {
+		_ = unix.Close(fd)
+	}(fd)
+
+	if err = unix.Bind(fd, &unix.SockaddrNetlink{Family: unix.AF_NETLINK}); err != nil {
+		return nil, err
+	}
+
+	family, err := genlFamilyID(fd, l2tpGenlName)
+	if errors.Is(err, syscall.ENOENT) {
+		// l2tp module not loaded, so there are no tunnels
+		return map[string]string{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	tunnels, err := genlRequest(fd, family, l2tpCmdTunnelGet, unix.NLM_F_DUMP, nil)
+	if err != nil {
+		return nil, err
+	}
+	sessions, err := genlRequest(fd, family, l2tpCmdSessionGet, unix.NLM_F_DUMP, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	remotes := map[uint32]string{}
+	for _, attrs := range tunnels {
+		var ip net.IP
+		if addr, ok := attrs[l2tpAttrIP6Daddr]; ok && len(addr) == net.IPv6len {
+			ip = net.IP(addr)
+		} else if addr, ok := attrs[l2tpAttrIPDaddr]; ok && len(addr) == net.IPv4len {
+			ip = net.IP(addr)
+		}
+		connID, port := attrs[l2tpAttrConnID], attrs[l2tpAttrUDPDport]
+		if ip == nil || len(connID) != 4 || len(port) != 2 {
+			continue
+		}
+		remotes[nativeEndian.Uint32(connID)] = net.JoinHostPort(ip.String(), strconv.Itoa(int(nativeEndian.Uint16(port))))
+	}
+
+	interfaces := map[string]string{}
+	for _, attrs := range sessions {
+		connID, ifname := attrs[l2tpAttrConnID], attrs[l2tpAttrIfname]
+		if len(connID) != 4 || len(ifname) == 0 {
+			continue
+		}
+		if remote, ok := remotes[nativeEndian.Uint32(connID)]; ok {
+			interfaces[remote] = unix.ByteSliceToString(ifname)
+		}
+	}
+
+	return interfaces, nil
+}
+
+// genlFamilyID resolves the id of a generic netlink family by its name.
+func genlFamilyID(fd int, name string) (uint16, error) {
+	replies, err := genlRequest(fd, unix.GENL_ID_CTRL, unix.CTRL_CMD_GETFAMILY, 0, map[uint16][]byte{
+		unix.CTRL_ATTR_FAMILY_NAME: append([]byte(name), 0),
+	})
+	if err != nil {
+		return 0, fmt.Errorf("resolve generic netlink family %s: %w", name, err)
+	}
+
+	for _, attrs := range replies {
+		if id, ok := attrs[unix.CTRL_ATTR_FAMILY_ID]; ok && len(id) == 2 {
+			return nativeEndian.Uint16(id), nil
+		}
+	}
+	return 0, fmt.Errorf("generic netlink family %s not found", name)
+}
+
+// genlRequest sends a generic netlink request and returns the attributes of
+// all replies, which spans multiple messages for dump requests.
+func genlRequest(fd int, family uint16, cmd uint8, flags uint16, attrs map[uint16][]byte) ([]map[uint16][]byte, error) {
+	payload := []byte{cmd, 1, 0, 0}
+	for attrType, value := range attrs {
+		attr := make([]byte, unix.NLA_HDRLEN, nlaAlign(unix.NLA_HDRLEN+len(value)))
+		nativeEndian.PutUint16(attr[0:2], uint16(unix.NLA_HDRLEN+len(value)))
+		nativeEndian.PutUint16(attr[2:4], attrType)
+		attr = append(attr, value...)
+		payload = append(payload, attr[:cap(attr)]...)
+	}
+
+	request := make([]byte, unix.NLMSG_HDRLEN, unix.NLMSG_HDRLEN+len(payload))
+	nativeEndian.PutUint32(request[0:4], uint32(unix.NLMSG_HDRLEN+len(payload)))
+	nativeEndian.PutUint16(request[4:6], family)
+	nativeEndian.PutUint16(request[6:8], unix.NLM_F_REQUEST|unix.NLM_F_ACK|flags)
+	nativeEndian.PutUint32(request[8:12], 1)
+	request = append(request, payload...)
+
+	if err := unix.Sendto(fd, request, 0, &unix.SockaddrNetlink{Family: unix.AF_NETLINK}); err != nil {
+		return nil, err
+	}
+
+	var replies []map[uint16][]byte
+	buf := make([]byte, 64*1024)
+	for {
+		n, _, err := unix.Recvfrom(fd, buf, 0)
+		if err != nil {
+			return nil, err
+		}
+
+		messages, err := syscall.ParseNetlinkMessage(buf[:n])
+		if err != nil {
+			return nil, err
+		}
+
+		for _, message := range messages {
+			switch message.Header.Type {
+			case unix.NLMSG_DONE:
+				return replies, nil
+			case unix.NLMSG_ERROR:
+				if len(message.Data) < 4 {
+					return nil, errors.New("truncated netlink error")
+				}
+				if errno := int32(nativeEndian.Uint32(message.Data[0:4])); errno != 0 {
+					return nil, syscall.Errno(-errno)
+				}
+				// acknowledgement of a non-dump request
+				return replies, nil
+			default:
+				if len(message.Data) < unix.GENL_HDRLEN {
+					continue
+				}
+				replies = append(replies, parseNetlinkAttributes(message.Data[unix.GENL_HDRLEN:]))
+			}
+		}
+	}
+}
+
+func parseNetlinkAttributes(data []byte) map[uint16][]byte {
+	attrs := map[uint16][]byte{}
+	for len(data) >= unix.NLA_HDRLEN {
+		length := int(nativeEndian.Uint16(data[0:2]))
+		if length < unix.NLA_HDRLEN || length > len(data) {
+			break
+		}
+		attrs[nativeEndian.Uint16(data[2:4])&^(unix.NLA_F_NESTED|unix.NLA_F_NET_BYTEORDER)] = data[unix.NLA_HDRLEN:length]
+		if nlaAlign(length) >= len(data) {
+			break
+		}
+		data = data[nlaAlign(length):]
+	}
+	return attrs
+}
+
+func nlaAlign(length int) int {
+	return (length + unix.NLA_ALIGNTO - 1) &^ (unix.NLA_ALIGNTO - 1)
+}
@@ -0,0 +1,9 @@
+//go:build !linux
+
+package main
+
+import "errors"
+
+func lookupTunnelInterfaces() (map[string]string, error) {
+	return nil, errors.New("l2tp tunnel lookup is only supported on linux")
+}
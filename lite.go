@@ -0,0 +1,42 @@
+package main
+
+import (
+	"log"
+	"runtime/debug"
+)
+
+// applyLiteProfile turns off everything but the core metrics to keep the
+// memory footprint small on embedded gateways, overriding other flags.
+func applyLiteProfile() {
+	log.Print("Running in lite mode, enrichment, caching and optional subsystems are disabled")
+
+	*ipAsnLookupEnable = false
+	*ipAsnLookupCacheFile = ""
+	*geoipDatabasePath = ""
+	*ifaceLookupEnable = false
+	*stalledPolls = 0
+	*packetSizePerPeer = false
+	*peersByPrefixThreshold = 0
+	*scrapeMinInterval = 0
+	*tracingEndpoint = ""
+	*eventsKafkaBrokers = ""
+	*eventsNATSURL = ""
+	*exportDirectory = ""
+	*rollupsDirectory = ""
+	*snmpAgentXAddress = ""
+	*peerAPIURL = ""
+	*nodesJSONURL = ""
+	*consulKVPrefix = ""
+	*peerMetadataKeys = ""
+	*handshakeLogEnable = false
+	*fastdVersionBinary = ""
+	*debugSnapshots = 0
+	*txRatiosWindow = 0
+	*bridgeExpected = ""
+	*peersTrendWindow = 0
+	exporterConfig.Sites = nil
+	exporterConfig.Enrichers = nil
+
+	// trade some CPU for a smaller heap
+	debug.SetGCPercent(20)
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"fmt"
+	"math/bits"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// MaintenanceWindow is a recurring maintenance of an instance, starting at
+// the times matching the cron schedule.
+type MaintenanceWindow struct {
+	Schedule cronSchedule  `yaml:"schedule"`
+	Duration time.Duration `yaml:"duration"`
+}
+
+// cronSchedule is a schedule in the five field format of cron: minute,
+// hour, day of month, month and day of week, in local time.
+type cronSchedule struct {
+	minutes, hours, days, months, weekdays uint64
+	// like cron, either day field matches if both are restricted
+	anyDay, anyWeekday bool
+}
+
+// UnmarshalText parses a schedule like "0 3 * * 0" or "*/30 1-4 * * 1,3,5".
+func (schedule *cronSchedule) UnmarshalText(text []byte) error {
+	fields := strings.Fields(string(text))
+	if len(fields) != 5 {
+		return fmt.Errorf("invalid schedule %q: expected 5 fields", text)
+	}
+
+	ranges := [5][2]int{{0, 59}, {0, 23}, {1, 31}, {1, 12}, {0, 7}}
+	var sets [5]uint64
+	for i, field := range fields {
+		set, err := parseCronField(field, ranges[i][0], ranges[i][1])
+		if err != nil {
+			return fmt.Errorf("invalid schedule %q: %w", text, err)
+		}
+		sets[i] = set
+	}
+	// 7 is another name for sunday
+	if sets[4]&(1<<7) != 0 {
+		sets[4] |= 1
+	}
+
+	*schedule = cronSchedule{
+		minutes:    sets[0],
+		hours:      sets[1],
+		days:       sets[2],
+		months:     sets[3],
+		weekdays:   sets[4],
+		anyDay:     fields[2] == "*",
+		anyWeekday: fields[4] == "*",
+	}
+	return nil
+}
+
+// parseCronField parses a comma separated list of values, ranges and steps
+// like "*/15" or "1-5/2" into a bit set.
+func parseCronField(field string, min, max int) (uint64, error) {
+	var set uint64
+	for _, item := range strings.Split(field, ",") {
+		step := 1
+		if i := strings.Index(item, "/"); i >= 0 {
+			var err error
+			if step, err = strconv.Atoi(item[i+1:]); err != nil || step <= 0 {
+				return 0, fmt.Errorf("invalid step in %q", item)
+			}
+			item = item[:i]
+		}
+
+		low, high := min, max
+		if item != "*" {
+			bounds := strings.SplitN(item, "-", 2)
+			var err error
+			if low, err = strconv.Atoi(bounds[0]); err != nil {
+				return 0, fmt.Errorf("invalid value %q", item)
+			}
+			high = low
+			if len(bounds) == 2 {
+				if high, err = strconv.Atoi(bounds[1]); err != nil {
+					return 0, fmt.Errorf("invalid value %q", item)
+				}
+			}
+		}
+		if low < min || high > max || low > high {
+			return 0, fmt.Errorf("%q is out of range %d-%d", item, min, max)
+		}
+
+		for value := low; value <= high; value += step {
+			set |= 1 << value
+		}
+	}
+	return set, nil
+}
+
+// matches reports whether the schedule matches the minute of t.
+func (schedule cronSchedule) matches(t time.Time) bool {
+	return schedule.minutes&(1<<t.Minute()) != 0 && schedule.hours&(1<<t.Hour()) != 0 && schedule.matchesDay(t)
+}
+
+// matchesDay reports whether the schedule matches the day of t.
+func (schedule cronSchedule) matchesDay(t time.Time) bool {
+	if schedule.months&(1<<int(t.Month())) == 0 {
+		return false
+	}
+
+	day := schedule.days&(1<<t.Day()) != 0
+	weekday := schedule.weekdays&(1<<int(t.Weekday())) != 0
+	if schedule.anyDay || schedule.anyWeekday {
+		return day && weekday
+	}
+	return day || weekday
+}
+
+// previous returns the last minute at or before t matching the schedule,
+// looking back no further than limit. Days and hours that do not match are
+// skipped as a whole.
+func (schedule cronSchedule) previous(t time.Time, limit time.Duration) (time.Time, bool) {
+	start := t.Truncate(time.Minute)
+	for match := start; t.Sub(match) < limit || match.Equal(start); {
+		year, month, day := match.Date()
+		dayStart := time.Date(year, month, day, 0, 0, 0, 0, match.Location())
+		hourStart := time.Date(year, month, day, match.Hour(), 0, 0, 0, match.Location())
+
+		switch {
+		case !schedule.matchesDay(match):
+			match = dayStart.Add(-time.Minute)
+		case schedule.hours&(1<<match.Hour()) == 0:
+			match = hourStart.Add(-time.Minute)
+		case schedule.minutes&(1<<match.Minute()) == 0:
+			// the closest earlier minute of the hour, if any
+			earlier := schedule.minutes & (1<<match.Minute() - 1)
+			if earlier == 0 {
+				match = hourStart.Add(-time.Minute)
+			} else {
+				match = hourStart.Add(time.Duration(bits.Len64(earlier)-1) * time.Minute)
+			}
+		default:
+			return match, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// active reports whether the window started within its duration before now.
+func (window MaintenanceWindow) active(now time.Time) bool {
+	_, ok := window.Schedule.previous(now, window.Duration)
+	return ok
+}
+
+// inMaintenance reports whether the instance is in a maintenance window of
+// the config or one started through the API.
+func (exporter *PrometheusExporter) inMaintenance(now time.Time) bool {
+	for _, window := range exporterConfig.Instances[exporter.instance].Maintenance {
+		if window.active(now) {
+			return true
+		}
+	}
+
+	exporter.mutex.Lock()
+	defer exporter.mutex.Unlock()
+
+	return now.Before(exporter.maintenanceUntil)
+}
+
+// startMaintenance starts a maintenance window of the given duration, 0 ends
+// the current one.
+func (exporter *PrometheusExporter) startMaintenance(duration time.Duration) {
+	exporter.mutex.Lock()
+	defer exporter.mutex.Unlock()
+
+	exporter.maintenanceUntil = time.Now().Add(duration)
+}
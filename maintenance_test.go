@@ -0,0 +1,99 @@
+package main
+
+import (
+	"math/rand"
+	"testing"
+	"time"
+)
+
+func mustSchedule(t *testing.T, text string) cronSchedule {
+	t.Helper()
+	var schedule cronSchedule
+	if err := schedule.UnmarshalText([]byte(text)); err != nil {
+		t.Fatal(err)
+	}
+	return schedule
+}
+
+func TestCronScheduleMatches(t *testing.T) {
+	// a monday
+	monday := time.Date(2024, time.March, 4, 4, 30, 0, 0, time.UTC)
+	for _, test := range []struct {
+		schedule string
+		time     time.Time
+		want     bool
+	}{
+		{"30 4 * * *", monday, true},
+		{"31 4 * * *", monday, false},
+		{"*/15 * * * *", monday, true},
+		{"*/20 * * * *", monday, false},
+		{"0-59/10 1-4 * * *", monday, true},
+		{"30 4 * * 1", monday, true},
+		{"30 4 * * 0,7", monday, false},
+		{"30 4 * * 7", monday.AddDate(0, 0, 6), true},
+		{"30 4 * 2 *", monday, false},
+		// either day field matches if both are restricted
+		{"30 4 1 * 1", monday, true},
+		{"30 4 4 * 0", monday, true},
+		{"30 4 1 * 0", monday, false},
+	} {
+		if got := mustSchedule(t, test.schedule).matches(test.time); got != test.want {
+			t.Errorf("%q matches %s: got %v, want %v", test.schedule, test.time, got, test.want)
+		}
+	}
+}
+
+func TestCronScheduleInvalid(t *testing.T) {
+	for _, text := range []string{"", "* * * *", "60 * * * *", "* 24 * * *", "* * 0 * *", "* * * 13 *", "* * * * 8", "*/0 * * * *", "5-1 * * * *", "a * * * *"} {
+		var schedule cronSchedule
+		if err := schedule.UnmarshalText([]byte(text)); err == nil {
+			t.Errorf("invalid schedule %q was accepted", text)
+		}
+	}
+}
+
+func TestMaintenanceWindowActive(t *testing.T) {
+	window := MaintenanceWindow{Schedule: mustSchedule(t, "0 4 * * 1"), Duration: 30 * time.Minute}
+	start := time.Date(2024, time.March, 4, 4, 0, 0, 0, time.UTC)
+	for offset, want := range map[time.Duration]bool{
+		-time.Second:     false,
+		0:                true,
+		29 * time.Minute: true,
+		30 * time.Minute: false,
+		24 * time.Hour:   false,
+	} {
+		if got := window.active(start.Add(offset)); got != want {
+			t.Errorf("active %s after the start: got %v, want %v", offset, got, want)
+		}
+	}
+}
+
+// TestCronSchedulePrevious compares previous with walking back minute by
+// minute.
+func TestCronSchedulePrevious(t *testing.T) {
+	random := rand.New(rand.NewSource(1))
+	schedules := []string{"0 4 * * 1", "*/7 3-5 * * *", "15 0 1,15 * *", "0 12 * * 0", "45 23 31 * *", "0 0 29 2 *", "* * * * *", "30 2 * 3 0"}
+	start := time.Date(2024, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+	for _, text := range schedules {
+		schedule := mustSchedule(t, text)
+		for i := 0; i < 50; i++ {
+			now := start.Add(time.Duration(random.Int63n(int64(400 * 24 * time.Hour))))
+			limit := time.Duration(random.Int63n(int64(10 * 24 * time.Hour)))
+
+			var want time.Time
+			first := now.Truncate(time.Minute)
+			for minute := first; now.Sub(minute) < limit || minute.Equal(first); minute = minute.Add(-time.Minute) {
+				if schedule.matches(minute) {
+					want = minute
+					break
+				}
+			}
+
+			got, ok := schedule.previous(now, limit)
+			if ok != !want.IsZero() || !got.Equal(want) {
+				t.Errorf("%q before %s within %s: got %s, want %s", text, now, limit, got, want)
+			}
+		}
+	}
+}
@@ -0,0 +1,23 @@
+package main
+
+import (
+	"net/http"
+	"net/http/pprof"
+)
+
+// managementMux returns the mux for the operational endpoints, which are
+// served on --web.management-address if given and along with the metrics
+// otherwise. The profiler is only served on a management address.
+func managementMux(public *http.ServeMux) *http.ServeMux {
+	if *webManagementAddress == "" {
+		return public
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	return mux
+}
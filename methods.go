@@ -0,0 +1,20 @@
+package main
+
+import "strings"
+
+// methodComponents splits a fastd method like "salsa2012+umac" or
+// "null@l2tp" into its cipher, its message authentication and the offload
+// after the @. Methods consisting of a single part, like "null" or
+// "aes128-gcm", have no separate MAC.
+func methodComponents(method string) (cipher, mac, offload string) {
+	if i := strings.LastIndex(method, "@"); i >= 0 {
+		method, offload = method[:i], method[i+1:]
+	}
+	cipher = method
+	if i := strings.Index(method, "+"); i >= 0 {
+		// composed methods like "null+salsa2012+umac" authenticate with the
+		// remaining parts
+		cipher, mac = method[:i], method[i+1:]
+	}
+	return cipher, mac, offload
+}
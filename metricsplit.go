@@ -0,0 +1,126 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// exporterRegistries holds the exporters of a metrics endpoint three times:
+// with all their metrics, with the instance metrics only and with the per
+// peer metrics only. Large supernodes can scrape the instance metrics often
+// and the per peer metrics rarely, and reading the instance metrics skips
+// the work for the per peer metrics.
+type exporterRegistries struct {
+	all       *prometheus.Registry
+	instances *prometheus.Registry
+	peers     *prometheus.Registry
+}
+
+// defaultExporterRegistries holds the exporters served on
+// --web.listen-address.
+var defaultExporterRegistries = newExporterRegistries()
+
+func newExporterRegistries() *exporterRegistries {
+	return &exporterRegistries{
+		all:       prometheus.NewRegistry(),
+		instances: prometheus.NewRegistry(),
+		peers:     prometheus.NewRegistry(),
+	}
+}
+
+func (registries *exporterRegistries) register(exporter *PrometheusExporter) error {
+	if err := registries.all.Register(exporter); err != nil {
+		return err
+	}
+	peerDescs := exporter.peerDescs()
+	registries.instances.MustRegister(exporterView{exporter: exporter, peerDescs: peerDescs, peers: false})
+	registries.peers.MustRegister(exporterView{exporter: exporter, peerDescs: peerDescs, peers: true})
+	return nil
+}
+
+// exporterRegistries returns the registries the instance is served from.
+func (exporter *PrometheusExporter) exporterRegistries() *exporterRegistries {
+	if exporter.registries != nil {
+		return exporter.registries
+	}
+	return defaultExporterRegistries
+}
+
+// peerDescs returns the descriptors of the per peer metrics.
+func (exporter *PrometheusExporter) peerDescs() map[*prometheus.Desc]bool {
+	descs := map[*prometheus.Desc]bool{}
+	for _, desc := range []*prometheus.Desc{
+		exporter.peerUp, exporter.peerUptime, exporter.criticalPeerUp,
+		exporter.peerInfo, exporter.peerInterfaceInfo, exporter.peerStalled,
+		exporter.peerRemoteResolved, exporter.peerRemoteAddresses,
+		exporter.peerThroughputMin, exporter.peerThroughputMax,
+		exporter.peerRegistryInfo, exporter.peerTagInfo, exporter.peerLastHandshake,
+		exporter.peerMetadataInfo, exporter.peerMethod, exporter.peerMethodDetail,
+		exporter.peerFloating, exporter.peerAveragePacketSize,
+		exporter.peerRxPackets, exporter.peerRxBytes, exporter.peerRxReorderedPackets, exporter.peerRxReorderedBytes,
+		exporter.peerTxPackets, exporter.peerTxBytes, exporter.peerTxDroppedPackets, exporter.peerTxDroppedBytes,
+		exporter.peerTxErrorPackets, exporter.peerTxErrorBytes,
+	} {
+		descs[desc] = true
+	}
+	for _, desc := range exporter.enricherInfo {
+		descs[desc] = true
+	}
+	return descs
+}
+
+// exporterView is either the instance metrics or the per peer metrics of an
+// exporter.
+type exporterView struct {
+	exporter  *PrometheusExporter
+	peerDescs map[*prometheus.Desc]bool
+	peers     bool
+}
+
+func (view exporterView) Describe(channel chan<- *prometheus.Desc) {
+	descs := make(chan *prometheus.Desc)
+	go func() {
+		view.exporter.Describe(descs)
+		close(descs)
+	}()
+	for desc := range descs {
+		if view.peerDescs[desc] == view.peers {
+			channel <- desc
+		}
+	}
+}
+
+func (view exporterView) Collect(channel chan<- prometheus.Metric) {
+	metrics := make(chan prometheus.Metric)
+	go func() {
+		view.exporter.collect(metrics, view.peers)
+		close(metrics)
+	}()
+	for metric := range metrics {
+		if view.peerDescs[metric.Desc()] == view.peers {
+			channel <- metric
+		}
+	}
+}
+
+// handleMetrics serves the metrics of a gatherer along with those of the
+// exporters in the registries under --web.telemetry-path, and split into
+// the instance metrics under /fast and the per peer metrics under /full
+// below it. The instance is given for instances with a listen address of
+// their own.
+func handleMetrics(mux *http.ServeMux, instance string, exporters []*PrometheusExporter, registries *exporterRegistries, registerer prometheus.Registerer, gatherer prometheus.Gatherer) {
+	handler := func(gatherer prometheus.Gatherer) http.Handler {
+		return refreshHandler(exporters, promhttp.InstrumentMetricHandler(
+			registerer,
+			promhttp.HandlerFor(gatherer, promhttp.HandlerOpts{
+				MaxRequestsInFlight: *webMaxRequests,
+			}),
+		))
+	}
+
+	mux.Handle(*webMetricsPath, instrumentInstanceHandler("metrics", instance, handler(prometheus.Gatherers{gatherer, registries.all})))
+	mux.Handle(*webMetricsPath+"/fast", instrumentInstanceHandler("metrics_fast", instance, handler(prometheus.Gatherers{gatherer, registries.instances})))
+	mux.Handle(*webMetricsPath+"/full", instrumentInstanceHandler("metrics_full", instance, handler(registries.peers)))
+}
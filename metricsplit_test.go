@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// testExporter returns an exporter reading a synthetic status with the
+// given number of peers, without lookups that would leave the test.
+func testExporter(t *testing.T, peers int) *PrometheusExporter {
+	t.Helper()
+	asnLookup, interfaceLookup, versionBinary := *ipAsnLookupEnable, *ifaceLookupEnable, *fastdVersionBinary
+	*ipAsnLookupEnable, *ifaceLookupEnable, *fastdVersionBinary = false, false, ""
+	t.Cleanup(func() {
+		*ipAsnLookupEnable, *ifaceLookupEnable, *fastdVersionBinary = asnLookup, interfaceLookup, versionBinary
+	})
+
+	statusFile := filepath.Join(t.TempDir(), "status.json")
+	data, err := json.Marshal(benchStatus(peers, 0.5))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(statusFile, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return NewPrometheusExporter("dom0", fastdConfig{statusSocketPath: statusFileScheme + statusFile})
+}
+
+// familyNames gathers a registry and returns the names of its families.
+func familyNames(t *testing.T, gatherer prometheus.Gatherer) map[string]bool {
+	t.Helper()
+	families, err := gatherer.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := map[string]bool{}
+	for _, family := range families {
+		names[family.GetName()] = true
+	}
+	return names
+}
+
+func TestExporterRegistriesSplit(t *testing.T) {
+	registries := newExporterRegistries()
+	if err := registries.register(testExporter(t, 10)); err != nil {
+		t.Fatal(err)
+	}
+
+	all := familyNames(t, registries.all)
+	instances := familyNames(t, registries.instances)
+	peers := familyNames(t, registries.peers)
+	if !peers["fastd_peer_up"] || !instances["fastd_peers_up_total"] {
+		t.Fatalf("got instance metrics %v and per peer metrics %v", instances, peers)
+	}
+	for name := range all {
+		if instances[name] == peers[name] {
+			t.Errorf("%s is in the instance metrics %v, in the per peer metrics %v", name, instances[name], peers[name])
+		}
+	}
+	if len(instances)+len(peers) != len(all) {
+		t.Errorf("got %d instance and %d per peer families, want %d together", len(instances), len(peers), len(all))
+	}
+}
+
+func TestCollectWithoutPeerMetrics(t *testing.T) {
+	exporter := testExporter(t, 10)
+	peerDescs := exporter.peerDescs()
+
+	metrics := make(chan prometheus.Metric)
+	go func() {
+		exporter.collect(metrics, false)
+		close(metrics)
+	}()
+	var peersUp dto.Metric
+	for metric := range metrics {
+		if peerDescs[metric.Desc()] {
+			t.Errorf("per peer metric %s was collected", metric.Desc())
+		}
+		if metric.Desc() == exporter.peersUpTotal {
+			if err := metric.Write(&peersUp); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	// the peers still count for the aggregates
+	if got := peersUp.GetGauge().GetValue(); got != 5 {
+		t.Errorf("got %v connected peers, want 5", got)
+	}
+}
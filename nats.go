@@ -0,0 +1,43 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/nats-io/nats.go"
+)
+
+// natsSink publishes events as JSON to a NATS subject per instance.
+type natsSink struct {
+	conn            *nats.Conn
+	subjectTemplate string
+}
+
+func newNATSSink(url string, subjectTemplate string) (*natsSink, error) {
+	// keep reconnecting for as long as the exporter runs
+	conn, err := nats.Connect(url, nats.Name("fastd-exporter"), nats.MaxReconnects(-1), nats.RetryOnFailedConnect(true))
+	if err != nil {
+		return nil, err
+	}
+
+	return &natsSink{conn: conn, subjectTemplate: subjectTemplate}, nil
+}
+
+func (sink *natsSink) name() string {
+	return "nats"
+}
+
+func (sink *natsSink) publish(ctx context.Context, events []Event) error {
+	for _, event := range events {
+		value, err := json.Marshal(event)
+		if err != nil {
+			return err
+		}
+		if err = sink.conn.Publish(fmt.Sprintf(sink.subjectTemplate, event.Instance), value); err != nil {
+			return err
+		}
+	}
+
+	return sink.conn.FlushWithContext(ctx)
+}
@@ -0,0 +1,58 @@
+//go:build linux
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"runtime"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// netnsPath returns the path of a network namespace given by its name, as
+// created by ip netns add, or by its path, e.g. /proc/<pid>/ns/net.
+func netnsPath(netns string) string {
+	if strings.Contains(netns, "/") {
+		return netns
+	}
+	return "/run/netns/" + netns
+}
+
+// dialInNetns dials in the given network namespace. The connection stays in
+// that namespace after the thread switched back.
+func dialInNetns(netns string, dial func() (net.Conn, error)) (net.Conn, error) {
+	target, err := os.Open(netnsPath(netns))
+	if err != nil {
+		return nil, err
+	}
+	defer target.Close()
+
+	runtime.LockOSThread()
+	current, err := os.Open(fmt.Sprintf("/proc/self/task/%d/ns/net", unix.Gettid()))
+	if err != nil {
+		runtime.UnlockOSThread()
+		return nil, err
+	}
+	defer current.Close()
+
+	if err := unix.Setns(int(target.Fd()), unix.CLONE_NEWNET); err != nil {
+		runtime.UnlockOSThread()
+		return nil, fmt.Errorf("failed to enter network namespace %s: %w", netns, err)
+	}
+
+	conn, dialErr := dial()
+
+	if err := unix.Setns(int(current.Fd()), unix.CLONE_NEWNET); err != nil {
+		// the thread stays locked, so it is terminated instead of being
+		// reused in the wrong namespace
+		if conn != nil {
+			_ = conn.Close()
+		}
+		return nil, fmt.Errorf("failed to leave network namespace %s: %w", netns, err)
+	}
+	runtime.UnlockOSThread()
+	return conn, dialErr
+}
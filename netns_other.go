@@ -0,0 +1,12 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"net"
+)
+
+func dialInNetns(netns string, dial func() (net.Conn, error)) (net.Conn, error) {
+	return nil, errors.New("network namespaces are only supported on linux")
+}
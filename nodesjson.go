@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var nodesJSONFailures = prometheus.NewCounter(prometheus.CounterOpts{
+	Name: prefixWrapper("nodes_json_failures_total"),
+	Help: "number of failed fetches of the nodes.json",
+})
+
+// nodesJSONReleases holds the firmware releases of the nodes in the
+// nodes.json given by --nodes-json.url, keyed by their fastd public key and
+// by the MAC addresses of their mesh VPN interfaces.
+var nodesJSONReleases = struct {
+	sync.Mutex
+	byPublicKey map[string]string
+	byMAC       map[string]string
+}{}
+
+var nodesJSONClient *http.Client
+
+// nodeInfo holds the parts of the respondd nodeinfo of a Gluon node that are
+// used to match it to a peer.
+type nodeInfo struct {
+	Software struct {
+		Firmware struct {
+			Release string `json:"release"`
+		} `json:"firmware"`
+		Fastd struct {
+			PublicKey string `json:"public_key"`
+		} `json:"fastd"`
+	} `json:"software"`
+	Network struct {
+		Mesh map[string]struct {
+			Interfaces struct {
+				Tunnel []string `json:"tunnel"`
+			} `json:"interfaces"`
+		} `json:"mesh"`
+	} `json:"network"`
+}
+
+// setupNodesJSON validates the nodes.json settings. Requests go through the
+// enrichment proxy, if any.
+func setupNodesJSON() error {
+	if *nodesJSONURL == "" {
+		return nil
+	}
+	if !strings.HasPrefix(*nodesJSONURL, "http://") && !strings.HasPrefix(*nodesJSONURL, "https://") {
+		return fmt.Errorf("nodes.json URL %s is not an HTTP(S) URL", *nodesJSONURL)
+	}
+
+	nodesJSONClient = &http.Client{
+		Timeout:   *nodesJSONInterval,
+		Transport: &http.Transport{DialContext: enrichmentDialer.DialContext},
+	}
+	prometheus.MustRegister(nodesJSONFailures)
+	return nil
+}
+
+// runNodesJSON fetches the nodes.json every --nodes-json.interval. Failed
+// fetches keep the releases of the previous one.
+func runNodesJSON() {
+	ticker := time.NewTicker(*nodesJSONInterval)
+	defer ticker.Stop()
+
+	for {
+		if err := fetchNodesJSON(); err != nil {
+			logRepeated("Failed to fetch nodes.json from %s: %v", *nodesJSONURL, err)
+			nodesJSONFailures.Inc()
+		}
+		<-ticker.C
+	}
+}
+
+// fetchNodesJSON fetches the nodes.json and replaces the known releases.
+// Both the nodes.json of meshviewer and ffmap-backend, with the nodes in a
+// list, and the older one with the nodes in an object are understood.
+func fetchNodesJSON() error {
+	ctx, cancel := context.WithTimeout(context.Background(), *nodesJSONInterval)
+	defer cancel()
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, *nodesJSONURL, nil)
+	if err != nil {
+		return err
+	}
+	response, err := nodesJSONClient.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %s", response.Status)
+	}
+
+	var document struct {
+		Nodes json.RawMessage `json:"nodes"`
+	}
+	if err := json.NewDecoder(response.Body).Decode(&document); err != nil {
+		return err
+	}
+
+	type node struct {
+		NodeInfo nodeInfo `json:"nodeinfo"`
+	}
+	var nodes []node
+	if err := json.Unmarshal(document.Nodes, &nodes); err != nil {
+		byID := map[string]node{}
+		if err := json.Unmarshal(document.Nodes, &byID); err != nil {
+			return fmt.Errorf("no nodes list or object: %v", err)
+		}
+		for _, node := range byID {
+			nodes = append(nodes, node)
+		}
+	}
+
+	byPublicKey, byMAC := map[string]string{}, map[string]string{}
+	for _, node := range nodes {
+		release := node.NodeInfo.Software.Firmware.Release
+		if release == "" {
+			continue
+		}
+		if publicKey := node.NodeInfo.Software.Fastd.PublicKey; publicKey != "" {
+			byPublicKey[strings.ToLower(publicKey)] = release
+		}
+		for _, mesh := range node.NodeInfo.Network.Mesh {
+			for _, mac := range mesh.Interfaces.Tunnel {
+				byMAC[strings.ToLower(mac)] = release
+			}
+		}
+	}
+
+	nodesJSONReleases.Lock()
+	defer nodesJSONReleases.Unlock()
+	nodesJSONReleases.byPublicKey, nodesJSONReleases.byMAC = byPublicKey, byMAC
+	return nil
+}
+
+// peerRelease returns the firmware release the node of a peer reports in the
+// nodes.json, "unknown" if it is not listed.
+func peerRelease(publicKey string, peer Peer) string {
+	nodesJSONReleases.Lock()
+	defer nodesJSONReleases.Unlock()
+
+	if release, ok := nodesJSONReleases.byPublicKey[publicKey]; ok {
+		return release
+	}
+	for _, mac := range peer.MAC {
+		if release, ok := nodesJSONReleases.byMAC[strings.ToLower(mac)]; ok {
+			return release
+		}
+	}
+	return "unknown"
+}
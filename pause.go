@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+type pauseState struct {
+	Instance    string     `json:"instance"`
+	Paused      bool       `json:"paused"`
+	Until       *time.Time `json:"until,omitempty"`
+	Maintenance bool       `json:"maintenance"`
+}
+
+// pauseHandler serves /api/v1/instances/<instance>/pause and .../resume.
+// Collection of a paused instance is skipped until it is resumed or the
+// optional duration given as ?duration=30m has passed. It also serves
+// .../maintenance, where POST starts a maintenance window of the given
+// duration and DELETE ends it.
+func pauseHandler(exporters []*PrometheusExporter) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/api/v1/instances/"), "/")
+		if len(parts) != 2 || (parts[1] != "pause" && parts[1] != "resume" && parts[1] != "maintenance") {
+			http.NotFound(w, r)
+			return
+		}
+		if r.Method != http.MethodPost && !(r.Method == http.MethodDelete && parts[1] == "maintenance") {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var duration time.Duration
+		if value := r.URL.Query().Get("duration"); value != "" && parts[1] != "resume" {
+			var err error
+			if duration, err = time.ParseDuration(value); err != nil || duration <= 0 {
+				http.Error(w, "invalid duration", http.StatusBadRequest)
+				return
+			}
+		}
+		if parts[1] == "maintenance" && r.Method == http.MethodPost && duration == 0 {
+			http.Error(w, "maintenance requires a duration", http.StatusBadRequest)
+			return
+		}
+
+		for _, exporter := range exporters {
+			if exporter.instance != parts[0] {
+				continue
+			}
+
+			switch {
+			case parts[1] == "pause":
+				exporter.pause(duration)
+				log.Printf("Paused collection of %s", exporter.instance)
+			case parts[1] == "resume":
+				exporter.resume()
+				log.Printf("Resumed collection of %s", exporter.instance)
+			case r.Method == http.MethodPost:
+				exporter.startMaintenance(duration)
+				log.Printf("Started maintenance of %s for %s", exporter.instance, duration)
+			default:
+				exporter.startMaintenance(0)
+				log.Printf("Ended maintenance of %s", exporter.instance)
+			}
+
+			w.Header().Set("Content-Type", "application/json")
+			if err := json.NewEncoder(w).Encode(exporter.pauseState()); err != nil {
+				log.Print(err)
+			}
+			return
+		}
+		http.Error(w, "unknown instance", http.StatusNotFound)
+	})
+}
+
+// pause skips the collection of the instance, for the given duration or
+// until it is resumed if the duration is 0.
+func (exporter *PrometheusExporter) pause(duration time.Duration) {
+	exporter.mutex.Lock()
+	defer exporter.mutex.Unlock()
+
+	exporter.paused = true
+	exporter.pausedUntil = time.Time{}
+	if duration > 0 {
+		exporter.pausedUntil = time.Now().Add(duration)
+	}
+}
+
+func (exporter *PrometheusExporter) resume() {
+	exporter.mutex.Lock()
+	defer exporter.mutex.Unlock()
+
+	exporter.paused = false
+}
+
+// isPaused reports whether the collection of the instance is paused.
+func (exporter *PrometheusExporter) isPaused() bool {
+	exporter.mutex.Lock()
+	defer exporter.mutex.Unlock()
+
+	if exporter.paused && !exporter.pausedUntil.IsZero() && time.Now().After(exporter.pausedUntil) {
+		exporter.paused = false
+	}
+	return exporter.paused
+}
+
+func (exporter *PrometheusExporter) pauseState() pauseState {
+	state := pauseState{Instance: exporter.instance, Paused: exporter.isPaused(), Maintenance: exporter.inMaintenance(time.Now())}
+
+	exporter.mutex.Lock()
+	defer exporter.mutex.Unlock()
+
+	if state.Paused && !exporter.pausedUntil.IsZero() {
+		until := exporter.pausedUntil
+		state.Until = &until
+	}
+	return state
+}
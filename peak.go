@@ -0,0 +1,65 @@
+package main
+
+import (
+	"time"
+)
+
+// peakBuckets is the number of buckets the rolling window of the peak is
+// divided into.
+const peakBuckets = 60
+
+// peakTracker tracks the maximum number of connected peers since the start
+// of the exporter and within a rolling window, from every status read
+// including those of the poller.
+type peakTracker struct {
+	total int
+	// maxima of consecutive slices of the window, the last one is current
+	buckets []peakBucket
+}
+
+type peakBucket struct {
+	start time.Time
+	max   int
+}
+
+// record adds the number of connected peers seen at a status read.
+func (tracker *peakTracker) record(peers int, readTime time.Time, window time.Duration) {
+	if peers > tracker.total {
+		tracker.total = peers
+	}
+
+	width := window / peakBuckets
+	last := len(tracker.buckets) - 1
+	if last < 0 || readTime.Sub(tracker.buckets[last].start) >= width {
+		tracker.buckets = append(tracker.buckets, peakBucket{start: readTime, max: peers})
+	} else if peers > tracker.buckets[last].max {
+		tracker.buckets[last].max = peers
+	}
+
+	expired := 0
+	for expired < len(tracker.buckets)-1 && readTime.Sub(tracker.buckets[expired].start) > window {
+		expired += 1
+	}
+	tracker.buckets = tracker.buckets[expired:]
+}
+
+// windowPeak returns the maximum number of connected peers within the
+// window.
+func (tracker *peakTracker) windowPeak() int {
+	peak := 0
+	for _, bucket := range tracker.buckets {
+		if bucket.max > peak {
+			peak = bucket.max
+		}
+	}
+	return peak
+}
+
+// recordPeersUp adds the number of connected peers at a status read to the
+// peaks of the instance.
+func (exporter *PrometheusExporter) recordPeersUp(peers int, readTime time.Time) {
+	exporter.peakMutex.Lock()
+	defer exporter.peakMutex.Unlock()
+
+	exporter.peak.record(peers, readTime, *peakWindow)
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// sanitizePeerName makes a peer name safe to use as label value: invalid
+// UTF-8 and control characters are replaced and names longer than
+// --peer-name.max-length characters are truncated.
+func sanitizePeerName(name string) string {
+	sanitized := strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return utf8.RuneError
+		}
+		return r
+	}, strings.ToValidUTF8(name, string(utf8.RuneError)))
+
+	if *peerNameMaxLength > 0 && utf8.RuneCountInString(sanitized) > *peerNameMaxLength {
+		sanitized = string([]rune(sanitized)[:*peerNameMaxLength])
+	}
+	return sanitized
+}
+
+// peerNamePseudonym returns a pseudonym for a peer name that stays the same
+// as long as the name and --peer-name.pseudonym-key do not change, and that
+// cannot be reversed with a list of likely names without the key.
+func peerNamePseudonym(name string) string {
+	if name == "" {
+		return ""
+	}
+	mac := hmac.New(sha256.New, []byte(*peerNamePseudonymKey))
+	mac.Write([]byte(name))
+	return "peer-" + hex.EncodeToString(mac.Sum(nil))[:16]
+}
+
+// publicPeerName returns the name of a peer as shown outside of labels, by
+// the APIs, events, exports and rollups: its pseudonym with
+// --peer-name.pseudonym-key, otherwise the name itself.
+func publicPeerName(name string) string {
+	if *peerNamePseudonymKey != "" {
+		return peerNamePseudonym(name)
+	}
+	return name
+}
+
+// labelPeerName returns the label value of a peer name: its pseudonym with
+// --peer-name.pseudonym-key, otherwise the sanitized name.
+func labelPeerName(name string) string {
+	if *peerNamePseudonymKey != "" {
+		return peerNamePseudonym(name)
+	}
+	return sanitizePeerName(name)
+}
+
+// peerName returns the label value of the name of a peer, which is only
+// derived again when fastd reports a different name. Names that had to be
+// sanitized are counted.
+func (exporter *PrometheusExporter) peerName(peer Peer, state *peerState) string {
+	if state.name != peer.Name {
+		state.name = peer.Name
+		state.sanitizedName = labelPeerName(peer.Name)
+		if sanitizePeerName(peer.Name) != peer.Name {
+			exporter.sanitizedNames += 1
+		}
+	}
+	return state.sanitizedName
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestPeerNamePseudonym(t *testing.T) {
+	name := "node\x00" + strings.Repeat("a", 100)
+	if got := labelPeerName(name); got != "node�"+strings.Repeat("a", 59) {
+		t.Errorf("got label %q without a key, want the sanitized name", got)
+	}
+	if got := publicPeerName(name); got != name {
+		t.Errorf("got %q without a key, want the name", got)
+	}
+
+	*peerNamePseudonymKey = "secret"
+	t.Cleanup(func() { *peerNamePseudonymKey = "" })
+	pseudonym := peerNamePseudonym(name)
+	if !strings.HasPrefix(pseudonym, "peer-") || labelPeerName(name) != pseudonym || publicPeerName(name) != pseudonym {
+		t.Errorf("got label %q and name %q with a key, want the pseudonym %q", labelPeerName(name), publicPeerName(name), pseudonym)
+	}
+	if publicPeerName("") != "" {
+		t.Error("empty name got a pseudonym")
+	}
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+)
+
+const defaultPluginTimeout = 5 * time.Second
+
+// PluginConfig is an external command whose output in the Prometheus text
+// format is merged into the metrics of every instance.
+type PluginConfig struct {
+	Name string `yaml:"name"`
+	// Command is run with the instance in FASTD_INSTANCE and its status
+	// socket in FASTD_STATUS_SOCKET
+	Command []string      `yaml:"command"`
+	Timeout time.Duration `yaml:"timeout"`
+}
+
+var pluginFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: prefixWrapper("exporter", "plugin_failures_total"),
+	Help: "number of plugin runs that failed or printed invalid metrics",
+}, []string{"plugin", "fastd_instance"})
+
+// reservedPluginPrefixes are the namespaces of the metrics of the exporter
+// itself, which plugins must not print.
+var reservedPluginPrefixes = []string{prefixWrapper(""), "go_", "process_", "promhttp_"}
+
+// pluginFamilies remembers the plugin, help, type and label names of every
+// metric family printed by a plugin. A family has to look the same across
+// plugins, runs and instances, or gathering all metrics fails.
+var pluginFamilies = struct {
+	sync.Mutex
+	shapes map[string]pluginFamily
+}{shapes: map[string]pluginFamily{}}
+
+type pluginFamily struct {
+	plugin     string
+	help       string
+	metricType dto.MetricType
+	labelNames string
+}
+
+// pluginCollector runs the plugins for an instance on every collection.
+// Their metrics are not known in advance, so it is an unchecked collector,
+// and runPlugin rejects output that would break gathering instead.
+type pluginCollector struct {
+	exporter *PrometheusExporter
+}
+
+func (collector pluginCollector) Describe(channel chan<- *prometheus.Desc) {}
+
+func (collector pluginCollector) Collect(channel chan<- prometheus.Metric) {
+	for _, plugin := range exporterConfig.Plugins {
+		if err := collector.runPlugin(plugin, channel); err != nil {
+			log.Printf("Plugin %s failed for %s: %v", plugin.Name, collector.exporter.instance, err)
+			pluginFailures.WithLabelValues(plugin.Name, collector.exporter.instance).Inc()
+		}
+	}
+}
+
+// runPlugin runs a plugin and passes on its metrics with the instance label
+// attached.
+func (collector pluginCollector) runPlugin(plugin PluginConfig, channel chan<- prometheus.Metric) error {
+	timeout := plugin.Timeout
+	if timeout == 0 {
+		timeout = defaultPluginTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	command := exec.CommandContext(ctx, plugin.Command[0], plugin.Command[1:]...)
+	command.Env = append(os.Environ(),
+		"FASTD_INSTANCE="+collector.exporter.instance,
+		"FASTD_STATUS_SOCKET="+collector.exporter.statusSocketPath,
+	)
+	output, err := command.Output()
+	if err != nil {
+		return err
+	}
+
+	var parser expfmt.TextParser
+	families, err := parser.TextToMetricFamilies(bytes.NewReader(output))
+	if err != nil {
+		return err
+	}
+
+	names := make([]string, 0, len(families))
+	for name := range families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	// convert everything first, so invalid output is dropped as a whole
+	var metrics []prometheus.Metric
+	for _, name := range names {
+		if err := checkPluginFamily(plugin.Name, families[name]); err != nil {
+			return err
+		}
+		for _, metric := range families[name].GetMetric() {
+			converted, err := pluginMetric(families[name], metric, collector.exporter.instance)
+			if err != nil {
+				return err
+			}
+			metrics = append(metrics, converted)
+		}
+	}
+
+	for _, metric := range metrics {
+		channel <- metric
+	}
+	return nil
+}
+
+// checkPluginFamily checks that a metric family printed by a plugin stays
+// out of the namespaces of the exporter, has the same label names on every
+// metric without repeating a series and looks like it did before.
+func checkPluginFamily(plugin string, family *dto.MetricFamily) error {
+	name := family.GetName()
+	for _, prefix := range reservedPluginPrefixes {
+		if strings.HasPrefix(name, prefix) {
+			return fmt.Errorf("%s: names starting with %s are reserved for the exporter", name, prefix)
+		}
+	}
+
+	var labelNames string
+	series := map[string]bool{}
+	for i, metric := range family.GetMetric() {
+		labels := append([]*dto.LabelPair{}, metric.GetLabel()...)
+		sort.Slice(labels, func(i, j int) bool { return labels[i].GetName() < labels[j].GetName() })
+		var names, values []string
+		for _, label := range labels {
+			names = append(names, label.GetName())
+			values = append(values, label.GetValue())
+		}
+		if i == 0 {
+			labelNames = strings.Join(names, ",")
+		} else if strings.Join(names, ",") != labelNames {
+			return fmt.Errorf("%s: metrics with different label names", name)
+		}
+		key := strings.Join(values, "\xff")
+		if series[key] {
+			return fmt.Errorf("%s: duplicate series %v", name, values)
+		}
+		series[key] = true
+	}
+
+	shape := pluginFamily{
+		plugin:     plugin,
+		help:       family.GetHelp(),
+		metricType: family.GetType(),
+		labelNames: labelNames,
+	}
+	pluginFamilies.Lock()
+	defer pluginFamilies.Unlock()
+	known, ok := pluginFamilies.shapes[name]
+	if !ok {
+		pluginFamilies.shapes[name] = shape
+		return nil
+	}
+	if known.plugin != plugin {
+		return fmt.Errorf("%s: already printed by plugin %s", name, known.plugin)
+	}
+	if known != shape {
+		return fmt.Errorf("%s: help, type or label names changed", name)
+	}
+	return nil
+}
+
+// pluginMetric converts a metric printed by a plugin to a const metric with
+// the fastd_instance label.
+func pluginMetric(family *dto.MetricFamily, metric *dto.Metric, instance string) (prometheus.Metric, error) {
+	var labelNames, labelValues []string
+	for _, label := range metric.GetLabel() {
+		if label.GetName() == "fastd_instance" {
+			return nil, fmt.Errorf("%s: the fastd_instance label is set by the exporter", family.GetName())
+		}
+		labelNames = append(labelNames, label.GetName())
+		labelValues = append(labelValues, label.GetValue())
+	}
+	desc := prometheus.NewDesc(family.GetName(), family.GetHelp(), labelNames, prometheus.Labels{"fastd_instance": instance})
+
+	switch family.GetType() {
+	case dto.MetricType_COUNTER:
+		return prometheus.NewConstMetric(desc, prometheus.CounterValue, metric.GetCounter().GetValue(), labelValues...)
+	case dto.MetricType_GAUGE:
+		return prometheus.NewConstMetric(desc, prometheus.GaugeValue, metric.GetGauge().GetValue(), labelValues...)
+	case dto.MetricType_HISTOGRAM:
+		histogram := metric.GetHistogram()
+		buckets := map[float64]uint64{}
+		for _, bucket := range histogram.GetBucket() {
+			buckets[bucket.GetUpperBound()] = bucket.GetCumulativeCount()
+		}
+		return prometheus.NewConstHistogram(desc, histogram.GetSampleCount(), histogram.GetSampleSum(), buckets, labelValues...)
+	case dto.MetricType_SUMMARY:
+		summary := metric.GetSummary()
+		quantiles := map[float64]float64{}
+		for _, quantile := range summary.GetQuantile() {
+			quantiles[quantile.GetQuantile()] = quantile.GetValue()
+		}
+		return prometheus.NewConstSummary(desc, summary.GetSampleCount(), summary.GetSampleSum(), quantiles, labelValues...)
+	default:
+		return prometheus.NewConstMetric(desc, prometheus.UntypedValue, metric.GetUntyped().GetValue(), labelValues...)
+	}
+}
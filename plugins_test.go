@@ -0,0 +1,85 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// gatherPlugin gathers the metrics of a plugin printing output for two
+// instances, as the plugin collectors of all instances end up in one
+// registry.
+func gatherPlugin(t *testing.T, output string) int {
+	t.Helper()
+	pluginFamilies.shapes = map[string]pluginFamily{}
+	exporterConfig = Config{Plugins: []PluginConfig{{
+		Name:    "test",
+		Command: []string{"printf", "%s", output},
+	}}}
+	t.Cleanup(func() { exporterConfig = Config{} })
+
+	registry := prometheus.NewPedanticRegistry()
+	registry.MustRegister(
+		pluginCollector{&PrometheusExporter{instance: "dom0"}},
+		pluginCollector{&PrometheusExporter{instance: "dom1"}},
+	)
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatalf("gather failed: %v", err)
+	}
+	var series int
+	for _, family := range families {
+		series += len(family.GetMetric())
+	}
+	return series
+}
+
+func TestPluginMetrics(t *testing.T) {
+	output := `# HELP uplink_up whether the uplink is up
+# TYPE uplink_up gauge
+uplink_up{link="a"} 1
+uplink_up{link="b"} 0
+`
+	if series := gatherPlugin(t, output); series != 4 {
+		t.Errorf("got %d series, want 4", series)
+	}
+}
+
+func TestPluginMetricsRejected(t *testing.T) {
+	for name, output := range map[string]string{
+		"reserved name":    "fastd_peers_up_total 3\n",
+		"go runtime name":  "go_goroutines 3\n",
+		"fastd_instance":   "uplink_up{fastd_instance=\"dom0\"} 1\n",
+		"label names":      "uplink_up{link=\"a\"} 1\nuplink_up{port=\"b\"} 1\n",
+		"missing label":    "uplink_up{link=\"a\"} 1\nuplink_up 1\n",
+		"duplicate series": "uplink_up{link=\"a\",port=\"1\"} 1\nuplink_up{port=\"1\",link=\"a\"} 0\n",
+	} {
+		t.Run(name, func(t *testing.T) {
+			if series := gatherPlugin(t, output); series != 0 {
+				t.Errorf("got %d series, want the output to be dropped", series)
+			}
+		})
+	}
+}
+
+func TestPluginFamilyChanged(t *testing.T) {
+	gatherPlugin(t, "uplink_up{link=\"a\"} 1\n")
+
+	family := pluginFamilies.shapes["uplink_up"]
+	exporterConfig = Config{Plugins: []PluginConfig{{
+		Name:    "test",
+		Command: []string{"printf", "%s", "# TYPE uplink_up counter\nuplink_up{link=\"a\"} 1\n"},
+	}}}
+	registry := prometheus.NewPedanticRegistry()
+	registry.MustRegister(pluginCollector{&PrometheusExporter{instance: "dom0"}})
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatalf("gather failed: %v", err)
+	}
+	if len(families) != 0 {
+		t.Errorf("got %d families, want the changed family to be dropped", len(families))
+	}
+	if pluginFamilies.shapes["uplink_up"] != family {
+		t.Errorf("the known shape of the family was replaced")
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// throughputWindow holds the minimum and maximum throughput of a peer seen
+// by the poller since the last scrape.
+type throughputWindow struct {
+	// rx and tx byte counters of the session at the last poll
+	bytes int
+	read  time.Time
+
+	min     float64
+	max     float64
+	samples int
+	// the window was exported, the next sample starts a new one
+	scraped bool
+}
+
+// runPoller reads the status of all instances every --poll.interval to
+// track the throughput of their peers and the peak of connected peers
+// between scrapes.
+func runPoller(exporters []*PrometheusExporter) {
+	ticker := time.NewTicker(*pollInterval)
+	defer ticker.Stop()
+
+	for {
+		<-ticker.C
+
+		for _, exporter := range exporters {
+			ctx, cancel := context.WithTimeout(context.Background(), exporter.settings.socketTimeout)
+			data, err := readStatus(ctx, exporter.statusSocketPath, exporter.settings)
+			cancel()
+			if err != nil {
+				continue
+			}
+			exporter.journal.record(data, time.Now())
+			exporter.poll(data, time.Now())
+		}
+	}
+}
+
+// poll updates the throughput windows and the peak of connected peers from
+// a status read.
+func (exporter *PrometheusExporter) poll(data Message, readTime time.Time) {
+	exporter.windowsMutex.Lock()
+	defer exporter.windowsMutex.Unlock()
+
+	if exporter.windows == nil {
+		exporter.windows = map[string]*throughputWindow{}
+	}
+
+	peers := 0
+	for publicKey, peer := range data.Peers {
+		if peer.Connection == nil {
+			delete(exporter.windows, publicKey)
+			continue
+		}
+		peers += 1
+
+		bytes := peer.Connection.Statistics.Rx.Bytes + peer.Connection.Statistics.Tx.Bytes
+		window, ok := exporter.windows[publicKey]
+		if !ok {
+			exporter.windows[publicKey] = &throughputWindow{bytes: bytes, read: readTime}
+			continue
+		}
+
+		// counters going backwards mean the session was re-established
+		if bytes >= window.bytes {
+			throughput := float64(bytes-window.bytes) / readTime.Sub(window.read).Seconds()
+			if window.samples == 0 || window.scraped {
+				window.min, window.max = throughput, throughput
+				window.samples = 0
+				window.scraped = false
+			}
+			if throughput < window.min {
+				window.min = throughput
+			}
+			if throughput > window.max {
+				window.max = throughput
+			}
+			window.samples += 1
+		}
+		window.bytes = bytes
+		window.read = readTime
+	}
+
+	for publicKey := range exporter.windows {
+		if _, ok := data.Peers[publicKey]; !ok {
+			delete(exporter.windows, publicKey)
+		}
+	}
+
+	exporter.recordPeersUp(peers, readTime)
+	exporter.recordTxSample(data.Statistics, readTime)
+	exporter.recordPeersTrend(peers, readTime)
+}
+
+// collectThroughputWindow exports the minimum and maximum throughput of a
+// peer since the last scrape. The values are kept until the poller starts a
+// new window.
+func (exporter *PrometheusExporter) collectThroughputWindow(channel chan<- prometheus.Metric, publicKey string, labelValues []string) {
+	exporter.windowsMutex.Lock()
+	defer exporter.windowsMutex.Unlock()
+
+	window, ok := exporter.windows[publicKey]
+	if !ok || window.samples == 0 {
+		return
+	}
+
+	channel <- prometheus.MustNewConstMetric(exporter.peerThroughputMin, prometheus.GaugeValue, window.min, labelValues...)
+	channel <- prometheus.MustNewConstMetric(exporter.peerThroughputMax, prometheus.GaugeValue, window.max, labelValues...)
+	window.scraped = true
+}
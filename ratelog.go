@@ -0,0 +1,55 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// repeatedLogs remembers when messages logged with logRepeated were last
+// written and how often they were suppressed since.
+var repeatedLogs = struct {
+	sync.Mutex
+	messages map[string]*repeatedLog
+}{messages: map[string]*repeatedLog{}}
+
+type repeatedLog struct {
+	logged     time.Time
+	suppressed int
+}
+
+// logRepeated logs a message like log.Printf, unless the same message was
+// logged within --log.repeat-interval, so an instance that is down does not
+// log the same error on every scrape for days. Suppressed messages are
+// counted and the count is logged along with the message next time.
+func logRepeated(format string, args ...interface{}) {
+	message := fmt.Sprintf(format, args...)
+	if *logRepeatInterval <= 0 {
+		log.Print(message)
+		return
+	}
+
+	repeatedLogs.Lock()
+	defer repeatedLogs.Unlock()
+
+	now := time.Now()
+	for key, entry := range repeatedLogs.messages {
+		// messages that stopped repeating start over
+		if now.Sub(entry.logged) > 2**logRepeatInterval {
+			delete(repeatedLogs.messages, key)
+		}
+	}
+
+	entry, ok := repeatedLogs.messages[message]
+	if ok && now.Sub(entry.logged) < *logRepeatInterval {
+		entry.suppressed += 1
+		return
+	}
+	if ok && entry.suppressed > 0 {
+		log.Printf("%s (repeated %d times since %s)", message, entry.suppressed, entry.logged.Format(time.RFC3339))
+	} else {
+		log.Print(message)
+	}
+	repeatedLogs.messages[message] = &repeatedLog{logged: now}
+}
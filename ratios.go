@@ -0,0 +1,79 @@
+package main
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// txCounters holds the tx counters of an instance.
+type txCounters struct {
+	tx      int
+	dropped int
+	errors  int
+}
+
+// txRatios keeps the tx counters of the status reads within
+// --tx-ratios.window to derive the share of dropped and failed packets from.
+type txRatios struct {
+	statusWindow[txCounters]
+}
+
+// recordCounters adds the counters of a status read. fastd releases that do
+// not report dropped and failed packets are ignored.
+func (ratios *txRatios) recordCounters(statistics Statistics, readTime time.Time, window time.Duration) {
+	if statistics.TxDropped == nil || statistics.TxError == nil {
+		return
+	}
+	counters := txCounters{tx: statistics.Tx.Count, dropped: statistics.TxDropped.Count, errors: statistics.TxError.Count}
+
+	// counters going backwards mean fastd restarted
+	if last, ok := ratios.last(); ok && readTime.After(last.time) {
+		if counters.tx < last.value.tx || counters.dropped < last.value.dropped || counters.errors < last.value.errors {
+			ratios.reset()
+		}
+	}
+	ratios.record(counters, readTime, window)
+}
+
+// ratios returns the share of dropped and failed packets among all packets
+// to send within the window, false if there are not enough samples yet.
+func (ratios *txRatios) ratios() (dropped float64, errors float64, ok bool) {
+	if len(ratios.samples) < 2 {
+		return 0, 0, false
+	}
+	first, last := ratios.samples[0].value, ratios.samples[len(ratios.samples)-1].value
+
+	total := (last.tx - first.tx) + (last.dropped - first.dropped) + (last.errors - first.errors)
+	if total == 0 {
+		return 0, 0, true
+	}
+	return float64(last.dropped-first.dropped) / float64(total), float64(last.errors-first.errors) / float64(total), true
+}
+
+// recordTxSample adds the counters of a status read to the tx ratios of the
+// instance.
+func (exporter *PrometheusExporter) recordTxSample(statistics Statistics, readTime time.Time) {
+	if *txRatiosWindow <= 0 {
+		return
+	}
+
+	exporter.txRatiosMutex.Lock()
+	defer exporter.txRatiosMutex.Unlock()
+
+	exporter.txRatios.recordCounters(statistics, readTime, *txRatiosWindow)
+}
+
+// collectTxRatios exports the share of dropped and failed packets within
+// --tx-ratios.window.
+func (exporter *PrometheusExporter) collectTxRatios(channel chan<- prometheus.Metric) {
+	exporter.txRatiosMutex.Lock()
+	defer exporter.txRatiosMutex.Unlock()
+
+	dropped, errors, ok := exporter.txRatios.ratios()
+	if !ok {
+		return
+	}
+	channel <- prometheus.MustNewConstMetric(exporter.txDroppedRatio, prometheus.GaugeValue, dropped)
+	channel <- prometheus.MustNewConstMetric(exporter.txErrorRatio, prometheus.GaugeValue, errors)
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// maxRegistryLookups limits the concurrent requests to the peer registry.
+const maxRegistryLookups = 4
+
+var registryLookupFailures = prometheus.NewCounter(prometheus.CounterOpts{
+	Name: prefixWrapper("peer_registry_failures_total"),
+	Help: "number of failed requests to the peer registry",
+})
+
+// registryCache holds the fields of peers looked up in the peer registry
+// given by --peer-api.url, keyed by public key.
+var registryCache = struct {
+	sync.Mutex
+	entries map[string]registryEntry
+	pending map[string]bool
+}{entries: map[string]registryEntry{}, pending: map[string]bool{}}
+
+type registryEntry struct {
+	// fields of the peer, nil if the registry does not know it
+	fields  map[string]string
+	expires time.Time
+}
+
+var (
+	registryClient    *http.Client
+	registryLookups   = make(chan struct{}, maxRegistryLookups)
+	registryFieldList []string
+)
+
+// setupPeerRegistry validates the peer registry settings. Requests go
+// through the enrichment proxy, if any.
+func setupPeerRegistry() error {
+	if *peerAPIURL == "" {
+		return nil
+	}
+	if !strings.Contains(*peerAPIURL, "{pubkey}") {
+		return fmt.Errorf("peer registry URL %s does not contain {pubkey}", *peerAPIURL)
+	}
+
+	for _, field := range strings.Split(*peerAPIFields, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		if err := exporterConfig.checkPeerLabel(field); err != nil {
+			return fmt.Errorf("invalid peer registry field: %w", err)
+		}
+		registryFieldList = append(registryFieldList, field)
+	}
+	if len(registryFieldList) == 0 {
+		return fmt.Errorf("--peer-api.url requires --peer-api.fields")
+	}
+
+	registryClient = &http.Client{
+		Timeout:   *peerAPITimeout,
+		Transport: &http.Transport{DialContext: enrichmentDialer.DialContext},
+	}
+	prometheus.MustRegister(registryLookupFailures)
+	return nil
+}
+
+// registryFields returns the cached registry fields of a peer. Missing or
+// expired entries are looked up in the background, so scrapes never wait
+// for the registry.
+func registryFields(publicKey string) (map[string]string, bool) {
+	registryCache.Lock()
+	defer registryCache.Unlock()
+
+	entry, ok := registryCache.entries[publicKey]
+	if (!ok || time.Now().After(entry.expires)) && !registryCache.pending[publicKey] {
+		registryCache.pending[publicKey] = true
+		go lookupRegistry(publicKey)
+	}
+
+	return entry.fields, ok && entry.fields != nil
+}
+
+// lookupRegistry fetches the fields of a peer from the registry. Failed
+// lookups keep the previous entry and are retried after the negative cache
+// TTL.
+func lookupRegistry(publicKey string) {
+	registryLookups <- struct{}{}
+	defer func() { <-registryLookups }()
+
+	fields, err := fetchRegistryFields(publicKey)
+
+	registryCache.Lock()
+	defer registryCache.Unlock()
+
+	delete(registryCache.pending, publicKey)
+	if err != nil {
+		log.Printf("Peer registry lookup of %s failed: %v", publicKey, err)
+		registryLookupFailures.Inc()
+
+		entry := registryCache.entries[publicKey]
+		entry.expires = time.Now().Add(asnNegativeCacheTTL)
+		registryCache.entries[publicKey] = entry
+		return
+	}
+
+	registryCache.entries[publicKey] = registryEntry{fields: fields, expires: time.Now().Add(*peerAPICacheTTL)}
+}
+
+// fetchRegistryFields requests the registry entry of a peer, which must be
+// a JSON object. Fields that are not strings, numbers or booleans are
+// exported empty.
+func fetchRegistryFields(publicKey string) (map[string]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), *peerAPITimeout)
+	defer cancel()
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.ReplaceAll(*peerAPIURL, "{pubkey}", publicKey), nil)
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Accept", "application/json")
+
+	response, err := registryClient.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", response.Status)
+	}
+
+	var object map[string]interface{}
+	if err := json.NewDecoder(response.Body).Decode(&object); err != nil {
+		return nil, err
+	}
+
+	fields := map[string]string{}
+	for _, field := range registryFieldList {
+		switch value := object[field].(type) {
+		case string:
+			fields[field] = value
+		case float64:
+			fields[field] = strconv.FormatFloat(value, 'f', -1, 64)
+		case bool:
+			fields[field] = strconv.FormatBool(value)
+		}
+	}
+	return fields, nil
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// configCache keeps fetched remote configs, so they can be revalidated with
+// their ETag and served when the config service is unreachable.
+var configCache = struct {
+	sync.Mutex
+	entries map[string]configCacheEntry
+}{entries: map[string]configCacheEntry{}}
+
+type configCacheEntry struct {
+	etag         string
+	lastModified string
+	data         []byte
+}
+
+// configHTTPClient is built in main, once --config-http.timeout is parsed.
+var configHTTPClient *http.Client
+
+// links in the directory listings generated by common web servers
+var directoryLinkPattern = regexp.MustCompile(`href="([^"?/]+)"`)
+
+// isConfigURL reports whether a config path refers to a HTTP(S) URL.
+func isConfigURL(path string) bool {
+	return strings.HasPrefix(path, "http://") || strings.HasPrefix(path, "https://")
+}
+
+// resolveConfigPath resolves a path found in the config at base.
+func resolveConfigPath(base string, ref string) string {
+	if isConfigURL(base) {
+		baseURL, err := url.Parse(base)
+		if err != nil {
+			return ref
+		}
+		refURL, err := url.Parse(ref)
+		if err != nil {
+			return ref
+		}
+		return baseURL.ResolveReference(refURL).String()
+	}
+
+	if filepath.IsAbs(ref) || isConfigURL(ref) {
+		return ref
+	}
+	return filepath.Join(filepath.Dir(base), ref)
+}
+
+// readConfigSource reads a config from a file or a HTTP(S) URL.
+func readConfigSource(path string) ([]byte, error) {
+	if isConfigURL(path) {
+		return fetchConfig(path)
+	}
+	return os.ReadFile(path)
+}
+
+// listPeerDirectory returns the names of the files in a peer directory. For
+// HTTP(S) URLs the directory must answer with a listing of the files, either
+// as an HTML index linking them or with one name per line.
+func listPeerDirectory(directory string) ([]string, error) {
+	var names []string
+	if !isConfigURL(directory) {
+		entries, err := os.ReadDir(directory)
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range entries {
+			if !entry.IsDir() {
+				names = append(names, entry.Name())
+			}
+		}
+		return names, nil
+	}
+
+	if !strings.HasSuffix(directory, "/") {
+		directory += "/"
+	}
+	data, err := fetchConfig(directory)
+	if err != nil {
+		return nil, err
+	}
+
+	if matches := directoryLinkPattern.FindAllSubmatch(data, -1); matches != nil {
+		for _, match := range matches {
+			if name, err := url.PathUnescape(string(match[1])); err == nil {
+				names = append(names, path.Base(name))
+			}
+		}
+		return names, nil
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		if name := strings.TrimSpace(scanner.Text()); name != "" {
+			names = append(names, name)
+		}
+	}
+	return names, scanner.Err()
+}
+
+// fetchConfig fetches a config over HTTP(S), revalidating a cached copy with
+// its ETag or modification time. The cached copy is returned if the server
+// cannot be reached.
+func fetchConfig(configURL string) ([]byte, error) {
+	configCache.Lock()
+	cached, isCached := configCache.entries[configURL]
+	configCache.Unlock()
+
+	request, err := http.NewRequest(http.MethodGet, configURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	if cached.etag != "" {
+		request.Header.Set("If-None-Match", cached.etag)
+	}
+	if cached.lastModified != "" {
+		request.Header.Set("If-Modified-Since", cached.lastModified)
+	}
+
+	response, err := configHTTPClient.Do(request)
+	if err != nil {
+		if isCached {
+			log.Printf("Failed to fetch %s, using cached copy: %v", configURL, err)
+			return cached.data, nil
+		}
+		return nil, err
+	}
+	defer func(body io.ReadCloser) {
+		_ = body.Close()
+	}(response.Body)
+
+	switch response.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotModified:
+		if isCached {
+			return cached.data, nil
+		}
+		return nil, fmt.Errorf("unexpected 304 for uncached %s", configURL)
+	case http.StatusNotFound, http.StatusGone:
+		return nil, fmt.Errorf("%s: %s: %w", configURL, response.Status, fs.ErrNotExist)
+	default:
+		if isCached {
+			log.Printf("Failed to fetch %s, using cached copy: %s", configURL, response.Status)
+			return cached.data, nil
+		}
+		return nil, fmt.Errorf("%s: %s", configURL, response.Status)
+	}
+
+	data, err := io.ReadAll(response.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	configCache.Lock()
+	configCache.entries[configURL] = configCacheEntry{
+		etag:         response.Header.Get("ETag"),
+		lastModified: response.Header.Get("Last-Modified"),
+		data:         data,
+	}
+	configCache.Unlock()
+
+	return data, nil
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"net"
+	"sort"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// remoteCheck is the result of resolving the hostname of a peer remote.
+type remoteCheck struct {
+	publicKey string
+	name      string
+	remote    string
+	resolved  bool
+	addresses int
+}
+
+// runRemoteChecks resolves the hostnames in the remote statements of the
+// configured peers of all instances every --remote-dns.interval.
+func runRemoteChecks(exporters []*PrometheusExporter) {
+	ticker := time.NewTicker(*remoteDNSInterval)
+	defer ticker.Stop()
+
+	for {
+		for _, exporter := range exporters {
+			var checks []remoteCheck
+			for publicKey, config := range exporter.peerConfigs() {
+				checked := map[string]bool{}
+				for _, remote := range config.remotes {
+					// the same host may be given for several address families
+					if checked[remote.host] {
+						continue
+					}
+					checked[remote.host] = true
+
+					addresses := resolveRemote(remote)
+					checks = append(checks, remoteCheck{
+						publicKey: publicKey,
+						name:      labelPeerName(config.name),
+						remote:    remote.host,
+						resolved:  addresses > 0,
+						addresses: addresses,
+					})
+				}
+			}
+			sort.Slice(checks, func(i, j int) bool {
+				return checks[i].publicKey < checks[j].publicKey
+			})
+
+			exporter.remoteChecksMutex.Lock()
+			exporter.remoteChecks = checks
+			exporter.remoteChecksMutex.Unlock()
+		}
+
+		<-ticker.C
+	}
+}
+
+// resolveRemote returns the number of addresses a remote resolves to in its
+// address family, like fastd would resolve it.
+func resolveRemote(remote peerRemote) int {
+	network := "ip"
+	switch remote.family {
+	case "ipv4":
+		network = "ip4"
+	case "ipv6":
+		network = "ip6"
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), *remoteDNSTimeout)
+	defer cancel()
+
+	addrs, err := net.DefaultResolver.LookupIP(ctx, network, remote.host)
+	if err != nil {
+		return 0
+	}
+	return len(addrs)
+}
+
+func (exporter *PrometheusExporter) collectRemoteChecks(channel chan<- prometheus.Metric) {
+	exporter.remoteChecksMutex.Lock()
+	defer exporter.remoteChecksMutex.Unlock()
+
+	for _, check := range exporter.remoteChecks {
+		channel <- prometheus.MustNewConstMetric(exporter.peerRemoteResolved, prometheus.GaugeValue, boolToFloat64(check.resolved), check.publicKey, check.name, check.remote)
+		channel <- prometheus.MustNewConstMetric(exporter.peerRemoteAddresses, prometheus.GaugeValue, float64(check.addresses), check.publicKey, check.name, check.remote)
+	}
+}
@@ -0,0 +1,332 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	rollupDayFormat    = "2006-01-02"
+	rollupSessionsFile = "sessions.json"
+)
+
+// peerRollup is the traffic of a peer on one day, in local time.
+type peerRollup struct {
+	Day       string `json:"day"`
+	Instance  string `json:"instance"`
+	PublicKey string `json:"public_key"`
+	Name      string `json:"name"`
+	RxBytes   int    `json:"rx_bytes"`
+	TxBytes   int    `json:"tx_bytes"`
+}
+
+// sessionBytes are the byte counters of a session at a status read.
+type sessionBytes struct {
+	Rx int `json:"rx"`
+	Tx int `json:"tx"`
+}
+
+// rollupStore accumulates the traffic of the peers per day from the
+// differences between status reads and keeps it in --rollups.directory, in
+// a file per day. Only the files of days with new traffic are written, so
+// saving does not get slower with the retention.
+type rollupStore struct {
+	sync.Mutex
+	// rollups by day, instance and public key
+	days map[string]map[string]map[string]*peerRollup
+	// days changed since the last save
+	changed map[string]bool
+	// counters of the sessions at the last read by instance and public key,
+	// instances not read yet are missing
+	sessions map[string]map[string]sessionBytes
+}
+
+// rollups is nil unless --rollups.directory is given.
+var rollups *rollupStore
+
+// runRollups adds the traffic since the last read to the rollups of the
+// peers every --rollups.interval and saves them.
+func runRollups(exporters []*PrometheusExporter) {
+	ticker := time.NewTicker(*rollupsInterval)
+	defer ticker.Stop()
+
+	for {
+		for _, exporter := range exporters {
+			ctx, cancel := context.WithTimeout(context.Background(), exporter.settings.socketTimeout)
+			data, readTime, err := exporter.status(ctx)
+			cancel()
+			if err != nil {
+				continue
+			}
+			rollups.add(exporter.instance, data, readTime)
+		}
+		rollups.applyRetention(time.Now())
+		if err := rollups.save(); err != nil {
+			log.Printf("Failed to save rollups to %s: %v", *rollupsDirectory, err)
+		}
+
+		<-ticker.C
+	}
+}
+
+// loadRollups reads the rollups from --rollups.directory, which is created
+// if it does not exist yet.
+func loadRollups() error {
+	rollups = &rollupStore{
+		days:     map[string]map[string]map[string]*peerRollup{},
+		changed:  map[string]bool{},
+		sessions: map[string]map[string]sessionBytes{},
+	}
+
+	if err := os.MkdirAll(*rollupsDirectory, 0o755); err != nil {
+		return err
+	}
+	entries, err := os.ReadDir(*rollupsDirectory)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		day, ok := rollupDay(entry.Name())
+		if !ok {
+			continue
+		}
+		var list []*peerRollup
+		if err := readRollupFile(entry.Name(), &list); err != nil {
+			return err
+		}
+		for _, rollup := range list {
+			*rollups.rollup(day, rollup.Instance, rollup.PublicKey, rollup.Name) = *rollup
+		}
+	}
+
+	err = readRollupFile(rollupSessionsFile, &rollups.sessions)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// rollupDay returns the day of the file of its rollups, false for other
+// files.
+func rollupDay(name string) (string, bool) {
+	day := strings.TrimSuffix(name, ".json")
+	if _, err := time.Parse(rollupDayFormat, day); err != nil || day == name {
+		return "", false
+	}
+	return day, true
+}
+
+// readRollupFile decodes a file in --rollups.directory.
+func readRollupFile(name string, v interface{}) error {
+	data, err := os.ReadFile(filepath.Join(*rollupsDirectory, name))
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("failed to parse %s: %w", name, err)
+	}
+	return nil
+}
+
+// rollup returns the rollup of a peer on a day, creating it if needed.
+func (store *rollupStore) rollup(day string, instance string, publicKey string, name string) *peerRollup {
+	instances, ok := store.days[day]
+	if !ok {
+		instances = map[string]map[string]*peerRollup{}
+		store.days[day] = instances
+	}
+	peers, ok := instances[instance]
+	if !ok {
+		peers = map[string]*peerRollup{}
+		instances[instance] = peers
+	}
+	rollup, ok := peers[publicKey]
+	if !ok {
+		rollup = &peerRollup{Day: day, Instance: instance, PublicKey: publicKey}
+		peers[publicKey] = rollup
+	}
+	rollup.Name = name
+	return rollup
+}
+
+// add accounts the traffic of the connected peers since the last read to the
+// day of readTime. Sessions that are new or whose counters went backwards
+// count from zero, the first read of an instance only sets the baseline.
+func (store *rollupStore) add(instance string, data Message, readTime time.Time) {
+	store.Lock()
+	defer store.Unlock()
+
+	previous, known := store.sessions[instance]
+	current := map[string]sessionBytes{}
+	day := readTime.Local().Format(rollupDayFormat)
+	for publicKey, peer := range data.Peers {
+		if peer.Connection == nil {
+			continue
+		}
+		counters := sessionBytes{Rx: peer.Connection.Statistics.Rx.Bytes, Tx: peer.Connection.Statistics.Tx.Bytes}
+		current[publicKey] = counters
+		if !known {
+			continue
+		}
+
+		delta := counters
+		if last, ok := previous[publicKey]; ok && counters.Rx >= last.Rx && counters.Tx >= last.Tx {
+			delta = sessionBytes{Rx: counters.Rx - last.Rx, Tx: counters.Tx - last.Tx}
+		}
+		rollup := store.rollup(day, instance, publicKey, publicPeerName(peer.Name))
+		rollup.RxBytes += delta.Rx
+		rollup.TxBytes += delta.Tx
+		store.changed[day] = true
+	}
+	store.sessions[instance] = current
+}
+
+// applyRetention drops the rollups of days older than --rollups.retention
+// along with their files.
+func (store *rollupStore) applyRetention(now time.Time) {
+	if *rollupsRetention <= 0 {
+		return
+	}
+
+	store.Lock()
+	defer store.Unlock()
+
+	oldest := now.Add(-*rollupsRetention).Format(rollupDayFormat)
+	for day := range store.days {
+		if day < oldest {
+			delete(store.days, day)
+			delete(store.changed, day)
+			err := os.Remove(filepath.Join(*rollupsDirectory, day+".json"))
+			if err != nil && !errors.Is(err, os.ErrNotExist) {
+				log.Printf("Failed to remove rollups of %s: %v", day, err)
+			}
+		}
+	}
+}
+
+// list returns the rollups matching the filters in the order of day,
+// instance and public key. Empty filters match everything.
+func (store *rollupStore) list(day string, instance string, publicKey string) []*peerRollup {
+	store.Lock()
+	defer store.Unlock()
+
+	list := []*peerRollup{}
+	for _, instances := range store.days {
+		for _, peers := range instances {
+			for _, rollup := range peers {
+				if (day == "" || rollup.Day == day) && (instance == "" || rollup.Instance == instance) && (publicKey == "" || rollup.PublicKey == publicKey) {
+					copied := *rollup
+					list = append(list, &copied)
+				}
+			}
+		}
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Day != list[j].Day {
+			return list[i].Day < list[j].Day
+		}
+		if list[i].Instance != list[j].Instance {
+			return list[i].Instance < list[j].Instance
+		}
+		return list[i].PublicKey < list[j].PublicKey
+	})
+	return list
+}
+
+// save writes the files of the days changed since the last save and the
+// counters of the sessions to --rollups.directory.
+func (store *rollupStore) save() error {
+	store.Lock()
+	var days []string
+	for day := range store.changed {
+		days = append(days, day)
+	}
+	store.changed = map[string]bool{}
+	sessions, err := json.Marshal(store.sessions)
+	store.Unlock()
+	if err != nil {
+		return err
+	}
+
+	for i, day := range days {
+		data, err := json.Marshal(store.list(day, "", ""))
+		if err == nil {
+			err = writeRollupFile(day+".json", data)
+		}
+		if err != nil {
+			// try again on the next save
+			store.Lock()
+			for _, day := range days[i:] {
+				store.changed[day] = true
+			}
+			store.Unlock()
+			return err
+		}
+	}
+	return writeRollupFile(rollupSessionsFile, sessions)
+}
+
+// writeRollupFile replaces a file in --rollups.directory atomically.
+func writeRollupFile(name string, data []byte) error {
+	temp, err := os.CreateTemp(*rollupsDirectory, ".rollups")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(temp.Name())
+
+	if _, err := temp.Write(data); err != nil {
+		_ = temp.Close()
+		return err
+	}
+	if err := temp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(temp.Name(), filepath.Join(*rollupsDirectory, name))
+}
+
+// rollupsHandler serves /api/v1/rollups with the daily traffic of the peers,
+// filtered by ?day=2024-05-01, ?instance= and ?public_key=, as JSON or as
+// CSV with ?format=csv.
+func rollupsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		if day := query.Get("day"); day != "" {
+			if _, err := time.Parse(rollupDayFormat, day); err != nil {
+				http.Error(w, "invalid day", http.StatusBadRequest)
+				return
+			}
+		}
+		list := rollups.list(query.Get("day"), query.Get("instance"), query.Get("public_key"))
+
+		if query.Get("format") != "csv" {
+			w.Header().Set("Content-Type", "application/json")
+			if err := json.NewEncoder(w).Encode(list); err != nil {
+				log.Print(err)
+			}
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/csv")
+		writer := csv.NewWriter(w)
+		_ = writer.Write([]string{"day", "instance", "public_key", "name", "rx_bytes", "tx_bytes"})
+		for _, rollup := range list {
+			_ = writer.Write([]string{rollup.Day, rollup.Instance, rollup.PublicKey, rollup.Name, strconv.Itoa(rollup.RxBytes), strconv.Itoa(rollup.TxBytes)})
+		}
+		writer.Flush()
+		if err := writer.Error(); err != nil {
+			log.Print(err)
+		}
+	})
+}
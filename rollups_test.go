@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// rollupStatus returns a status with one peer that has sent and received
+// the given bytes.
+func rollupStatus(t *testing.T, bytes int) Message {
+	t.Helper()
+	var data Message
+	status := `{"peers": {"abcd": {"name": "peer", "connection": {"statistics": {"rx": {"bytes": ` + strconv.Itoa(bytes) + `}, "tx": {"bytes": ` + strconv.Itoa(bytes) + `}}}}}}`
+	if err := json.Unmarshal([]byte(status), &data); err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestRollupsSaveChangedDays(t *testing.T) {
+	directory := t.TempDir()
+	*rollupsDirectory = directory
+	t.Cleanup(func() { *rollupsDirectory = ""; rollups = nil })
+	if err := loadRollups(); err != nil {
+		t.Fatal(err)
+	}
+
+	first := time.Date(2024, time.May, 1, 12, 0, 0, 0, time.Local)
+	rollups.add("dom0", rollupStatus(t, 100), first)
+	rollups.add("dom0", rollupStatus(t, 150), first.Add(time.Hour))
+	if err := rollups.save(); err != nil {
+		t.Fatal(err)
+	}
+
+	// only the file of the day with new traffic is written again
+	oldFile := filepath.Join(directory, "2024-05-01.json")
+	if err := os.WriteFile(oldFile, []byte(`[]`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	rollups.add("dom0", rollupStatus(t, 170), first.AddDate(0, 0, 1))
+	if err := rollups.save(); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(oldFile); string(data) != "[]" {
+		t.Errorf("unchanged day was written again: %s", data)
+	}
+
+	if err := loadRollups(); err != nil {
+		t.Fatal(err)
+	}
+	list := rollups.list("", "", "")
+	if len(list) != 1 || list[0].Day != "2024-05-02" || list[0].RxBytes != 20 {
+		t.Errorf("got rollups %+v after loading, want 20 bytes on 2024-05-02", list)
+	}
+	if counters := rollups.sessions["dom0"]["abcd"]; counters.Rx != 170 {
+		t.Errorf("got session counters %+v after loading, want 170 bytes", counters)
+	}
+}
+
+func TestRollupsRetentionRemovesFiles(t *testing.T) {
+	directory := t.TempDir()
+	*rollupsDirectory = directory
+	retention := *rollupsRetention
+	t.Cleanup(func() { *rollupsDirectory = ""; *rollupsRetention = retention; rollups = nil })
+	if err := loadRollups(); err != nil {
+		t.Fatal(err)
+	}
+
+	day := time.Date(2024, time.May, 1, 12, 0, 0, 0, time.Local)
+	rollups.add("dom0", rollupStatus(t, 100), day)
+	rollups.add("dom0", rollupStatus(t, 150), day)
+	if err := rollups.save(); err != nil {
+		t.Fatal(err)
+	}
+
+	*rollupsRetention = 24 * time.Hour
+	rollups.applyRetention(day.AddDate(0, 0, 3))
+	if _, err := os.Stat(filepath.Join(directory, "2024-05-01.json")); !os.IsNotExist(err) {
+		t.Errorf("file of a day past the retention was kept: %v", err)
+	}
+	if list := rollups.list("", "", ""); len(list) != 0 {
+		t.Errorf("got rollups %+v past the retention", list)
+	}
+}
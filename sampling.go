@@ -0,0 +1,15 @@
+package main
+
+import "hash/fnv"
+
+// peerSampled reports whether the per peer metrics of a peer are exported
+// with --peer-sampling.modulus. The sample is deterministic, so the same
+// peers are exported on every scrape and by every exporter.
+func peerSampled(publicKey string) bool {
+	if *peerSamplingModulus <= 1 {
+		return true
+	}
+	hash := fnv.New32a()
+	_, _ = hash.Write([]byte(publicKey))
+	return hash.Sum32()%uint32(*peerSamplingModulus) == 0
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/posteo/go-agentx"
+	"github.com/posteo/go-agentx/pdu"
+	"github.com/posteo/go-agentx/value"
+)
+
+// snmpSnapshotTTL is how long the SNMP tables are served from a snapshot
+// before the status sockets are read again, so walking a table does not read
+// the sockets for every single object.
+const snmpSnapshotTTL = 5 * time.Second
+
+// Layout of the SNMP subtree below --snmp.base-oid. Instances and peers are
+// indexed by their position, peers additionally by the index of the instance.
+//
+//	.1.1.<column>.<instance>        instance table
+//	.2.1.<column>.<instance>.<peer> peer table
+const (
+	snmpInstanceTable = 1
+	snmpPeerTable     = 2
+)
+
+type snmpVariable struct {
+	oid          value.OID
+	variableType pdu.VariableType
+	value        interface{}
+}
+
+// snmpHandler serves the instance and peer tables to the SNMP daemon.
+type snmpHandler struct {
+	baseOID   value.OID
+	exporters []*PrometheusExporter
+
+	mutex     sync.Mutex
+	built     time.Time
+	variables []snmpVariable
+}
+
+// runSNMPSubagent registers the fastd subtree with the AgentX master agent of
+// the SNMP daemon at address, which is either a unix socket path or a
+// host:port.
+func runSNMPSubagent(address string, baseOID string, exporters []*PrometheusExporter) error {
+	oid, err := value.ParseOID(baseOID)
+	if err != nil {
+		return err
+	}
+
+	network := "tcp"
+	if strings.HasPrefix(address, "/") {
+		network = "unix"
+	}
+	client, err := agentx.Dial(network, address)
+	if err != nil {
+		return err
+	}
+	client.Timeout = time.Minute
+	client.ReconnectInterval = time.Second
+	client.NameOID = oid
+	client.Name = "fastd-exporter"
+
+	session, err := client.Session()
+	if err != nil {
+		return err
+	}
+	session.Handler = &snmpHandler{baseOID: oid, exporters: exporters}
+
+	return session.Register(127, oid)
+}
+
+func (handler *snmpHandler) Get(oid value.OID) (value.OID, pdu.VariableType, interface{}, error) {
+	variables := handler.snapshot()
+	i := sort.Search(len(variables), func(i int) bool {
+		return value.CompareOIDs(variables[i].oid, oid) >= 0
+	})
+	if i < len(variables) && value.CompareOIDs(variables[i].oid, oid) == 0 {
+		return variables[i].oid, variables[i].variableType, variables[i].value, nil
+	}
+
+	return nil, pdu.VariableTypeNoSuchObject, nil, nil
+}
+
+func (handler *snmpHandler) GetNext(from value.OID, includeFrom bool, to value.OID) (value.OID, pdu.VariableType, interface{}, error) {
+	variables := handler.snapshot()
+	i := sort.Search(len(variables), func(i int) bool {
+		compare := value.CompareOIDs(variables[i].oid, from)
+		return compare > 0 || (compare == 0 && includeFrom)
+	})
+	if i < len(variables) && (len(to) == 0 || value.CompareOIDs(variables[i].oid, to) < 0) {
+		return variables[i].oid, variables[i].variableType, variables[i].value, nil
+	}
+
+	return nil, pdu.VariableTypeEndOfMIBView, nil, nil
+}
+
+// snapshot returns the variables of the subtree sorted by OID, reading the
+// status sockets if the previous snapshot expired.
+func (handler *snmpHandler) snapshot() []snmpVariable {
+	handler.mutex.Lock()
+	defer handler.mutex.Unlock()
+
+	if time.Since(handler.built) < snmpSnapshotTTL {
+		return handler.variables
+	}
+
+	var variables []snmpVariable
+	add := func(variableType pdu.VariableType, v interface{}, subidentifiers ...uint32) {
+		oid := append(append(value.OID{}, handler.baseOID...), subidentifiers...)
+		variables = append(variables, snmpVariable{oid: oid, variableType: variableType, value: v})
+	}
+
+	for i, exporter := range handler.exporters {
+		instanceIndex := uint32(i + 1)
+
+		ctx, cancel := context.WithTimeout(context.Background(), exporter.settings.socketTimeout)
+		data, _, err := exporter.status(ctx)
+		cancel()
+		if err != nil {
+			log.Printf("Failed to read status of %s for SNMP: %v", exporter.instance, err)
+		}
+
+		peersUp := 0
+		for _, peer := range data.Peers {
+			if peer.Connection != nil {
+				peersUp += 1
+			}
+		}
+
+		instanceEntry := func(column uint32, variableType pdu.VariableType, v interface{}) {
+			add(variableType, v, snmpInstanceTable, 1, column, instanceIndex)
+		}
+		instanceEntry(1, pdu.VariableTypeOctetString, exporter.instance)
+		instanceEntry(2, pdu.VariableTypeInteger, int32(boolToFloat64(err == nil)))
+		instanceEntry(3, pdu.VariableTypeTimeTicks, time.Duration(data.Uptime)*time.Millisecond)
+		instanceEntry(4, pdu.VariableTypeGauge32, uint32(peersUp))
+		instanceEntry(5, pdu.VariableTypeCounter64, uint64(data.Statistics.Rx.Count))
+		instanceEntry(6, pdu.VariableTypeCounter64, uint64(data.Statistics.Rx.Bytes))
+		instanceEntry(7, pdu.VariableTypeCounter64, uint64(data.Statistics.Tx.Count))
+		instanceEntry(8, pdu.VariableTypeCounter64, uint64(data.Statistics.Tx.Bytes))
+
+		publicKeys := make([]string, 0, len(data.Peers))
+		for publicKey := range data.Peers {
+			publicKeys = append(publicKeys, publicKey)
+		}
+		sort.Strings(publicKeys)
+
+		for j, publicKey := range publicKeys {
+			peer := data.Peers[publicKey]
+			var statistics Statistics
+			var established float64
+			if peer.Connection != nil {
+				statistics = peer.Connection.Statistics
+				established = peer.Connection.Established
+			}
+
+			peerEntry := func(column uint32, variableType pdu.VariableType, v interface{}) {
+				add(variableType, v, snmpPeerTable, 1, column, instanceIndex, uint32(j+1))
+			}
+			peerEntry(1, pdu.VariableTypeOctetString, publicKey)
+			peerEntry(2, pdu.VariableTypeOctetString, publicPeerName(peer.Name))
+			peerEntry(3, pdu.VariableTypeInteger, int32(boolToFloat64(peer.Connection != nil)))
+			peerEntry(4, pdu.VariableTypeTimeTicks, time.Duration(established)*time.Millisecond)
+			peerEntry(5, pdu.VariableTypeCounter64, uint64(statistics.Rx.Count))
+			peerEntry(6, pdu.VariableTypeCounter64, uint64(statistics.Rx.Bytes))
+			peerEntry(7, pdu.VariableTypeCounter64, uint64(statistics.Tx.Count))
+			peerEntry(8, pdu.VariableTypeCounter64, uint64(statistics.Tx.Bytes))
+		}
+	}
+
+	sort.Slice(variables, func(i, j int) bool {
+		return value.CompareOIDs(variables[i].oid, variables[j].oid) < 0
+	})
+	handler.variables = variables
+	handler.built = time.Now()
+
+	return variables
+}
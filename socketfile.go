@@ -0,0 +1,31 @@
+package main
+
+import (
+	"io/fs"
+	"os"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// collectSocketFile exports the age of the local status socket and whether
+// it is a socket at all. A regular file left behind at its path, e.g. after
+// fastd crashed, exists but cannot be connected to.
+func (exporter *PrometheusExporter) collectSocketFile(channel chan<- prometheus.Metric) {
+	if isRemoteStatusSocket(exporter.statusSocketPath) {
+		return
+	}
+	if _, ok := statusFilePath(exporter.statusSocketPath); ok {
+		return
+	}
+	if _, ok := agentSnapshotKey(exporter.statusSocketPath); ok {
+		return
+	}
+
+	info, err := os.Stat(exporter.statusSocketPath)
+	if err != nil {
+		return
+	}
+	channel <- prometheus.MustNewConstMetric(exporter.socketFileAge, prometheus.GaugeValue, time.Since(info.ModTime()).Seconds())
+	channel <- prometheus.MustNewConstMetric(exporter.socketFileIsSocket, prometheus.GaugeValue, boolToFloat64(info.Mode().Type() == fs.ModeSocket))
+}
@@ -0,0 +1,319 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+const (
+	statusAPIPackage         = "fastd.status.v1"
+	defaultWatchInterval     = 10 * time.Second
+	minimumWatchInterval     = time.Second
+	statusAPIServiceName     = statusAPIPackage + ".StatusService"
+	statusAPIDescriptorError = "invalid status API descriptor"
+)
+
+// statusAPIFile describes proto/fastd/status/v1/status.proto, which it has
+// to be kept in sync with, as checked by the tests. Building the descriptor
+// here spares generating code from the schema.
+var statusAPIFile = func() protoreflect.FileDescriptor {
+	field := func(name string, number int32, kind descriptorpb.FieldDescriptorProto_Type, typeName string) *descriptorpb.FieldDescriptorProto {
+		descriptor := &descriptorpb.FieldDescriptorProto{
+			Name:     proto.String(name),
+			JsonName: proto.String(name),
+			Number:   proto.Int32(number),
+			Label:    descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL.Enum(),
+			Type:     kind.Enum(),
+		}
+		if typeName != "" {
+			descriptor.TypeName = proto.String("." + statusAPIPackage + "." + typeName)
+		}
+		return descriptor
+	}
+	repeated := func(descriptor *descriptorpb.FieldDescriptorProto) *descriptorpb.FieldDescriptorProto {
+		descriptor.Label = descriptorpb.FieldDescriptorProto_LABEL_REPEATED.Enum()
+		return descriptor
+	}
+	message := func(name string, fields ...*descriptorpb.FieldDescriptorProto) *descriptorpb.DescriptorProto {
+		return &descriptorpb.DescriptorProto{Name: proto.String(name), Field: fields}
+	}
+
+	const (
+		typeString  = descriptorpb.FieldDescriptorProto_TYPE_STRING
+		typeDouble  = descriptorpb.FieldDescriptorProto_TYPE_DOUBLE
+		typeUint32  = descriptorpb.FieldDescriptorProto_TYPE_UINT32
+		typeUint64  = descriptorpb.FieldDescriptorProto_TYPE_UINT64
+		typeInt64   = descriptorpb.FieldDescriptorProto_TYPE_INT64
+		typeMessage = descriptorpb.FieldDescriptorProto_TYPE_MESSAGE
+	)
+
+	peersEntry := message("PeersEntry",
+		field("key", 1, typeString, ""),
+		field("value", 2, typeMessage, "Peer"),
+	)
+	peersEntry.Options = &descriptorpb.MessageOptions{MapEntry: proto.Bool(true)}
+	statusMessage := message("Status",
+		field("uptime", 1, typeDouble, ""),
+		field("interface", 2, typeString, ""),
+		field("statistics", 3, typeMessage, "Statistics"),
+		repeated(field("peers", 4, typeMessage, "Status.PeersEntry")),
+	)
+	statusMessage.NestedType = []*descriptorpb.DescriptorProto{peersEntry}
+
+	file := &descriptorpb.FileDescriptorProto{
+		Name:    proto.String("fastd/status/v1/status.proto"),
+		Package: proto.String(statusAPIPackage),
+		Syntax:  proto.String("proto3"),
+		MessageType: []*descriptorpb.DescriptorProto{
+			message("GetStatusRequest",
+				field("instance", 1, typeString, ""),
+			),
+			message("WatchStatusRequest",
+				field("instance", 1, typeString, ""),
+				field("interval_seconds", 2, typeUint32, ""),
+			),
+			message("InstanceStatus",
+				field("instance", 1, typeString, ""),
+				field("read_time_unix_nano", 2, typeInt64, ""),
+				field("status", 3, typeMessage, "Status"),
+			),
+			statusMessage,
+			message("Peer",
+				field("name", 1, typeString, ""),
+				field("address", 2, typeString, ""),
+				field("interface", 3, typeString, ""),
+				field("connection", 4, typeMessage, "Connection"),
+				repeated(field("mac_addresses", 5, typeString, "")),
+			),
+			message("Connection",
+				field("established", 1, typeDouble, ""),
+				field("method", 2, typeString, ""),
+				field("statistics", 3, typeMessage, "Statistics"),
+			),
+			message("Statistics",
+				field("rx", 1, typeMessage, "PacketStatistics"),
+				field("rx_reordered", 2, typeMessage, "PacketStatistics"),
+				field("tx", 3, typeMessage, "PacketStatistics"),
+				field("tx_dropped", 4, typeMessage, "PacketStatistics"),
+				field("tx_error", 5, typeMessage, "PacketStatistics"),
+			),
+			message("PacketStatistics",
+				field("packets", 1, typeUint64, ""),
+				field("bytes", 2, typeUint64, ""),
+			),
+		},
+	}
+
+	descriptor, err := protodesc.NewFile(file, nil)
+	if err != nil {
+		panic(fmt.Sprintf("%s: %v", statusAPIDescriptorError, err))
+	}
+	return descriptor
+}()
+
+// statusAPIMessage creates an empty message of the status API.
+func statusAPIMessage(name protoreflect.Name) *dynamicpb.Message {
+	return dynamicpb.NewMessage(statusAPIFile.Messages().ByName(name))
+}
+
+// statusAPIServer serves the status API for the instances of the exporter.
+type statusAPIServer struct {
+	exporters map[string]*PrometheusExporter
+}
+
+var statusAPIServiceDesc = grpc.ServiceDesc{
+	ServiceName: statusAPIServiceName,
+	HandlerType: (*interface{})(nil),
+	Methods: []grpc.MethodDesc{{
+		MethodName: "GetStatus",
+		Handler: func(srv interface{}, ctx context.Context, decode func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+			request := statusAPIMessage("GetStatusRequest")
+			if err := decode(request); err != nil {
+				return nil, err
+			}
+			return srv.(*statusAPIServer).getStatus(ctx, request)
+		},
+	}},
+	Streams: []grpc.StreamDesc{{
+		StreamName: "WatchStatus",
+		Handler: func(srv interface{}, stream grpc.ServerStream) error {
+			request := statusAPIMessage("WatchStatusRequest")
+			if err := stream.RecvMsg(request); err != nil {
+				return err
+			}
+			return srv.(*statusAPIServer).watchStatus(request, stream)
+		},
+		ServerStreams: true,
+	}},
+}
+
+// runStatusAPI serves the status API on --grpc.listen-address, with mutual
+// TLS unless --grpc.insecure is set.
+func runStatusAPI(exporters []*PrometheusExporter) error {
+	listener, err := net.Listen("tcp", *grpcListenAddress)
+	if err != nil {
+		return err
+	}
+
+	var options []grpc.ServerOption
+	if !*grpcInsecure {
+		config, err := agentTLSConfig(true)
+		if err != nil {
+			return err
+		}
+		options = append(options, grpc.Creds(credentials.NewTLS(config)))
+	}
+
+	server := &statusAPIServer{exporters: map[string]*PrometheusExporter{}}
+	for _, exporter := range exporters {
+		server.exporters[exporter.instance] = exporter
+	}
+
+	grpcServer := grpc.NewServer(options...)
+	grpcServer.RegisterService(&statusAPIServiceDesc, server)
+	go func() {
+		log.Fatal(grpcServer.Serve(listener))
+	}()
+	return nil
+}
+
+func (server *statusAPIServer) exporter(request *dynamicpb.Message) (*PrometheusExporter, error) {
+	instance := request.Get(request.Descriptor().Fields().ByName("instance")).String()
+	exporter, ok := server.exporters[instance]
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "unknown instance %q", instance)
+	}
+	return exporter, nil
+}
+
+func (server *statusAPIServer) getStatus(ctx context.Context, request *dynamicpb.Message) (*dynamicpb.Message, error) {
+	exporter, err := server.exporter(request)
+	if err != nil {
+		return nil, err
+	}
+	return exporter.instanceStatus(ctx)
+}
+
+func (server *statusAPIServer) watchStatus(request *dynamicpb.Message, stream grpc.ServerStream) error {
+	exporter, err := server.exporter(request)
+	if err != nil {
+		return err
+	}
+
+	interval := time.Duration(request.Get(request.Descriptor().Fields().ByName("interval_seconds")).Uint()) * time.Second
+	if interval == 0 {
+		interval = defaultWatchInterval
+	} else if interval < minimumWatchInterval {
+		interval = minimumWatchInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		response, err := exporter.instanceStatus(stream.Context())
+		if err != nil {
+			return err
+		}
+		if err := stream.SendMsg(response); err != nil {
+			return err
+		}
+
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// instanceStatus reads the status of the instance as InstanceStatus message.
+func (exporter *PrometheusExporter) instanceStatus(ctx context.Context) (*dynamicpb.Message, error) {
+	ctx, cancel := context.WithTimeout(ctx, exporter.settings.socketTimeout)
+	defer cancel()
+
+	data, readTime, err := exporter.status(ctx)
+	if err != nil {
+		return nil, status.Errorf(codes.Unavailable, "failed to read status of %s: %v", exporter.instance, err)
+	}
+
+	response := statusAPIMessage("InstanceStatus")
+	setField(response, "instance", protoreflect.ValueOfString(exporter.instance))
+	setField(response, "read_time_unix_nano", protoreflect.ValueOfInt64(readTime.UnixNano()))
+	setField(response, "status", protoreflect.ValueOfMessage(statusToProto(data)))
+	return response, nil
+}
+
+func setField(message *dynamicpb.Message, name protoreflect.Name, value protoreflect.Value) {
+	message.Set(message.Descriptor().Fields().ByName(name), value)
+}
+
+func statusToProto(data Message) *dynamicpb.Message {
+	message := statusAPIMessage("Status")
+	setField(message, "uptime", protoreflect.ValueOfFloat64(data.Uptime))
+	setField(message, "interface", protoreflect.ValueOfString(data.Interface))
+	setField(message, "statistics", protoreflect.ValueOfMessage(statisticsToProto(data.Statistics)))
+
+	peers := message.Mutable(message.Descriptor().Fields().ByName("peers")).Map()
+	for publicKey, peer := range data.Peers {
+		peerMessage := statusAPIMessage("Peer")
+		setField(peerMessage, "name", protoreflect.ValueOfString(publicPeerName(peer.Name)))
+		setField(peerMessage, "address", protoreflect.ValueOfString(peer.Address))
+		setField(peerMessage, "interface", protoreflect.ValueOfString(peer.Interface))
+
+		macs := peer.MAC
+		if peer.Connection != nil {
+			connection := statusAPIMessage("Connection")
+			setField(connection, "established", protoreflect.ValueOfFloat64(peer.Connection.Established))
+			setField(connection, "method", protoreflect.ValueOfString(peer.Connection.Method))
+			setField(connection, "statistics", protoreflect.ValueOfMessage(statisticsToProto(peer.Connection.Statistics)))
+			setField(peerMessage, "connection", protoreflect.ValueOfMessage(connection))
+			if len(macs) == 0 {
+				macs = peer.Connection.MAC
+			}
+		}
+
+		list := peerMessage.Mutable(peerMessage.Descriptor().Fields().ByName("mac_addresses")).List()
+		for _, mac := range macs {
+			list.Append(protoreflect.ValueOfString(mac))
+		}
+
+		peers.Set(protoreflect.ValueOfString(publicKey).MapKey(), protoreflect.ValueOfMessage(peerMessage))
+	}
+	return message
+}
+
+func statisticsToProto(statistics Statistics) *dynamicpb.Message {
+	packets := func(stats PacketStatistics) protoreflect.Value {
+		message := statusAPIMessage("PacketStatistics")
+		setField(message, "packets", protoreflect.ValueOfUint64(uint64(stats.Count)))
+		setField(message, "bytes", protoreflect.ValueOfUint64(uint64(stats.Bytes)))
+		return protoreflect.ValueOfMessage(message)
+	}
+
+	message := statusAPIMessage("Statistics")
+	setField(message, "rx", packets(statistics.Rx))
+	setField(message, "tx", packets(statistics.Tx))
+	if statistics.RxReordered != nil {
+		setField(message, "rx_reordered", packets(*statistics.RxReordered))
+	}
+	if statistics.TxDropped != nil {
+		setField(message, "tx_dropped", packets(*statistics.TxDropped))
+	}
+	if statistics.TxError != nil {
+		setField(message, "tx_error", packets(*statistics.TxError))
+	}
+	return message
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+var (
+	protoMessagePattern = regexp.MustCompile(`(?ms)^message (\w+) \{\n(.*?)^\}`)
+	protoFieldPattern   = regexp.MustCompile(`(?m)^\s*(repeated )?(map<string, \w+>|\w+) (\w+) = (\d+);`)
+	protoRPCPattern     = regexp.MustCompile(`(?m)^\s*rpc (\w+)\(\w+\) returns \((stream )?\w+\);`)
+)
+
+// protoField formats a field the same for the schema and the descriptor.
+func protoField(repeated bool, kind string, name string, number int) string {
+	field := kind + " " + name + " = " + strconv.Itoa(number)
+	if repeated {
+		return "repeated " + field
+	}
+	return field
+}
+
+// schemaMessages returns the fields of the messages in status.proto.
+func schemaMessages(t *testing.T) (map[string][]string, []string) {
+	data, err := os.ReadFile("proto/fastd/status/v1/status.proto")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	messages := map[string][]string{}
+	for _, match := range protoMessagePattern.FindAllStringSubmatch(string(data), -1) {
+		var fields []string
+		for _, field := range protoFieldPattern.FindAllStringSubmatch(match[2], -1) {
+			number, _ := strconv.Atoi(field[4])
+			fields = append(fields, protoField(field[1] != "", field[2], field[3], number))
+		}
+		sort.Strings(fields)
+		messages[match[1]] = fields
+	}
+
+	var rpcs []string
+	for _, match := range protoRPCPattern.FindAllStringSubmatch(string(data), -1) {
+		rpcs = append(rpcs, match[2]+match[1])
+	}
+	sort.Strings(rpcs)
+	return messages, rpcs
+}
+
+// descriptorKind returns the type of a field as written in the schema.
+func descriptorKind(field protoreflect.FieldDescriptor) string {
+	if field.IsMap() {
+		return "map<" + descriptorKind(field.MapKey()) + ", " + descriptorKind(field.MapValue()) + ">"
+	}
+	if field.Kind() == protoreflect.MessageKind {
+		return string(field.Message().Name())
+	}
+	return field.Kind().String()
+}
+
+func TestStatusAPIDescriptorMatchesSchema(t *testing.T) {
+	schema, schemaRPCs := schemaMessages(t)
+	if len(schema) == 0 || len(schemaRPCs) == 0 {
+		t.Fatal("no messages or rpcs found in the schema")
+	}
+
+	messages := map[string][]string{}
+	for i := 0; i < statusAPIFile.Messages().Len(); i++ {
+		message := statusAPIFile.Messages().Get(i)
+		var fields []string
+		for j := 0; j < message.Fields().Len(); j++ {
+			field := message.Fields().Get(j)
+			repeated := field.Cardinality() == protoreflect.Repeated && !field.IsMap()
+			fields = append(fields, protoField(repeated, descriptorKind(field), string(field.Name()), int(field.Number())))
+		}
+		sort.Strings(fields)
+		messages[string(message.Name())] = fields
+	}
+
+	for name, fields := range schema {
+		if _, ok := messages[name]; !ok {
+			t.Errorf("message %s of the schema is missing in the descriptor", name)
+			continue
+		}
+		if strings.Join(fields, "; ") != strings.Join(messages[name], "; ") {
+			t.Errorf("message %s differs:\nschema:     %s\ndescriptor: %s", name, strings.Join(fields, "; "), strings.Join(messages[name], "; "))
+		}
+	}
+	for name := range messages {
+		if _, ok := schema[name]; !ok {
+			t.Errorf("message %s of the descriptor is missing in the schema", name)
+		}
+	}
+
+	var rpcs []string
+	for _, method := range statusAPIServiceDesc.Methods {
+		rpcs = append(rpcs, method.MethodName)
+	}
+	for _, stream := range statusAPIServiceDesc.Streams {
+		rpcs = append(rpcs, "stream "+stream.StreamName)
+	}
+	sort.Strings(rpcs)
+	if strings.Join(rpcs, ", ") != strings.Join(schemaRPCs, ", ") {
+		t.Errorf("service differs:\nschema:     %v\ndescriptor: %v", schemaRPCs, rpcs)
+	}
+}
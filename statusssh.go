@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"os/user"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+	"golang.org/x/net/proxy"
+)
+
+// status sockets on other hosts, forwarded over SSH
+const statusSSHScheme = "ssh://"
+
+// sshClients are the SSH connections to the hosts of status sockets, reused
+// across scrapes and dropped once forwarding over them fails.
+var sshClients = struct {
+	sync.Mutex
+	hosts map[string]*sshHost
+}{hosts: map[string]*sshHost{}}
+
+// sshHost holds the connection to a host. Its lock is held while
+// connecting, so reads of other hosts do not wait for the handshake.
+type sshHost struct {
+	sync.Mutex
+	client *ssh.Client
+}
+
+var sshConfig struct {
+	once    sync.Once
+	auth    []ssh.AuthMethod
+	hostKey ssh.HostKeyCallback
+	err     error
+}
+
+// setupSSH loads the keys from --ssh.identity-file or the SSH agent and the
+// known hosts from --ssh.known-hosts, defaulting to those in ~/.ssh.
+func setupSSH() {
+	home, _ := os.UserHomeDir()
+
+	knownHosts := *sshKnownHosts
+	if knownHosts == "" {
+		knownHosts = filepath.Join(home, ".ssh", "known_hosts")
+	}
+	sshConfig.hostKey, sshConfig.err = knownhosts.New(knownHosts)
+	if sshConfig.err != nil {
+		return
+	}
+
+	var signers []ssh.Signer
+	identities := []string{*sshIdentityFile}
+	if *sshIdentityFile == "" {
+		identities = []string{filepath.Join(home, ".ssh", "id_ed25519"), filepath.Join(home, ".ssh", "id_ecdsa"), filepath.Join(home, ".ssh", "id_rsa")}
+	}
+	for _, identity := range identities {
+		data, err := os.ReadFile(identity)
+		if errors.Is(err, os.ErrNotExist) && *sshIdentityFile == "" {
+			continue
+		} else if err != nil {
+			sshConfig.err = err
+			return
+		}
+		signer, err := ssh.ParsePrivateKey(data)
+		if err != nil {
+			sshConfig.err = fmt.Errorf("failed to parse %s: %w", identity, err)
+			return
+		}
+		signers = append(signers, signer)
+	}
+	if len(signers) != 0 {
+		sshConfig.auth = append(sshConfig.auth, ssh.PublicKeys(signers...))
+	}
+
+	if socket := os.Getenv("SSH_AUTH_SOCK"); socket != "" {
+		if conn, err := net.Dial("unix", socket); err == nil {
+			sshConfig.auth = append(sshConfig.auth, ssh.PublicKeysCallback(agent.NewClient(conn).Signers))
+		}
+	}
+	if len(sshConfig.auth) == 0 {
+		sshConfig.err = errors.New("no SSH identity found, set --ssh.identity-file")
+	}
+}
+
+// dialSSHStatusSocket connects to a status socket given as
+// ssh://[user@]host[:port]/path, forwarded over an SSH connection to the
+// host, so no socat is needed there.
+func dialSSHStatusSocket(ctx context.Context, sock string, tcpDialer proxy.ContextDialer, deadline time.Time) (net.Conn, error) {
+	parsed, err := url.Parse(sock)
+	if err != nil {
+		return nil, fmt.Errorf("invalid status socket %s: %w", sock, err)
+	}
+	address := parsed.Host
+	if parsed.Port() == "" {
+		address = net.JoinHostPort(parsed.Hostname(), "22")
+	}
+	username := parsed.User.Username()
+	if username == "" {
+		if current, err := user.Current(); err == nil {
+			username = current.Username
+		}
+	}
+
+	host := sshClientHost(username + "@" + address)
+	client, err := host.connect(ctx, username, address, tcpDialer, deadline)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := client.Dial("unix", parsed.Path)
+	if err != nil {
+		// the connection may be broken, reconnect on the next read
+		host.Lock()
+		if host.client == client {
+			host.client = nil
+		}
+		host.Unlock()
+		_ = client.Close()
+		return nil, err
+	}
+	return &sshStatusConn{Conn: conn}, nil
+}
+
+// sshClientHost returns the connection state of user@host:port.
+func sshClientHost(key string) *sshHost {
+	sshClients.Lock()
+	defer sshClients.Unlock()
+
+	host, ok := sshClients.hosts[key]
+	if !ok {
+		host = &sshHost{}
+		sshClients.hosts[key] = host
+	}
+	return host
+}
+
+// connect returns the SSH connection to the host, connecting if there is
+// none yet.
+func (host *sshHost) connect(ctx context.Context, username string, address string, tcpDialer proxy.ContextDialer, deadline time.Time) (*ssh.Client, error) {
+	sshConfig.once.Do(setupSSH)
+	if sshConfig.err != nil {
+		return nil, sshConfig.err
+	}
+
+	host.Lock()
+	defer host.Unlock()
+
+	if host.client != nil {
+		return host.client, nil
+	}
+
+	conn, err := tcpDialer.DialContext(ctx, "tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	// the timeout of the client config only applies to its own dialing,
+	// the deadline covers the handshake
+	_ = conn.SetDeadline(deadline)
+	clientConn, channels, requests, err := ssh.NewClientConn(conn, address, &ssh.ClientConfig{
+		User:            username,
+		Auth:            sshConfig.auth,
+		HostKeyCallback: sshConfig.hostKey,
+	})
+	if err != nil {
+		_ = conn.Close()
+		// failed handshakes count as failed connections
+		return nil, &net.OpError{Op: "dial", Net: "tcp", Err: err}
+	}
+	_ = conn.SetDeadline(time.Time{})
+
+	host.client = ssh.NewClient(clientConn, channels, requests)
+	return host.client, nil
+}
+
+// sshStatusConn implements the deadline of a status read, which forwarded
+// SSH channels do not support, by closing the channel.
+type sshStatusConn struct {
+	net.Conn
+	timer *time.Timer
+}
+
+func (conn *sshStatusConn) SetDeadline(deadline time.Time) error {
+	if conn.timer != nil {
+		conn.timer.Stop()
+	}
+	if !deadline.IsZero() {
+		conn.timer = time.AfterFunc(time.Until(deadline), func() {
+			_ = conn.Conn.Close()
+		})
+	}
+	return nil
+}
+
+func (conn *sshStatusConn) Close() error {
+	if conn.timer != nil {
+		conn.timer.Stop()
+	}
+	return conn.Conn.Close()
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+const (
+	// status sockets exposed over TCP, e.g. with socat, and over TLS
+	statusTCPScheme = "tcp://"
+	statusTLSScheme = "tls://"
+)
+
+// statusTLSConfig is used for status sockets given as tls://host:port.
+var statusTLSConfig *tls.Config
+
+// setupStatusTLS loads the CA and client certificate for status sockets read
+// over TLS.
+func setupStatusTLS() error {
+	config := &tls.Config{
+		ServerName:         *statusTLSServerName,
+		InsecureSkipVerify: *statusTLSInsecure,
+	}
+
+	if *statusTLSCA != "" {
+		data, err := os.ReadFile(*statusTLSCA)
+		if err != nil {
+			return err
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(data) {
+			return fmt.Errorf("no certificates found in %s", *statusTLSCA)
+		}
+	}
+
+	if *statusTLSCert != "" || *statusTLSKey != "" {
+		if *statusTLSCert == "" || *statusTLSKey == "" {
+			return errors.New("--status-tls.cert and --status-tls.key must be given together")
+		}
+		certificate, err := tls.LoadX509KeyPair(*statusTLSCert, *statusTLSKey)
+		if err != nil {
+			return err
+		}
+		config.Certificates = []tls.Certificate{certificate}
+	}
+
+	statusTLSConfig = config
+	return nil
+}
+
+// isRemoteStatusSocket reports whether a status socket is read over the
+// network.
+func isRemoteStatusSocket(sock string) bool {
+	return strings.HasPrefix(sock, statusTCPScheme) || strings.HasPrefix(sock, statusTLSScheme) || strings.HasPrefix(sock, statusSSHScheme)
+}
+
+// dialStatusSocket connects to a local status socket or to one given as
+// tcp://host:port, tls://host:port or ssh://host/path, through the SOCKS5 proxy if given and
+// from within the network namespace if given.
+func dialStatusSocket(ctx context.Context, sock string, settings instanceSettings, deadline time.Time) (net.Conn, error) {
+	if settings.netns == "" {
+		return dialStatusSocketDirect(ctx, sock, settings.socketProxy, deadline)
+	}
+	return dialInNetns(settings.netns, func() (net.Conn, error) {
+		return dialStatusSocketDirect(ctx, sock, settings.socketProxy, deadline)
+	})
+}
+
+func dialStatusSocketDirect(ctx context.Context, sock string, proxyURL string, deadline time.Time) (net.Conn, error) {
+	dialer := &net.Dialer{Deadline: deadline}
+	if !isRemoteStatusSocket(sock) {
+		return dialer.DialContext(ctx, "unix", sock)
+	}
+
+	var tcpDialer proxy.ContextDialer = dialer
+	if proxyURL != "" {
+		var err error
+		if tcpDialer, err = socksDialer(proxyURL, dialer); err != nil {
+			return nil, err
+		}
+	}
+
+	if strings.HasPrefix(sock, statusTCPScheme) {
+		return tcpDialer.DialContext(ctx, "tcp", strings.TrimPrefix(sock, statusTCPScheme))
+	}
+	if strings.HasPrefix(sock, statusSSHScheme) {
+		return dialSSHStatusSocket(ctx, sock, tcpDialer, deadline)
+	}
+
+	address := strings.TrimPrefix(sock, statusTLSScheme)
+	conn, err := tcpDialer.DialContext(ctx, "tcp", address)
+	if err != nil {
+		return nil, err
+	}
+
+	config := statusTLSConfig.Clone()
+	if config == nil {
+		config = &tls.Config{}
+	}
+	if config.ServerName == "" {
+		config.ServerName, _, _ = net.SplitHostPort(address)
+	}
+	tlsConn := tls.Client(conn, config)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		_ = conn.Close()
+		// failed handshakes count as failed connections
+		return nil, &net.OpError{Op: "dial", Net: "tcp", Err: err}
+	}
+	return tlsConn, nil
+}
+
+// socksDialer returns a dialer connecting through the SOCKS5 proxy at
+// proxyURL.
+func socksDialer(proxyURL string, forward *net.Dialer) (proxy.ContextDialer, error) {
+	parsed, err := url.Parse(proxyURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid status socket proxy: %w", err)
+	}
+	if parsed.Scheme != "socks5" && parsed.Scheme != "socks5h" {
+		return nil, fmt.Errorf("unsupported status socket proxy scheme %q", parsed.Scheme)
+	}
+
+	dialer, err := proxy.FromURL(parsed, forward)
+	if err != nil {
+		return nil, fmt.Errorf("invalid status socket proxy: %w", err)
+	}
+	return dialer.(proxy.ContextDialer), nil
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"regexp"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// handshakeStormMinAttempts keeps small instances from reporting a storm
+// because of a few peers reconnecting at once.
+const handshakeStormMinAttempts = 20
+
+// fastd logs the start of every handshake exchange at the verbose log
+// level, the handshake it sends to or receives from a peer, with the name of
+// the peer, or its key if it has no name, in angle brackets. The responses
+// and the established sessions belong to the same exchange and are not
+// counted.
+var handshakeAttemptPattern = regexp.MustCompile(`(?:sending handshake to|received handshake from) <[^>]+>`)
+
+// recordHandshakeAttempt counts a handshake exchange seen in the log or
+// reported by the verify hook.
+func (exporter *PrometheusExporter) recordHandshakeAttempt(attemptTime time.Time) {
+	exporter.handshakesMutex.Lock()
+	defer exporter.handshakesMutex.Unlock()
+
+	exporter.handshakeCount += 1
+	expired := 0
+	for expired < len(exporter.handshakeWindow) && attemptTime.Sub(exporter.handshakeWindow[expired]) > time.Minute {
+		expired += 1
+	}
+	exporter.handshakeWindow = append(exporter.handshakeWindow[expired:], attemptTime)
+}
+
+// collectHandshakeStorm exports the handshake exchanges and whether those
+// of the last minute exceed --handshake-storm.ratio per connected peer,
+// which happens when sessions keep failing, e.g. because of an MTU or key
+// mismatch after a config push.
+func (exporter *PrometheusExporter) collectHandshakeStorm(channel chan<- prometheus.Metric, peersUp int) {
+	exporter.handshakesMutex.Lock()
+	defer exporter.handshakesMutex.Unlock()
+
+	attempts := 0
+	for _, attemptTime := range exporter.handshakeWindow {
+		if time.Since(attemptTime) <= time.Minute {
+			attempts += 1
+		}
+	}
+
+	if peersUp < 1 {
+		peersUp = 1
+	}
+	storm := attempts >= handshakeStormMinAttempts && float64(attempts) > *handshakeStormRatio*float64(peersUp)
+	channel <- prometheus.MustNewConstMetric(exporter.handshakeAttempts, prometheus.CounterValue, float64(exporter.handshakeCount))
+	channel <- prometheus.MustNewConstMetric(exporter.handshakeStorm, prometheus.GaugeValue, boolToFloat64(storm))
+}
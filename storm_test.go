@@ -0,0 +1,37 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestHandshakeExchangesCountedOnce(t *testing.T) {
+	exporter := NewPrometheusExporter("dom0", fastdConfig{})
+	start := time.Unix(0, 0)
+	for i, line := range []string{
+		// an exchange started by the gateway
+		"sending handshake to <node1>[192.0.2.1:10000]...",
+		"received handshake response from <node1>[192.0.2.1:10000] using fastd v22",
+		"new session with <node1> established using method `salsa2012+umac'.",
+		// an exchange started by the peer
+		"received handshake from <node2>[192.0.2.2:10000] using fastd v22",
+		"sending handshake response to <node2>[192.0.2.2:10000]...",
+		"connection with <node2> established.",
+		"resolving host `gw01.example.net' for peer <node3>...",
+	} {
+		exporter.recordLogLine(line, start.Add(time.Duration(i)*time.Second))
+	}
+
+	if exporter.handshakeCount != 2 {
+		t.Errorf("got %d handshake exchanges, want 2", exporter.handshakeCount)
+	}
+	if len(exporter.handshakes) != 2 {
+		t.Errorf("got established sessions of %v, want node1 and node2", exporter.handshakes)
+	}
+
+	// the window only keeps the last minute, the counter everything
+	exporter.recordHandshakeAttempt(start.Add(2 * time.Minute))
+	if exporter.handshakeCount != 3 || len(exporter.handshakeWindow) != 1 {
+		t.Errorf("got %d exchanges and %d in the window, want 3 and 1", exporter.handshakeCount, len(exporter.handshakeWindow))
+	}
+}
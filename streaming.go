@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"time"
+)
+
+// streamMaxAge is the age after which a snapshot received over a streaming
+// status connection is no longer used and the status socket is read again.
+const streamMaxAge = time.Minute
+
+// runStatusStream keeps a connection to the status socket of an instance
+// open, for fastd versions that send a new status over it whenever it
+// changes, and updates the cached status with every message. fastd versions
+// that close the connection after the first status keep being read on every
+// poll.
+func (exporter *PrometheusExporter) runStatusStream() {
+	if _, ok := statusFilePath(exporter.statusSocketPath); ok {
+		return
+	}
+	if _, ok := agentSnapshotKey(exporter.statusSocketPath); ok {
+		return
+	}
+
+	backoff := *socketRetryBackoff
+	for {
+		streamed, err := exporter.readStatusStream()
+		exporter.mutex.Lock()
+		exporter.streaming = false
+		exporter.mutex.Unlock()
+		if !streamed && err == nil {
+			log.Printf("fastd of %s does not keep the status connection open, reading it on every poll", exporter.instance)
+			return
+		}
+		if streamed {
+			backoff = *socketRetryBackoff
+		}
+		logRepeated("Status stream of %s failed: %v", exporter.instance, err)
+
+		time.Sleep(backoff)
+		if backoff < streamMaxAge {
+			backoff *= 2
+		}
+	}
+}
+
+// readStatusStream reads status messages from a single connection until it
+// fails. It reports whether more than one message was received, which
+// means fastd streams its status, and a nil error if fastd closed the
+// connection after the first message.
+func (exporter *PrometheusExporter) readStatusStream() (bool, error) {
+	deadline := time.Now().Add(exporter.settings.socketTimeout)
+	conn, err := dialStatusSocket(context.Background(), exporter.statusSocketPath, exporter.settings, deadline)
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+
+	decoder := json.NewDecoder(conn)
+	for messages := 0; ; messages++ {
+		// the first status is sent right away, updates whenever they happen
+		if messages == 0 {
+			err = conn.SetDeadline(deadline)
+		} else {
+			err = conn.SetDeadline(time.Time{})
+		}
+		if err != nil {
+			return false, err
+		}
+
+		msg, err := decodeStatusMessage(decoder)
+		if errors.Is(err, io.EOF) && messages == 1 {
+			return false, nil
+		} else if err != nil {
+			return messages > 1, err
+		}
+
+		exporter.mutex.Lock()
+		exporter.lastMessage, exporter.lastError, exporter.lastRead = msg, nil, time.Now()
+		exporter.ready = true
+		exporter.streaming = messages > 0
+		exporter.journal.record(msg, exporter.lastRead)
+		exporter.mutex.Unlock()
+	}
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"net"
+	"os"
+	"strings"
+)
+
+// sdNotify sends a state update to systemd's notification socket. It does
+// nothing if the exporter was not started by a Type=notify unit.
+func sdNotify(state string) error {
+	socketPath := os.Getenv("NOTIFY_SOCKET")
+	if socketPath == "" {
+		return nil
+	}
+	if strings.HasPrefix(socketPath, "@") {
+		// abstract namespace socket
+		socketPath = "\x00" + socketPath[1:]
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socketPath, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer func(conn *net.UnixConn) {
+		_ = conn.Close()
+	}(conn)
+
+	_, err = conn.Write([]byte(state))
+	return err
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// systemdUnitDirectories are searched for unit files and their drop-ins, in
+// order of precedence.
+var systemdUnitDirectories = []string{"/etc/systemd/system", "/run/systemd/system", "/usr/local/lib/systemd/system", "/usr/lib/systemd/system", "/lib/systemd/system"}
+
+// socketFromSystemdUnit returns the status socket given with --status-socket
+// in the ExecStart of the systemd unit of an instance, for distributions that
+// configure it on the command line instead of in the fastd config.
+func socketFromSystemdUnit(instance string) (string, error) {
+	unit := fmt.Sprintf(*socketSystemdUnit, instance)
+	units := []string{unit}
+	if template := systemdTemplate(unit); template != "" {
+		units = []string{template, unit}
+	}
+
+	var files []string
+	for _, name := range units {
+		for _, directory := range systemdUnitDirectories {
+			path := filepath.Join(directory, name)
+			if _, err := os.Stat(path); err == nil {
+				files = append(files, path)
+				break
+			}
+		}
+	}
+	if len(files) == 0 {
+		return "", fmt.Errorf("unit %s not found", unit)
+	}
+	for _, name := range units {
+		files = append(files, systemdDropIns(name)...)
+	}
+
+	var execStart []string
+	for _, path := range files {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return "", err
+		}
+		for _, value := range systemdExecStart(data) {
+			if value == "" {
+				// an empty ExecStart resets the ones before
+				execStart = nil
+				continue
+			}
+			execStart = append(execStart, value)
+		}
+	}
+
+	for _, command := range execStart {
+		command = strings.NewReplacer("%i", instance, "%I", instance).Replace(command)
+		fields := strings.Fields(command)
+		for i, field := range fields {
+			if strings.HasPrefix(field, "--status-socket=") {
+				return strings.Trim(strings.TrimPrefix(field, "--status-socket="), `"'`), nil
+			}
+			if field == "--status-socket" && i+1 < len(fields) {
+				return strings.Trim(fields[i+1], `"'`), nil
+			}
+		}
+	}
+	return "", errors.New("no --status-socket in ExecStart of " + unit)
+}
+
+// systemdTemplate returns the template of an instantiated unit like
+// fastd@dom0.service, or an empty string for other units.
+func systemdTemplate(unit string) string {
+	at := strings.Index(unit, "@")
+	dot := strings.LastIndex(unit, ".")
+	if at < 0 || dot <= at+1 {
+		return ""
+	}
+	return unit[:at+1] + unit[dot:]
+}
+
+// systemdDropIns returns the drop-in files of a unit sorted by their name,
+// where drop-ins of the same name in directories of higher precedence replace
+// those in the others.
+func systemdDropIns(unit string) []string {
+	dropIns := map[string]string{}
+	for i := len(systemdUnitDirectories) - 1; i >= 0; i-- {
+		matches, _ := filepath.Glob(filepath.Join(systemdUnitDirectories[i], unit+".d", "*.conf"))
+		for _, path := range matches {
+			dropIns[filepath.Base(path)] = path
+		}
+	}
+
+	var names []string
+	for name := range dropIns {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	files := make([]string, 0, len(names))
+	for _, name := range names {
+		files = append(files, dropIns[name])
+	}
+	return files
+}
+
+// systemdExecStart returns the values of the ExecStart settings in the
+// [Service] section of a unit file, with continuation lines joined.
+func systemdExecStart(data []byte) []string {
+	var values []string
+	var line string
+	section := ""
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line += strings.TrimSpace(scanner.Text())
+		if strings.HasSuffix(line, `\`) {
+			line = strings.TrimSuffix(line, `\`) + " "
+			continue
+		}
+
+		switch {
+		case strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";"):
+		case strings.HasPrefix(line, "["):
+			section = line
+		case section == "[Service]":
+			if key, value, ok := strings.Cut(line, "="); ok && strings.TrimSpace(key) == "ExecStart" {
+				// strip the prefixes changing how the command is executed
+				values = append(values, strings.TrimLeft(strings.TrimSpace(value), "-@:+!"))
+			}
+		}
+		line = ""
+	}
+	return values
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// writeUnitFile creates a unit file or drop-in below a unit directory.
+func writeUnitFile(t *testing.T, directory string, name string, content string) {
+	t.Helper()
+	path := filepath.Join(directory, name)
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// testUnitDirectories replaces the unit directories with an /etc and a /lib
+// one for the duration of a test.
+func testUnitDirectories(t *testing.T) (string, string) {
+	t.Helper()
+	etc, lib := t.TempDir(), t.TempDir()
+	directories, unit := systemdUnitDirectories, *socketSystemdUnit
+	systemdUnitDirectories = []string{etc, lib}
+	*socketSystemdUnit = "fastd@%s.service"
+	t.Cleanup(func() {
+		systemdUnitDirectories, *socketSystemdUnit = directories, unit
+	})
+	return etc, lib
+}
+
+func TestSocketFromSystemdUnit(t *testing.T) {
+	etc, lib := testUnitDirectories(t)
+	writeUnitFile(t, lib, "fastd@.service", `[Unit]
+Description=fastd %i
+
+[Service]
+ExecStart=/usr/bin/fastd --config /etc/fastd/%i/fastd.conf --status-socket /run/fastd-%i.sock
+`)
+	if socket, err := socketFromSystemdUnit("dom0"); err != nil || socket != "/run/fastd-dom0.sock" {
+		t.Errorf("template: got %q, %v", socket, err)
+	}
+
+	// drop-ins reset the ExecStart of the template, and those in /etc
+	// replace the ones of the same name in /lib
+	writeUnitFile(t, lib, "fastd@.service.d/10-socket.conf", "[Service]\nExecStart=\nExecStart=/usr/bin/fastd --status-socket=/run/lib/%i.sock\n")
+	writeUnitFile(t, etc, "fastd@.service.d/10-socket.conf", `[Service]
+ExecStart=
+# the socket of the instance
+ExecStart=-/usr/bin/fastd --config /etc/fastd/%I/fastd.conf \
+	--status-socket="/run/fastd/%I.sock"
+`)
+	if socket, err := socketFromSystemdUnit("dom0"); err != nil || socket != "/run/fastd/dom0.sock" {
+		t.Errorf("drop-in: got %q, %v", socket, err)
+	}
+
+	// drop-ins of the instance come after those of the template
+	writeUnitFile(t, etc, "fastd@dom1.service.d/socket.conf", "[Service]\nExecStart=\nExecStart=/usr/bin/fastd --status-socket /run/dom1.sock\n")
+	if socket, err := socketFromSystemdUnit("dom1"); err != nil || socket != "/run/dom1.sock" {
+		t.Errorf("instance drop-in: got %q, %v", socket, err)
+	}
+}
+
+func TestSocketFromSystemdUnitMissing(t *testing.T) {
+	_, lib := testUnitDirectories(t)
+	if _, err := socketFromSystemdUnit("dom0"); err == nil {
+		t.Error("socket from a unit that does not exist")
+	}
+
+	writeUnitFile(t, lib, "fastd@.service", "[Install]\nExecStart=/usr/bin/fastd --status-socket /run/fastd.sock\n\n[Service]\nExecStart=/usr/bin/fastd --config /etc/fastd/%i/fastd.conf\n")
+	if socket, err := socketFromSystemdUnit("dom0"); err == nil {
+		t.Errorf("got socket %q from a unit without --status-socket in its [Service] section", socket)
+	}
+}
+
+func TestSystemdTemplate(t *testing.T) {
+	for unit, want := range map[string]string{
+		"fastd@dom0.service": "fastd@.service",
+		"fastd@.service":     "",
+		"fastd.service":      "",
+		"fastd@dom0":         "",
+	} {
+		if got := systemdTemplate(unit); got != want {
+			t.Errorf("template of %s: got %q, want %q", unit, got, want)
+		}
+	}
+}
+
+func TestSystemdExecStart(t *testing.T) {
+	got := systemdExecStart([]byte(`[Service]
+; a comment
+ExecStartPre=/bin/true
+ExecStart = +/usr/bin/fastd\
+  --daemon
+ExecStart=
+`))
+	if want := []string{"/usr/bin/fastd --daemon", ""}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
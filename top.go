@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"golang.org/x/term"
+)
+
+// topPeer is a row of the top view.
+type topPeer struct {
+	publicKey string
+	peer      Peer
+	rxRate    float64
+	txRate    float64
+}
+
+// topSortKeys maps the keys pressed in the top view to the column sorted by.
+var topSortKeys = map[byte]string{
+	'r': "rx",
+	't': "tx",
+	'b': "total",
+	'n': "name",
+	'u': "uptime",
+}
+
+// runTop implements the top subcommand, which shows a live table of the peers
+// of an instance sorted by their throughput, read from its status socket.
+func runTop(args []string) error {
+	flags := flag.NewFlagSet("top", flag.ExitOnError)
+	instance := flags.String("instance", "", "fastd instance to show the peers of.")
+	socket := flags.String("socket", "", "Status socket (or file://) of the instance, read from its fastd config if empty.")
+	interval := flags.Duration("interval", 2*time.Second, "Interval in which the view is refreshed.")
+	sortBy := flags.String("sort", "total", "Column to sort by: rx, tx, total, name or uptime. Can be changed with the keys r, t, b, n and u.")
+	flags.Var(&configPathPatterns, "config-path", "Override fastd config path, %s will be replaced with the fastd instance name.")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *instance == "" {
+		return errors.New("--instance is required")
+	}
+
+	statusSocketPath := *socket
+	if statusSocketPath == "" {
+		config, err := parseConfig(*instance)
+		if err != nil {
+			return err
+		}
+		statusSocketPath = config.statusSocketPath
+	}
+	settings := exporterConfig.instanceSettings(*instance)
+
+	// read single keys to change the sorting while running in a terminal
+	keys := make(chan byte)
+	if term.IsTerminal(int(os.Stdin.Fd())) {
+		state, err := term.MakeRaw(int(os.Stdin.Fd()))
+		if err != nil {
+			return err
+		}
+		defer func() {
+			_ = term.Restore(int(os.Stdin.Fd()), state)
+		}()
+
+		go func() {
+			buffer := make([]byte, 1)
+			for {
+				if _, err := os.Stdin.Read(buffer); err != nil {
+					close(keys)
+					return
+				}
+				keys <- buffer[0]
+			}
+		}()
+	}
+
+	ticker := time.NewTicker(*interval)
+	defer ticker.Stop()
+
+	var previous Message
+	var previousRead time.Time
+	var peers []topPeer
+	var header string
+
+	for refresh := true; ; {
+		if refresh {
+			ctx, cancel := context.WithTimeout(context.Background(), settings.socketTimeout)
+			data, err := readStatus(ctx, statusSocketPath, settings)
+			cancel()
+			readTime := time.Now()
+
+			if err != nil {
+				header = fmt.Sprintf("%s: %v", *instance, err)
+				peers = nil
+			} else {
+				peers = topPeers(data, previous, readTime.Sub(previousRead))
+				header = fmt.Sprintf("%s  uptime %s  peers up %d/%d  %s",
+					*instance, time.Duration(data.Uptime)*time.Millisecond/time.Second*time.Second,
+					len(peers), len(data.Peers), readTime.Format("15:04:05"))
+				previous, previousRead = data, readTime
+			}
+		}
+
+		sortTopPeers(peers, *sortBy)
+		renderTop(header, *sortBy, peers)
+
+		refresh = false
+		select {
+		case <-ticker.C:
+			refresh = true
+		case key, ok := <-keys:
+			if !ok || key == 'q' || key == 3 {
+				return nil
+			}
+			if column, ok := topSortKeys[key]; ok {
+				*sortBy = column
+			}
+		}
+	}
+}
+
+// topPeers returns the connected peers with their throughput since the
+// previous read.
+func topPeers(data Message, previous Message, elapsed time.Duration) []topPeer {
+	var peers []topPeer
+	for publicKey, peer := range data.Peers {
+		if peer.Connection == nil {
+			continue
+		}
+
+		row := topPeer{publicKey: publicKey, peer: peer}
+		last, ok := previous.Peers[publicKey]
+		if ok && last.Connection != nil && elapsed > 0 {
+			rx := peer.Connection.Statistics.Rx.Bytes - last.Connection.Statistics.Rx.Bytes
+			tx := peer.Connection.Statistics.Tx.Bytes - last.Connection.Statistics.Tx.Bytes
+			if rx >= 0 && tx >= 0 {
+				row.rxRate = float64(rx) / elapsed.Seconds()
+				row.txRate = float64(tx) / elapsed.Seconds()
+			}
+		}
+		peers = append(peers, row)
+	}
+
+	return peers
+}
+
+func sortTopPeers(peers []topPeer, column string) {
+	sort.SliceStable(peers, func(i, j int) bool {
+		a, b := peers[i], peers[j]
+		switch column {
+		case "rx":
+			return a.rxRate > b.rxRate
+		case "tx":
+			return a.txRate > b.txRate
+		case "name":
+			return a.peer.Name < b.peer.Name
+		case "uptime":
+			return a.peer.Connection.Established > b.peer.Connection.Established
+		default:
+			return a.rxRate+a.txRate > b.rxRate+b.txRate
+		}
+	})
+}
+
+func renderTop(header string, column string, peers []topPeer) {
+	rows := len(peers)
+	if _, height, err := term.GetSize(int(os.Stdout.Fd())); err == nil && height-4 < rows {
+		rows = height - 4
+		if rows < 0 {
+			rows = 0
+		}
+	}
+
+	var out strings.Builder
+	out.WriteString("\033[H\033[2J")
+	fmt.Fprintf(&out, "%s  sorted by %s\n\n", header, column)
+	fmt.Fprintf(&out, "%-24s %-40s %-16s %10s %10s %10s %10s %10s\n", "NAME", "ADDRESS", "METHOD", "UPTIME", "RX/s", "TX/s", "RX", "TX")
+	for _, row := range peers[:rows] {
+		statistics := row.peer.Connection.Statistics
+		fmt.Fprintf(&out, "%-24.24s %-40.40s %-16.16s %10s %10s %10s %10s %10s\n",
+			row.peer.Name, row.peer.Address, row.peer.Connection.Method,
+			time.Duration(row.peer.Connection.Established)*time.Millisecond/time.Second*time.Second,
+			formatBytes(row.rxRate), formatBytes(row.txRate),
+			formatBytes(float64(statistics.Rx.Bytes)), formatBytes(float64(statistics.Tx.Bytes)))
+	}
+
+	// raw terminals do not return the carriage on line feeds
+	_, _ = os.Stdout.WriteString(strings.ReplaceAll(out.String(), "\n", "\r\n"))
+}
+
+// formatBytes formats a number of bytes with a binary unit prefix.
+func formatBytes(bytes float64) string {
+	units := []string{"B", "KiB", "MiB", "GiB", "TiB"}
+	unit := 0
+	for bytes >= 1024 && unit < len(units)-1 {
+		bytes /= 1024
+		unit += 1
+	}
+	return fmt.Sprintf("%.1f %s", bytes, units[unit])
+}
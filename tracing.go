@@ -0,0 +1,40 @@
+package main
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.17.0"
+)
+
+// tracer records spans of the collection pipeline. It stays a no-op unless
+// setupTracing installs a provider.
+var tracer = otel.Tracer("fastd-exporter")
+
+// setupTracing exports spans to the OTLP endpoint configured by
+// --tracing.otlp-endpoint, if any.
+func setupTracing() error {
+	if *tracingEndpoint == "" {
+		return nil
+	}
+
+	options := []otlptracehttp.Option{otlptracehttp.WithEndpoint(*tracingEndpoint)}
+	if *tracingInsecure {
+		options = append(options, otlptracehttp.WithInsecure())
+	}
+
+	exporter, err := otlptracehttp.New(context.Background(), options...)
+	if err != nil {
+		return err
+	}
+
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewWithAttributes(semconv.SchemaURL, semconv.ServiceName("fastd-exporter"))),
+	))
+
+	return nil
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// peersTrend keeps the number of connected peers of the status reads within
+// --peers-trend.window to fit a linear trend to.
+type peersTrend struct {
+	statusWindow[int]
+}
+
+// perHour returns the slope of the least squares fit of the number of
+// connected peers over time, false if there are not enough samples yet.
+func (trend *peersTrend) perHour() (float64, bool) {
+	if len(trend.samples) < 2 {
+		return 0, false
+	}
+
+	// hours since the first sample, to keep the sums small
+	start := trend.samples[0].time
+	var sumX, sumY, sumXY, sumXX float64
+	for _, sample := range trend.samples {
+		x := sample.time.Sub(start).Hours()
+		y := float64(sample.value)
+		sumX += x
+		sumY += y
+		sumXY += x * y
+		sumXX += x * x
+	}
+
+	n := float64(len(trend.samples))
+	denominator := n*sumXX - sumX*sumX
+	if denominator == 0 {
+		return 0, false
+	}
+	return (n*sumXY - sumX*sumY) / denominator, true
+}
+
+// recordPeersTrend adds the number of connected peers at a status read to
+// the trend of the instance.
+func (exporter *PrometheusExporter) recordPeersTrend(peers int, readTime time.Time) {
+	if *peersTrendWindow <= 0 {
+		return
+	}
+
+	exporter.peersTrendMutex.Lock()
+	defer exporter.peersTrendMutex.Unlock()
+
+	exporter.peersTrend.record(peers, readTime, *peersTrendWindow)
+}
+
+// collectPeersTrend exports the trend of the number of connected peers
+// within --peers-trend.window.
+func (exporter *PrometheusExporter) collectPeersTrend(channel chan<- prometheus.Metric) {
+	exporter.peersTrendMutex.Lock()
+	defer exporter.peersTrendMutex.Unlock()
+
+	perHour, ok := exporter.peersTrend.perHour()
+	if !ok {
+		return
+	}
+	channel <- prometheus.MustNewConstMetric(exporter.peersTrendPerHour, prometheus.GaugeValue, perHour)
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// maxUnknownKeyPrefixes limits the key prefixes of unknown peers tracked per
+// instance, further prefixes are counted as "other".
+const maxUnknownKeyPrefixes = 256
+
+// verifyHookHandler serves /hooks/verify, which the on verify hook of fastd
+// calls with the instance and public key of every unknown peer attempting a
+// handshake. Only requests from loopback addresses are accepted.
+func verifyHookHandler(exporters []*PrometheusExporter) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		host, _, err := net.SplitHostPort(r.RemoteAddr)
+		if ip := net.ParseIP(host); err != nil || ip == nil || !ip.IsLoopback() {
+			http.Error(w, "verify hook requests must come from the local host", http.StatusForbidden)
+			return
+		}
+
+		publicKey := strings.ToLower(r.FormValue("key"))
+		if !publicKeyPattern.MatchString(publicKey) {
+			http.Error(w, "invalid public key", http.StatusBadRequest)
+			return
+		}
+
+		instance := r.FormValue("instance")
+		for _, exporter := range exporters {
+			if exporter.instance == instance {
+				exporter.recordUnknownPeer(publicKey)
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+		}
+		http.Error(w, "unknown instance", http.StatusNotFound)
+	})
+}
+
+// recordUnknownPeer counts a handshake attempt of a peer unknown to fastd.
+func (exporter *PrometheusExporter) recordUnknownPeer(publicKey string) {
+	exporter.unknownPeersMutex.Lock()
+	defer exporter.unknownPeersMutex.Unlock()
+
+	prefix := ""
+	if *verifyHookKeyPrefix > 0 {
+		prefix = publicKey
+		if len(prefix) > *verifyHookKeyPrefix {
+			prefix = prefix[:*verifyHookKeyPrefix]
+		}
+		if _, ok := exporter.unknownPeers[prefix]; !ok && len(exporter.unknownPeers) >= maxUnknownKeyPrefixes {
+			prefix = "other"
+		}
+	}
+
+	exporter.unknownPeers[prefix] += 1
+	exporter.recordHandshakeAttempt(time.Now())
+}
+
+// collectUnknownPeers exports the handshake attempts of unknown peers.
+func (exporter *PrometheusExporter) collectUnknownPeers(channel chan<- prometheus.Metric) {
+	exporter.unknownPeersMutex.Lock()
+	defer exporter.unknownPeersMutex.Unlock()
+
+	if *verifyHookKeyPrefix == 0 {
+		channel <- prometheus.MustNewConstMetric(exporter.unknownPeerAttempts, prometheus.CounterValue, float64(exporter.unknownPeers[""]))
+		return
+	}
+	for prefix, count := range exporter.unknownPeers {
+		channel <- prometheus.MustNewConstMetric(exporter.unknownPeerAttempts, prometheus.CounterValue, float64(count), prefix)
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// runVersionCheck determines the version of the fastd binary of an instance
+// every --fastd-version.interval. The binary of the running process is
+// preferred, it is still the old release after an upgrade until fastd is
+// restarted. Instances on other hosts are skipped.
+func (exporter *PrometheusExporter) runVersionCheck() {
+	if isRemoteStatusSocket(exporter.statusSocketPath) {
+		return
+	}
+	if _, ok := agentSnapshotKey(exporter.statusSocketPath); ok {
+		return
+	}
+
+	ticker := time.NewTicker(*fastdVersionInterval)
+	defer ticker.Stop()
+
+	for {
+		var version string
+		var err error
+		if pid, ok := exporter.fastdProcess(); ok {
+			// works even if the binary was replaced on disk, but not if
+			// fastd runs as another user and the exporter is not root
+			version, err = fastdVersion(fmt.Sprintf("/proc/%d/exe", pid))
+		}
+		if version == "" {
+			version, err = fastdVersion(*fastdVersionBinary)
+		}
+		if err != nil {
+			logRepeated("Failed to determine the fastd version of %s: %v", exporter.instance, err)
+		}
+
+		exporter.versionMutex.Lock()
+		exporter.version = version
+		exporter.versionMutex.Unlock()
+
+		<-ticker.C
+	}
+}
+
+// fastdProcess finds the fastd process of the instance by its config or its
+// status socket on the command line.
+func (exporter *PrometheusExporter) fastdProcess() (int, bool) {
+	var needles []string
+	if exporter.configPath != "" {
+		needles = append(needles, exporter.configPath)
+	}
+	if !isRemoteStatusSocket(exporter.statusSocketPath) {
+		needles = append(needles, exporter.statusSocketPath)
+	}
+
+	paths, _ := filepath.Glob("/proc/[0-9]*/cmdline")
+	for _, path := range paths {
+		cmdline, err := os.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		args := strings.Split(string(cmdline), "\x00")
+		if filepath.Base(args[0]) != "fastd" {
+			continue
+		}
+		for _, arg := range args[1:] {
+			for _, needle := range needles {
+				if arg == needle || strings.HasSuffix(arg, "="+needle) {
+					var pid int
+					_, _ = fmt.Sscanf(path, "/proc/%d/cmdline", &pid)
+					return pid, true
+				}
+			}
+		}
+	}
+	return 0, false
+}
+
+// fastdVersion runs a fastd binary with --version, which prints e.g.
+// "fastd v22", and returns the version.
+func fastdVersion(binary string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), *socketTimeout)
+	defer cancel()
+
+	output, err := exec.CommandContext(ctx, binary, "--version").Output()
+	if err != nil {
+		return "", err
+	}
+	version := strings.TrimPrefix(string(bytes.TrimSpace(output)), "fastd ")
+	if version == "" || strings.ContainsAny(version, "\n") {
+		return "", fmt.Errorf("unexpected output %q", output)
+	}
+	return version, nil
+}
+
+// collectVersion exports the version of the fastd binary once it is known.
+func (exporter *PrometheusExporter) collectVersion(channel chan<- prometheus.Metric) {
+	exporter.versionMutex.Lock()
+	defer exporter.versionMutex.Unlock()
+
+	if exporter.version != "" {
+		channel <- prometheus.MustNewConstMetric(exporter.versionInfo, prometheus.GaugeValue, 1, exporter.version)
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import "time"
+
+// windowSample holds a value derived from the status of an instance at a
+// status read.
+type windowSample[T any] struct {
+	time  time.Time
+	value T
+}
+
+// statusWindow keeps the values of the status reads of an instance within
+// a window, including those of the poller.
+type statusWindow[T any] struct {
+	samples []windowSample[T]
+}
+
+// last returns the most recent sample, false if there is none.
+func (window *statusWindow[T]) last() (windowSample[T], bool) {
+	if len(window.samples) == 0 {
+		return windowSample[T]{}, false
+	}
+	return window.samples[len(window.samples)-1], true
+}
+
+// record adds the value of a status read and drops the samples that left
+// the window. The last sample before the window is kept as its start. Reads
+// that are not newer than the last sample are ignored.
+func (window *statusWindow[T]) record(value T, readTime time.Time, length time.Duration) {
+	if last, ok := window.last(); ok && !readTime.After(last.time) {
+		return
+	}
+	window.samples = append(window.samples, windowSample[T]{time: readTime, value: value})
+
+	expired := 0
+	for expired < len(window.samples)-1 && readTime.Sub(window.samples[expired+1].time) >= length {
+		expired += 1
+	}
+	window.samples = window.samples[expired:]
+}
+
+// reset drops all samples, e.g. when the counters of a restarted fastd
+// start over.
+func (window *statusWindow[T]) reset() {
+	window.samples = nil
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestStatusWindowExpiry(t *testing.T) {
+	start := time.Unix(0, 0)
+	var window statusWindow[int]
+	for i := 0; i <= 10; i++ {
+		window.record(i, start.Add(time.Duration(i)*time.Minute), 5*time.Minute)
+	}
+	// reads that are not newer are ignored
+	window.record(99, start.Add(5*time.Minute), 5*time.Minute)
+
+	if len(window.samples) != 6 || window.samples[0].value != 5 || window.samples[5].value != 10 {
+		t.Errorf("got samples %v, want 5 to 10", window.samples)
+	}
+}
+
+func TestPeersTrend(t *testing.T) {
+	start := time.Unix(0, 0)
+	var trend peersTrend
+	if _, ok := trend.perHour(); ok {
+		t.Error("trend without samples")
+	}
+	for i := 0; i < 7; i++ {
+		trend.record(100+5*i, start.Add(time.Duration(i)*10*time.Minute), time.Hour)
+	}
+
+	if perHour, ok := trend.perHour(); !ok || math.Abs(perHour-30) > 1e-9 {
+		t.Errorf("got %v peers per hour, want 30", perHour)
+	}
+}
+
+func TestTxRatios(t *testing.T) {
+	start := time.Unix(0, 0)
+	statistics := func(tx, dropped, errors int) Statistics {
+		return Statistics{
+			Tx:        PacketStatistics{Count: tx},
+			TxDropped: &PacketStatistics{Count: dropped},
+			TxError:   &PacketStatistics{Count: errors},
+		}
+	}
+
+	var ratios txRatios
+	ratios.recordCounters(statistics(1000, 100, 10), start, time.Hour)
+	ratios.recordCounters(statistics(1080, 115, 15), start.Add(time.Minute), time.Hour)
+	if dropped, errors, ok := ratios.ratios(); !ok || dropped != 0.15 || errors != 0.05 {
+		t.Errorf("got ratios %v and %v, want 0.15 and 0.05", dropped, errors)
+	}
+
+	// a restarted fastd starts over
+	ratios.recordCounters(statistics(10, 0, 0), start.Add(2*time.Minute), time.Hour)
+	if _, _, ok := ratios.ratios(); ok {
+		t.Error("ratios across a restart of fastd")
+	}
+}